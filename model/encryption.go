@@ -0,0 +1,55 @@
+package model
+
+import (
+	"encoding/json"
+	"io/ioutil"
+
+	"github.com/knanao/goauth/server/envelope"
+	"github.com/knanao/goauth/server/internal/fileutil"
+)
+
+// EncryptUserFile はJSONファイルをkeyringの先頭の鍵で暗号化し直す
+//
+// 暗号化されていないファイルは暗号化し、古い鍵で暗号化されたファイルは鍵を入れ替える
+func EncryptUserFile(path string, keyring *envelope.Keyring) error {
+	if keyring == nil {
+		return envelope.ErrorNoKey
+	}
+	plain, err := readUserFile(path, keyring)
+	if err != nil {
+		return err
+	}
+	data, err := keyring.Seal(plain)
+	if err != nil {
+		return err
+	}
+	return fileutil.WriteAtomic(path, data, 0600)
+}
+
+// DecryptUserFile は暗号化されたJSONファイルを平文に戻す
+func DecryptUserFile(path string, keyring *envelope.Keyring) error {
+	plain, err := readUserFile(path, keyring)
+	if err != nil {
+		return err
+	}
+	return fileutil.WriteAtomic(path, plain, 0600)
+}
+
+// readUserFile はファイルを復号し、ユーザーの一覧として読み込めることを確認する
+func readUserFile(path string, keyring *envelope.Keyring) ([]byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if envelope.IsSealed(data) {
+		data, _, err = keyring.Open(data)
+		if err != nil {
+			return nil, err
+		}
+	}
+	var records []User
+	if err := json.Unmarshal(data, &records); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
@@ -0,0 +1,23 @@
+package model
+
+import (
+	"time"
+
+	"github.com/knanao/goauth/server/setting"
+)
+
+// PasswordExpired はパスワードが設定された有効期間を過ぎているかを返す
+//
+// 変更日時が記録されていない古いデータは期限切れとして扱わない
+func (u *User) PasswordExpired(now time.Time) bool {
+	maxAge := setting.RealmFor(u.Realm).PasswordPolicy.MaxAge
+	if maxAge <= 0 || u.PasswordChangedAt.IsZero() {
+		return false
+	}
+	return now.After(u.PasswordChangedAt.Add(maxAge))
+}
+
+// PasswordChangeRequired は次のログインでパスワードの変更が必要かを返す
+func (u *User) PasswordChangeRequired(now time.Time) bool {
+	return u.MustChangePassword || u.PasswordExpired(now)
+}
@@ -0,0 +1,52 @@
+package model
+
+import (
+	"github.com/knanao/goauth/server/setting"
+)
+
+const ViolationReused = "reused"
+
+// checkPasswordHistory は新しいパスワードが現在または過去のパスワードと一致しないかを確認する
+//
+// ハッシュは形式を判別して検証するため、アルゴリズムを変更した後の履歴にも使用できる
+func checkPasswordHistory(password string, u *User) error {
+	if setting.RealmFor(u.Realm).PasswordPolicy.HistoryDepth <= 0 {
+		return nil
+	}
+	hashes := append([]PasswordHash{u.Password}, u.PasswordHistory...)
+	for _, x := range hashes {
+		if x == "" {
+			continue
+		}
+		match, err := VerifyPassword(password, x)
+		if err != nil {
+			// 読めない古い履歴は比較の対象にしない
+			continue
+		}
+		if match {
+			return &PasswordPolicyError{[]PolicyViolation{{ViolationReused,
+				"Password must not be the same as a recently used password."}}}
+		}
+	}
+	return nil
+}
+
+// pushPasswordHistory は変更前のハッシュを履歴の先頭に追加し、設定された件数に切り詰める
+func pushPasswordHistory(u *User, old PasswordHash) {
+	depth := setting.RealmFor(u.Realm).PasswordPolicy.HistoryDepth
+	if depth <= 0 || old == "" {
+		u.PasswordHistory = nil
+		return
+	}
+	history := append([]PasswordHash{old}, u.PasswordHistory...)
+	if len(history) > depth {
+		history = history[:depth]
+	}
+	u.PasswordHistory = history
+}
+
+// copyPublic はパスワードの履歴を含めずにユーザーをコピーする
+func (u *User) copyPublic(f *User) {
+	u.Copy(f)
+	u.PasswordHistory = nil
+}
@@ -0,0 +1,225 @@
+package model
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"strings"
+)
+
+// Apache htpasswdで使用される形式のハッシュ
+//
+//	apr1-md5  $apr1$<salt>$<hash>
+//	md5-crypt $1$<salt>$<hash>
+//	sha1      {SHA}<base64>
+//	des-crypt 2文字のソルトと11文字のハッシュ
+//
+// htpasswdファイルのユーザーを検証するための形式で、新しいハッシュの作成には使用しない
+const (
+	AlgorithmAPR1MD5  = "apr1-md5"
+	AlgorithmMD5Crypt = "md5-crypt"
+	AlgorithmSHA1     = "sha1"
+	AlgorithmDESCrypt = "des-crypt"
+)
+
+const md5CryptMaxSalt = 8
+
+var md5CryptOrder = [][]int{
+	{0, 6, 12}, {1, 7, 13}, {2, 8, 14}, {3, 9, 15}, {4, 10, 5},
+	{-1, -1, 11},
+}
+
+type md5CryptHasher struct {
+	algorithm string
+	prefix    string
+}
+
+func newAPR1Hasher() *md5CryptHasher {
+	return &md5CryptHasher{AlgorithmAPR1MD5, "$apr1$"}
+}
+
+func newMD5CryptHasher() *md5CryptHasher {
+	return &md5CryptHasher{AlgorithmMD5Crypt, "$1$"}
+}
+
+func (h *md5CryptHasher) Algorithm() string {
+	return h.algorithm
+}
+
+func (h *md5CryptHasher) Match(hash PasswordHash) bool {
+	return strings.HasPrefix(string(hash), h.prefix)
+}
+
+func (h *md5CryptHasher) Hash(password []byte) (PasswordHash, error) {
+	salt, err := createSalt()
+	if err != nil {
+		return "", err
+	}
+	return h.crypt(password, cryptBase64(salt)[:md5CryptMaxSalt]), nil
+}
+
+func (h *md5CryptHasher) Verify(password []byte, hash PasswordHash) (bool, error) {
+	salt, err := h.parse(hash)
+	if err != nil {
+		return false, err
+	}
+	other := h.crypt(password, salt)
+	return subtle.ConstantTimeCompare([]byte(hash), []byte(other)) == 1, nil
+}
+
+func (h *md5CryptHasher) NeedsRehash(hash PasswordHash) bool {
+	return true
+}
+
+// parse は "$apr1$salt$hash" 形式からソルトを取り出す
+func (h *md5CryptHasher) parse(hash PasswordHash) (string, error) {
+	parts := strings.Split(strings.TrimPrefix(string(hash), h.prefix), "$")
+	if len(parts) != 2 || len(parts[0]) > md5CryptMaxSalt || len(parts[1]) != 22 {
+		return "", ErrorInvalidHash
+	}
+	return parts[0], nil
+}
+
+func (h *md5CryptHasher) crypt(password []byte, salt string) PasswordHash {
+	s := []byte(salt)
+	b := md5.New()
+	b.Write(password)
+	b.Write(s)
+	b.Write(password)
+	digestB := b.Sum(nil)
+
+	a := md5.New()
+	a.Write(password)
+	a.Write([]byte(h.prefix))
+	a.Write(s)
+	a.Write(repeatBytes(digestB, len(password)))
+	for i := len(password); i > 0; i >>= 1 {
+		if i&1 != 0 {
+			a.Write([]byte{0})
+		} else {
+			a.Write(password[:1])
+		}
+	}
+	digestA := a.Sum(nil)
+
+	for i := 0; i < 1000; i++ {
+		c := md5.New()
+		if i&1 != 0 {
+			c.Write(password)
+		} else {
+			c.Write(digestA)
+		}
+		if i%3 != 0 {
+			c.Write(s)
+		}
+		if i%7 != 0 {
+			c.Write(password)
+		}
+		if i&1 != 0 {
+			c.Write(digestA)
+		} else {
+			c.Write(password)
+		}
+		digestA = c.Sum(nil)
+	}
+	return PasswordHash(h.prefix + salt + "$" + cryptEncode(md5CryptOrder, digestA))
+}
+
+type sha1Hasher struct{}
+
+const sha1Prefix = "{SHA}"
+
+func (h *sha1Hasher) Algorithm() string {
+	return AlgorithmSHA1
+}
+
+func (h *sha1Hasher) Match(hash PasswordHash) bool {
+	return strings.HasPrefix(string(hash), sha1Prefix)
+}
+
+func (h *sha1Hasher) Hash(password []byte) (PasswordHash, error) {
+	sum := sha1.Sum(password)
+	return PasswordHash(sha1Prefix + base64.StdEncoding.EncodeToString(sum[:])), nil
+}
+
+func (h *sha1Hasher) Verify(password []byte, hash PasswordHash) (bool, error) {
+	if len(hash) != len(sha1Prefix)+28 {
+		return false, ErrorInvalidHash
+	}
+	other, _ := h.Hash(password)
+	return subtle.ConstantTimeCompare([]byte(hash), []byte(other)) == 1, nil
+}
+
+func (h *sha1Hasher) NeedsRehash(hash PasswordHash) bool {
+	return true
+}
+
+// desCryptHasher は従来のcrypt(3)のDESによる形式
+//
+// パスワードは先頭の8文字のみが使用される
+type desCryptHasher struct{}
+
+func (h *desCryptHasher) Algorithm() string {
+	return AlgorithmDESCrypt
+}
+
+func (h *desCryptHasher) Match(hash PasswordHash) bool {
+	if len(hash) != 13 {
+		return false
+	}
+	for i := 0; i < len(hash); i++ {
+		if strings.IndexByte(cryptAlphabet, hash[i]) < 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (h *desCryptHasher) Hash(password []byte) (PasswordHash, error) {
+	b := make([]byte, 2)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	salt := string([]byte{cryptAlphabet[b[0]&0x3f], cryptAlphabet[b[1]&0x3f]})
+	return desCrypt(password, salt), nil
+}
+
+func (h *desCryptHasher) Verify(password []byte, hash PasswordHash) (bool, error) {
+	if !h.Match(hash) {
+		return false, ErrorInvalidHash
+	}
+	other := desCrypt(password, string(hash[:2]))
+	return subtle.ConstantTimeCompare([]byte(hash), []byte(other)) == 1, nil
+}
+
+func (h *desCryptHasher) NeedsRehash(hash PasswordHash) bool {
+	return true
+}
+
+// cryptEncode はダイジェストをorderの順に3バイトずつまとめてcrypt形式のアルファベットで出力する
+func cryptEncode(order [][]int, digest []byte) string {
+	out := strings.Builder{}
+	for _, g := range order {
+		var w uint
+		n := 0
+		for _, x := range g {
+			w <<= 8
+			if x >= 0 {
+				w |= uint(digest[x])
+				n++
+			}
+		}
+		// 最後のグループは含まれるバイト数に応じた文字数だけ出力する
+		chars := 4
+		if n < 3 {
+			chars = n + 1
+		}
+		for j := 0; j < chars; j++ {
+			out.WriteByte(cryptAlphabet[w&0x3f])
+			w >>= 6
+		}
+	}
+	return out.String()
+}
@@ -0,0 +1,137 @@
+package model
+
+import (
+	"sort"
+)
+
+// index はユーザーの属性値からIDを引くための二次インデックス
+type index struct {
+	keys    func(u *User) []string
+	entries map[string]*indexEntry
+}
+
+// indexEntry はキーに一致するIDの集合
+//
+// ID順のスライスは最初の検索で作成して変更されるまで使い回すため、
+// 更新が続く読み込み時には並べ替えず、検索のたびに割り当てることもない
+type indexEntry struct {
+	ids    map[ID]struct{}
+	sorted []ID // nilの場合は作り直す
+}
+
+func newIndex(keys func(u *User) []string) *index {
+	return &index{keys, make(map[string]*indexEntry)}
+}
+
+func (x *index) add(u *User) {
+	for _, k := range x.keys(u) {
+		entry, ok := x.entries[k]
+		if !ok {
+			entry = &indexEntry{ids: make(map[ID]struct{})}
+			x.entries[k] = entry
+		}
+		if _, ok := entry.ids[u.ID]; ok {
+			continue
+		}
+		entry.ids[u.ID] = struct{}{}
+		entry.sorted = nil
+	}
+}
+
+func (x *index) remove(u *User) {
+	for _, k := range x.keys(u) {
+		entry, ok := x.entries[k]
+		if !ok {
+			continue
+		}
+		delete(entry.ids, u.ID)
+		entry.sorted = nil
+		if len(entry.ids) <= 0 {
+			delete(x.entries, k)
+		}
+	}
+}
+
+// lookup はキーに一致するIDをID順で返す
+//
+// 返したスライスは変更しない。インデックスの更新後は新しいスライスを作成するため、
+// 返したスライスの内容は変わらない
+func (x *index) lookup(key string) []ID {
+	entry, ok := x.entries[key]
+	if !ok {
+		return nil
+	}
+	if entry.sorted == nil {
+		sorted := make([]ID, 0, len(entry.ids))
+		for id := range entry.ids {
+			sorted = append(sorted, id)
+		}
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+		entry.sorted = sorted
+	}
+	return entry.sorted
+}
+
+// exists はexceptID以外にキーに一致するIDがあるかを返す
+func (x *index) exists(key string, exceptID ID) bool {
+	entry, ok := x.entries[key]
+	if !ok {
+		return false
+	}
+	if len(entry.ids) > 1 {
+		return true
+	}
+	_, self := entry.ids[exceptID]
+	return len(entry.ids) == 1 && !self
+}
+
+var (
+	userIDIndex *index
+	roleIndex   *index
+	groupIndex  *index
+)
+
+// allIndexes は更新時に維持するすべてのインデックス
+var allIndexes []*index
+
+func initIndexes() {
+	userIDIndex = newIndex(func(u *User) []string {
+		return []string{realmUserKey(u.Realm, u.UserID)}
+	})
+	roleIndex = newIndex(func(u *User) []string {
+		res := make([]string, len(u.Roles))
+		for i, x := range u.Roles {
+			res[i] = string(x)
+		}
+		return res
+	})
+	groupIndex = newIndex(func(u *User) []string {
+		return append([]string{}, u.Groups...)
+	})
+	allIndexes = []*index{userIDIndex, roleIndex, groupIndex}
+}
+
+// putUser はユーザーを保存してインデックスを更新する
+func putUser(u User) {
+	if old, ok := users[u.ID]; ok {
+		for _, x := range allIndexes {
+			x.remove(&old)
+		}
+	}
+	users[u.ID] = u
+	for _, x := range allIndexes {
+		x.add(&u)
+	}
+}
+
+// removeUser はユーザーを削除してインデックスを更新する
+func removeUser(id ID) {
+	old, ok := users[id]
+	if !ok {
+		return
+	}
+	for _, x := range allIndexes {
+		x.remove(&old)
+	}
+	delete(users, id)
+}
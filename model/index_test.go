@@ -0,0 +1,180 @@
+package model
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/knanao/goauth/server/setting"
+)
+
+func resetUsers() {
+	users = make(map[ID]User)
+	initIndexes()
+}
+
+func TestIndexLookupSorted(t *testing.T) {
+	resetUsers()
+	for _, id := range []ID{"c", "a", "b", "a"} {
+		putUser(User{ID: id, UserID: string(id), Roles: []Role{RoleUser}})
+	}
+	if got, want := roleIndex.lookup(string(RoleUser)), []ID{"a", "b", "c"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("lookup = %v, want %v", got, want)
+	}
+	removeUser("b")
+	if got, want := roleIndex.lookup(string(RoleUser)), []ID{"a", "c"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("lookup after remove = %v, want %v", got, want)
+	}
+	removeUser("a")
+	removeUser("c")
+	if got := roleIndex.lookup(string(RoleUser)); len(got) != 0 {
+		t.Fatalf("lookup after removing all = %v, want empty", got)
+	}
+	if _, ok := roleIndex.entries[string(RoleUser)]; ok {
+		t.Fatal("empty key is left in the index")
+	}
+}
+
+func TestIndexLookupIsStable(t *testing.T) {
+	resetUsers()
+	putUser(User{ID: "b", UserID: "b", Roles: []Role{RoleUser}})
+	putUser(User{ID: "d", UserID: "d", Roles: []Role{RoleUser}})
+	got := roleIndex.lookup(string(RoleUser))
+	putUser(User{ID: "a", UserID: "a", Roles: []Role{RoleUser}})
+	removeUser("d")
+	if want := []ID{"b", "d"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("returned slice changed to %v, want %v", got, want)
+	}
+}
+
+func TestUserIDIndexNormalizedKeys(t *testing.T) {
+	resetUsers()
+	putUser(User{ID: "1", UserID: "alice"})
+	putUser(User{ID: "2", Realm: "partner", UserID: "alice"})
+	tests := []struct {
+		realm  string
+		userID string
+		want   []ID
+	}{
+		{"", "alice", []ID{"1"}},
+		{"", "ALICE", []ID{"1"}},
+		{"", "Alice", []ID{"1"}},
+		{"", "ａｌｉｃｅ", []ID{"1"}}, // 全角は半角に揃える
+		{"default", "alice", []ID{"1"}},
+		{"partner", "Alice", []ID{"2"}},
+		{"other", "alice", nil},
+		{"", "bob", nil},
+	}
+	for _, x := range tests {
+		got := userIDIndex.lookup(realmUserKey(x.realm, x.userID))
+		if len(got) == 0 && len(x.want) == 0 {
+			continue
+		}
+		if !reflect.DeepEqual(got, x.want) {
+			t.Errorf("lookup(%q, %q) = %v, want %v", x.realm, x.userID, got, x.want)
+		}
+	}
+	if !userIDIndex.exists(realmUserKey("", "ALICE"), "") {
+		t.Error("exists(ALICE) = false, want true")
+	}
+	if userIDIndex.exists(realmUserKey("", "ALICE"), "1") {
+		t.Error("exists(ALICE) excluding its own ID = true, want false")
+	}
+}
+
+func TestUserIDIndexRename(t *testing.T) {
+	resetUsers()
+	putUser(User{ID: "1", UserID: "alice", Roles: []Role{RoleUser}})
+	putUser(User{ID: "1", UserID: "carol", Roles: []Role{RoleAdmin}})
+	if got := userIDIndex.lookup(realmUserKey("", "alice")); len(got) != 0 {
+		t.Errorf("old user_id still indexed: %v", got)
+	}
+	if got := userIDIndex.lookup(realmUserKey("", "Carol")); !reflect.DeepEqual(got, []ID{"1"}) {
+		t.Errorf("lookup(Carol) = %v, want [1]", got)
+	}
+	if got := roleIndex.lookup(string(RoleUser)); len(got) != 0 {
+		t.Errorf("old role still indexed: %v", got)
+	}
+}
+
+// benchmarkSizes はベンチマークで使用するユーザー数
+var benchmarkSizes = []int{10000, 100000}
+
+func setupBenchmarkUsers(n int) {
+	resetUsers()
+	roles := []Role{RoleUser, RoleAdmin}
+	for i := 0; i < n; i++ {
+		putUser(User{
+			ID:     ID(fmt.Sprintf("id-%06d", i)),
+			UserID: fmt.Sprintf("user%06d", i),
+			Roles:  []Role{roles[i%len(roles)]},
+		})
+	}
+}
+
+// benchmarkEachSize はユーザー数ごとにデータを用意してベンチマークを実行する
+func benchmarkEachSize(b *testing.B, f func(b *testing.B, n int)) {
+	for _, n := range benchmarkSizes {
+		b.Run(fmt.Sprintf("users=%d", n), func(b *testing.B) {
+			setupBenchmarkUsers(n)
+			b.ReportAllocs()
+			b.ResetTimer()
+			f(b, n)
+		})
+	}
+}
+
+func BenchmarkUserIDLookup(b *testing.B) {
+	benchmarkEachSize(b, func(b *testing.B, n int) {
+		key := realmUserKey("", fmt.Sprintf("USER%06d", n/2))
+		for i := 0; i < b.N; i++ {
+			if len(userIDIndex.lookup(key)) != 1 {
+				b.Fatal("not found")
+			}
+		}
+	})
+}
+
+// BenchmarkFindByUserIDLinearScan はインデックスを使用する前の全件の走査との比較に使用する
+func BenchmarkFindByUserIDLinearScan(b *testing.B) {
+	benchmarkEachSize(b, func(b *testing.B, n int) {
+		userID := fmt.Sprintf("user%06d", n/2)
+		for i := 0; i < b.N; i++ {
+			results := []User{}
+			for _, x := range users {
+				if x.RealmName() == setting.DefaultRealm && x.UserID == userID {
+					results = append(results, x)
+				}
+			}
+			if len(results) != 1 {
+				b.Fatal("not found")
+			}
+		}
+	})
+}
+
+func BenchmarkUserIDKey(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		realmUserKey("", "USER005000")
+	}
+}
+
+func BenchmarkRoleLookup(b *testing.B) {
+	benchmarkEachSize(b, func(b *testing.B, n int) {
+		for i := 0; i < b.N; i++ {
+			if len(roleIndex.lookup(string(RoleAdmin))) != n/2 {
+				b.Fatal("unexpected count")
+			}
+		}
+	})
+}
+
+func BenchmarkPutUser(b *testing.B) {
+	benchmarkEachSize(b, func(b *testing.B, n int) {
+		id := ID(fmt.Sprintf("id-%06d", n/2))
+		for i := 0; i < b.N; i++ {
+			putUser(User{ID: id, UserID: fmt.Sprintf("renamed%d", i%2), Roles: []Role{RoleAdmin}})
+		}
+	})
+}
@@ -0,0 +1,95 @@
+package model
+
+import (
+	"context"
+	"time"
+
+	"github.com/knanao/goauth/server/setting"
+)
+
+// IsLocked はアカウントがロックされているかを返す
+func (u *User) IsLocked(now time.Time) bool {
+	return now.Before(u.LockedUntil)
+}
+
+// lockoutCooldown はlockouts回目のロックの期間を返す。ロックのたびに倍になる
+func lockoutCooldown(lockouts int) time.Duration {
+	cooldown := setting.Lockout.Cooldown
+	for i := 1; i < lockouts; i++ {
+		cooldown *= 2
+		if cooldown >= setting.Lockout.MaxCooldown {
+			return setting.Lockout.MaxCooldown
+		}
+	}
+	return cooldown
+}
+
+// recordLoginFailure はログインの失敗回数を数え、上限に達した場合はアカウントをロックする
+func recordLoginFailure(u *User, now time.Time) {
+	if setting.Lockout.MaxFailures <= 0 {
+		return
+	}
+	u.FailedLogins++
+	if u.FailedLogins < setting.Lockout.MaxFailures {
+		return
+	}
+	u.Lockouts++
+	u.FailedLogins = 0
+	u.LockedUntil = now.Add(lockoutCooldown(u.Lockouts))
+}
+
+// resetLockout はログインの失敗回数とロックを解除する
+func resetLockout(u *User) {
+	u.FailedLogins = 0
+	u.Lockouts = 0
+	u.LockedUntil = time.Time{}
+}
+
+func (a *UserDataAccessor) LoginFailed(id ID) (User, error) {
+	return a.LoginFailedContext(context.Background(), id)
+}
+
+func (a *UserDataAccessor) LoginFailedContext(ctx context.Context, id ID) (User, error) {
+	req := []interface{}{id, time.Now()}
+	resp := a.send(ctx, commandLoginFailed, req)
+	var res User
+	if resp.err != nil {
+		e.Logger.Debugf("User[ID=%s] Record login failure Error. [%s]", id, resp.err)
+		return res, resp.err
+	}
+	if res, ok := resp.result[0].(User); ok {
+		return res, nil
+	}
+	e.Logger.Debugf("User[ID=%s] Record login failure Error. [%s]", id, ErrorOther)
+	return res, ErrorOther
+}
+
+// LoginSucceeded はログインの失敗回数をリセットし、最終ログインを記録する
+func (a *UserDataAccessor) LoginSucceeded(id ID, ip string) error {
+	return a.LoginSucceededContext(context.Background(), id, ip)
+}
+
+func (a *UserDataAccessor) LoginSucceededContext(ctx context.Context, id ID, ip string) error {
+	req := []interface{}{id, time.Now(), ip}
+	resp := a.send(ctx, commandLoginSucceeded, req)
+	if resp.err != nil {
+		e.Logger.Debugf("User[ID=%s] Record login Error. [%s]", id, resp.err)
+		return resp.err
+	}
+	return nil
+}
+
+// Unlock はロックされたアカウントを管理者が解除する
+func (a *UserDataAccessor) Unlock(id ID) error {
+	return a.UnlockContext(context.Background(), id)
+}
+
+func (a *UserDataAccessor) UnlockContext(ctx context.Context, id ID) error {
+	req := []interface{}{id}
+	resp := a.send(ctx, commandUnlock, req)
+	if resp.err != nil {
+		e.Logger.Debugf("User[ID=%s] Unlock Error. [%s]", id, resp.err)
+		return resp.err
+	}
+	return nil
+}
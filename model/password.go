@@ -0,0 +1,533 @@
+package model
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/knanao/goauth/server/setting"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/crypto/scrypt"
+)
+
+// PasswordHash はアルゴリズムとパラメータ、ソルトを含む自己記述的なハッシュ文字列
+//
+//	bcrypt        $2a$12$<salt+hash>
+//	scrypt        $scrypt$n=32768,r=8,p=1$<salt>$<hash>
+//	argon2id      $argon2id$v=19$m=65536,t=3,p=2$<salt>$<hash>
+//	pbkdf2-sha256 $pbkdf2-sha256$i=310000$<salt>$<hash>
+//	md5(旧形式)   32桁の16進数
+//
+// ペッパーを付与して作成したハッシュは先頭にpepperMarkerを付ける。
+// htpasswdの形式はhtpasswd_hash.goを参照
+type PasswordHash string
+
+// pepperMarker はこのサーバーがペッパーを付与して作成したハッシュの目印
+const pepperMarker = "{pepper}"
+
+const (
+	AlgorithmMD5          = "md5"
+	AlgorithmBcrypt       = "bcrypt"
+	AlgorithmScrypt       = "scrypt"
+	AlgorithmArgon2id     = "argon2id"
+	AlgorithmPBKDF2SHA256 = "pbkdf2-sha256"
+)
+
+var (
+	ErrorUnknownAlgorithm = errors.New("Unknown Algorithm")
+	ErrorInvalidHash      = errors.New("Invalid Hash")
+	ErrorPepperRequired   = errors.New("Pepper Required")
+)
+
+type PasswordHasher interface {
+	// Algorithm はハッシュ形式の名前を返す
+	Algorithm() string
+	// Match はハッシュがこのアルゴリズムの形式であるかを返す
+	Match(hash PasswordHash) bool
+	Hash(password []byte) (PasswordHash, error)
+	Verify(password []byte, hash PasswordHash) (bool, error)
+	// NeedsRehash はハッシュのパラメータが現在の設定と異なる場合にtrueを返す
+	NeedsRehash(hash PasswordHash) bool
+}
+
+const saltLength = 16
+
+var passwordHasher PasswordHasher
+
+// knownHashers は検証に使用できるすべての形式
+var knownHashers []PasswordHasher
+
+func NewPasswordHasher(algorithm string) (PasswordHasher, error) {
+	switch algorithm {
+	case AlgorithmBcrypt:
+		return &bcryptHasher{cost: setting.Password.BcryptCost}, nil
+	case AlgorithmScrypt:
+		return &scryptHasher{n: setting.Password.ScryptN, r: setting.Password.ScryptR, p: setting.Password.ScryptP}, nil
+	case AlgorithmArgon2id:
+		return &argon2idHasher{time: setting.Password.Argon2Time, memory: setting.Password.Argon2Memory, threads: setting.Password.Argon2Threads}, nil
+	case AlgorithmPBKDF2SHA256:
+		return &pbkdf2Hasher{iterations: setting.Password.PBKDF2Iterations}, nil
+	}
+	return nil, ErrorUnknownAlgorithm
+}
+
+func initPasswordHasher() error {
+	h, err := NewPasswordHasher(setting.Password.Algorithm)
+	if err != nil {
+		return err
+	}
+	passwordHasher = h
+	knownHashers = []PasswordHasher{&md5Hasher{}}
+	for _, x := range []string{AlgorithmBcrypt, AlgorithmScrypt, AlgorithmArgon2id, AlgorithmPBKDF2SHA256} {
+		if x == h.Algorithm() {
+			knownHashers = append(knownHashers, h)
+			continue
+		}
+		other, _ := NewPasswordHasher(x)
+		knownHashers = append(knownHashers, other)
+	}
+	knownHashers = append(knownHashers, newSHA256CryptHasher(), newSHA512CryptHasher())
+	// 形式の判別が最も緩いdes-cryptは最後に確認する
+	knownHashers = append(knownHashers, newAPR1Hasher(), newMD5CryptHasher(), &sha1Hasher{}, &desCryptHasher{})
+	return nil
+}
+
+// HashPassword は設定されたアルゴリズムでパスワードをハッシュ化する
+func HashPassword(password string) (PasswordHash, error) {
+	hash, err := passwordHasher.Hash(pepper(password))
+	if err != nil || setting.Password.Pepper == "" {
+		return hash, err
+	}
+	return pepperMarker + hash, nil
+}
+
+// VerifyPassword はハッシュの形式を判別してパスワードを検証する
+func VerifyPassword(password string, hash PasswordHash) (bool, error) {
+	hash, marked := splitPepper(hash)
+	h := findHasher(hash)
+	if h == nil {
+		return false, ErrorUnknownAlgorithm
+	}
+	if marked {
+		if setting.Password.Pepper == "" {
+			return false, ErrorPepperRequired
+		}
+		return h.Verify(pepper(password), hash)
+	}
+	// 目印のないハッシュは他のシステムから移行したものとしてペッパーなしで検証する
+	match, err := h.Verify([]byte(password), hash)
+	if match || err != nil || setting.Password.Pepper == "" || !legacyPeppered(h.Algorithm()) {
+		return match, err
+	}
+	// 目印を付ける前に作成したハッシュはペッパーを付与して保存されている
+	return h.Verify(pepper(password), hash)
+}
+
+// PasswordNeedsRehash はハッシュを設定されたアルゴリズムで作り直すべきかを返す
+func PasswordNeedsRehash(hash PasswordHash) bool {
+	hash, marked := splitPepper(hash)
+	if marked != (setting.Password.Pepper != "") {
+		return true
+	}
+	if !passwordHasher.Match(hash) {
+		return true
+	}
+	return passwordHasher.NeedsRehash(hash)
+}
+
+// HashAlgorithm はハッシュの形式名を返す
+func HashAlgorithm(hash PasswordHash) (string, error) {
+	hash, _ = splitPepper(hash)
+	h := findHasher(hash)
+	if h == nil {
+		return "", ErrorUnknownAlgorithm
+	}
+	return h.Algorithm(), nil
+}
+
+// HashPeppered はハッシュがペッパーを付与して作成されたものかを返す
+func HashPeppered(hash PasswordHash) bool {
+	_, marked := splitPepper(hash)
+	return marked
+}
+
+func findHasher(hash PasswordHash) PasswordHasher {
+	for _, h := range knownHashers {
+		if h.Match(hash) {
+			return h
+		}
+	}
+	return nil
+}
+
+// splitPepper はハッシュからpepperMarkerを取り除き、付いていたかを返す
+func splitPepper(hash PasswordHash) (PasswordHash, bool) {
+	if strings.HasPrefix(string(hash), pepperMarker) {
+		return hash[len(pepperMarker):], true
+	}
+	return hash, false
+}
+
+// legacyPeppered は目印を付ける前にペッパーを付与して作成していたアルゴリズムかを返す
+func legacyPeppered(algorithm string) bool {
+	switch algorithm {
+	case AlgorithmBcrypt, AlgorithmScrypt, AlgorithmArgon2id, AlgorithmPBKDF2SHA256:
+		return true
+	}
+	return false
+}
+
+func pepper(password string) []byte {
+	if setting.Password.Pepper == "" {
+		return []byte(password)
+	}
+	mac := hmac.New(sha256.New, []byte(setting.Password.Pepper))
+	mac.Write([]byte(password))
+	// bcryptの72バイト制限に収まるようにエンコードする
+	return []byte(base64.RawStdEncoding.EncodeToString(mac.Sum(nil)))
+}
+
+func createSalt() ([]byte, error) {
+	salt := make([]byte, saltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	return salt, nil
+}
+
+// splitHash は "$name$params$salt$hash" 形式を分解する
+func splitHash(hash PasswordHash, name string) (params string, salt []byte, key []byte, err error) {
+	parts := strings.Split(string(hash), "$")
+	if len(parts) != 5 || parts[0] != "" || parts[1] != name {
+		return "", nil, nil, ErrorInvalidHash
+	}
+	salt, err = base64.RawStdEncoding.DecodeString(parts[3])
+	if err != nil {
+		return "", nil, nil, ErrorInvalidHash
+	}
+	key, err = base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return "", nil, nil, ErrorInvalidHash
+	}
+	return parts[2], salt, key, nil
+}
+
+func joinHash(name string, params string, salt []byte, key []byte) PasswordHash {
+	return PasswordHash(fmt.Sprintf("$%s$%s$%s$%s", name, params,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key)))
+}
+
+// parseParams は "a=1,b=2" 形式のパラメータを読み取る
+func parseParams(params string) (map[string]int, error) {
+	res := make(map[string]int)
+	for _, kv := range strings.Split(params, ",") {
+		x := strings.SplitN(kv, "=", 2)
+		if len(x) != 2 {
+			return nil, ErrorInvalidHash
+		}
+		v, err := strconv.Atoi(x[1])
+		if err != nil {
+			return nil, ErrorInvalidHash
+		}
+		res[x[0]] = v
+	}
+	return res, nil
+}
+
+type md5Hasher struct{}
+
+func (h *md5Hasher) Algorithm() string {
+	return AlgorithmMD5
+}
+
+func (h *md5Hasher) Match(hash PasswordHash) bool {
+	if len(hash) != 32 {
+		return false
+	}
+	_, err := hex.DecodeString(string(hash))
+	return err == nil
+}
+
+func (h *md5Hasher) Hash(password []byte) (PasswordHash, error) {
+	return PasswordHash(EncodeStringMD5(string(password))), nil
+}
+
+func (h *md5Hasher) Verify(password []byte, hash PasswordHash) (bool, error) {
+	encode := EncodeStringMD5(string(password))
+	return subtle.ConstantTimeCompare([]byte(strings.ToLower(string(hash))), []byte(encode)) == 1, nil
+}
+
+func (h *md5Hasher) NeedsRehash(hash PasswordHash) bool {
+	return true
+}
+
+type bcryptHasher struct {
+	cost int
+}
+
+func (h *bcryptHasher) Algorithm() string {
+	return AlgorithmBcrypt
+}
+
+func (h *bcryptHasher) Match(hash PasswordHash) bool {
+	return strings.HasPrefix(string(hash), "$2a$") ||
+		strings.HasPrefix(string(hash), "$2b$") ||
+		strings.HasPrefix(string(hash), "$2y$")
+}
+
+func (h *bcryptHasher) Hash(password []byte) (PasswordHash, error) {
+	b, err := bcrypt.GenerateFromPassword(password, h.cost)
+	if err != nil {
+		return "", err
+	}
+	return PasswordHash(b), nil
+}
+
+func (h *bcryptHasher) Verify(password []byte, hash PasswordHash) (bool, error) {
+	err := bcrypt.CompareHashAndPassword([]byte(hash), password)
+	if err == bcrypt.ErrMismatchedHashAndPassword {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (h *bcryptHasher) NeedsRehash(hash PasswordHash) bool {
+	cost, err := bcrypt.Cost([]byte(hash))
+	if err != nil {
+		return true
+	}
+	return cost != h.cost
+}
+
+type scryptHasher struct {
+	n, r, p int
+}
+
+func (h *scryptHasher) Algorithm() string {
+	return AlgorithmScrypt
+}
+
+func (h *scryptHasher) Match(hash PasswordHash) bool {
+	return strings.HasPrefix(string(hash), "$scrypt$")
+}
+
+func (h *scryptHasher) Hash(password []byte) (PasswordHash, error) {
+	salt, err := createSalt()
+	if err != nil {
+		return "", err
+	}
+	key, err := scrypt.Key(password, salt, h.n, h.r, h.p, 32)
+	if err != nil {
+		return "", err
+	}
+	params := fmt.Sprintf("n=%d,r=%d,p=%d", h.n, h.r, h.p)
+	return joinHash(AlgorithmScrypt, params, salt, key), nil
+}
+
+func (h *scryptHasher) Verify(password []byte, hash PasswordHash) (bool, error) {
+	params, salt, key, err := splitHash(hash, AlgorithmScrypt)
+	if err != nil {
+		return false, err
+	}
+	p, err := parseParams(params)
+	if err != nil {
+		return false, err
+	}
+	if err := checkScryptParams(p, salt, key); err != nil {
+		return false, err
+	}
+	other, err := scrypt.Key(password, salt, p["n"], p["r"], p["p"], len(key))
+	if err != nil {
+		return false, err
+	}
+	return subtle.ConstantTimeCompare(key, other) == 1, nil
+}
+
+func (h *scryptHasher) NeedsRehash(hash PasswordHash) bool {
+	params, _, _, err := splitHash(hash, AlgorithmScrypt)
+	if err != nil {
+		return true
+	}
+	p, err := parseParams(params)
+	if err != nil {
+		return true
+	}
+	return p["n"] != h.n || p["r"] != h.r || p["p"] != h.p
+}
+
+type argon2idHasher struct {
+	time    uint32
+	memory  uint32
+	threads uint8
+}
+
+func (h *argon2idHasher) Algorithm() string {
+	return AlgorithmArgon2id
+}
+
+func (h *argon2idHasher) Match(hash PasswordHash) bool {
+	return strings.HasPrefix(string(hash), "$argon2id$")
+}
+
+func (h *argon2idHasher) Hash(password []byte) (PasswordHash, error) {
+	salt, err := createSalt()
+	if err != nil {
+		return "", err
+	}
+	key := argon2.IDKey(password, salt, h.time, h.memory, h.threads, 32)
+	params := fmt.Sprintf("m=%d,t=%d,p=%d", h.memory, h.time, h.threads)
+	return joinHash(AlgorithmArgon2id, fmt.Sprintf("v=%d$%s", argon2.Version, params), salt, key), nil
+}
+
+// split はバージョン部を含む "$argon2id$v=19$params$salt$hash" 形式を分解し、パラメーターの範囲を確認する
+func (h *argon2idHasher) split(hash PasswordHash) (map[string]int, []byte, []byte, error) {
+	p, salt, key, err := h.parse(hash)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if err := checkArgon2idParams(p, salt, key); err != nil {
+		return nil, nil, nil, err
+	}
+	return p, salt, key, nil
+}
+
+// parse はパラメーターの範囲を確認せずに分解する
+func (h *argon2idHasher) parse(hash PasswordHash) (map[string]int, []byte, []byte, error) {
+	parts := strings.Split(string(hash), "$")
+	if len(parts) != 6 || parts[1] != AlgorithmArgon2id {
+		return nil, nil, nil, ErrorInvalidHash
+	}
+	if parts[2] != fmt.Sprintf("v=%d", argon2.Version) {
+		return nil, nil, nil, ErrorInvalidHash
+	}
+	params, salt, key, err := splitHash(PasswordHash(strings.Join(append(parts[:2], parts[3:]...), "$")), AlgorithmArgon2id)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	p, err := parseParams(params)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return p, salt, key, nil
+}
+
+// 保存されたハッシュのパラメーターの上限。これを超える値は改ざんや誤った取り込みとみなす
+const (
+	argon2MaxTime    = 64
+	argon2MaxMemory  = 4 * 1024 * 1024 // KiB
+	scryptMaxMemory  = 1 << 30         // バイト
+	scryptMaxP       = 16
+	pbkdf2MaxIter    = 10000000
+	hashMaxKeyLength = 64
+)
+
+// checkScryptParams はscrypt.Keyにそのまま渡せる範囲のパラメーターかを確認する
+//
+// nは2の累乗でなければならず、128*n*rバイトのメモリを使用するため上限を設ける
+func checkScryptParams(p map[string]int, salt []byte, key []byte) error {
+	n, r, threads := p["n"], p["r"], p["p"]
+	if n <= 1 || n&(n-1) != 0 || r < 1 || threads < 1 || threads > scryptMaxP ||
+		n > scryptMaxMemory/128/r || len(salt) <= 0 || len(key) <= 0 || len(key) > hashMaxKeyLength {
+		return ErrorInvalidHash
+	}
+	return nil
+}
+
+// checkPbkdf2Params は反復回数と鍵の長さが範囲内かを確認する
+func checkPbkdf2Params(p map[string]int, salt []byte, key []byte) error {
+	if p["i"] < 1 || p["i"] > pbkdf2MaxIter || len(salt) <= 0 || len(key) <= 0 || len(key) > hashMaxKeyLength {
+		return ErrorInvalidHash
+	}
+	return nil
+}
+
+// checkArgon2idParams はargon2.IDKeyにそのまま渡せる範囲のパラメーターかを確認する
+//
+// t=0やp=0はargon2.IDKeyがpanicし、大きなmはメモリを使い果たすためErrorInvalidHashとする
+func checkArgon2idParams(p map[string]int, salt []byte, key []byte) error {
+	t, m, threads := p["t"], p["m"], p["p"]
+	if t < 1 || t > argon2MaxTime || threads < 1 || threads > 255 ||
+		m < 8*threads || m > argon2MaxMemory || len(salt) <= 0 || len(key) <= 0 {
+		return ErrorInvalidHash
+	}
+	return nil
+}
+
+func (h *argon2idHasher) Verify(password []byte, hash PasswordHash) (bool, error) {
+	p, salt, key, err := h.split(hash)
+	if err != nil {
+		return false, err
+	}
+	other := argon2.IDKey(password, salt, uint32(p["t"]), uint32(p["m"]), uint8(p["p"]), uint32(len(key)))
+	return subtle.ConstantTimeCompare(key, other) == 1, nil
+}
+
+func (h *argon2idHasher) NeedsRehash(hash PasswordHash) bool {
+	p, _, _, err := h.split(hash)
+	if err != nil {
+		return true
+	}
+	return uint32(p["t"]) != h.time || uint32(p["m"]) != h.memory || uint8(p["p"]) != h.threads
+}
+
+type pbkdf2Hasher struct {
+	iterations int
+}
+
+func (h *pbkdf2Hasher) Algorithm() string {
+	return AlgorithmPBKDF2SHA256
+}
+
+func (h *pbkdf2Hasher) Match(hash PasswordHash) bool {
+	return strings.HasPrefix(string(hash), "$pbkdf2-sha256$")
+}
+
+func (h *pbkdf2Hasher) Hash(password []byte) (PasswordHash, error) {
+	salt, err := createSalt()
+	if err != nil {
+		return "", err
+	}
+	key := pbkdf2.Key(password, salt, h.iterations, 32, sha256.New)
+	return joinHash(AlgorithmPBKDF2SHA256, fmt.Sprintf("i=%d", h.iterations), salt, key), nil
+}
+
+func (h *pbkdf2Hasher) Verify(password []byte, hash PasswordHash) (bool, error) {
+	params, salt, key, err := splitHash(hash, AlgorithmPBKDF2SHA256)
+	if err != nil {
+		return false, err
+	}
+	p, err := parseParams(params)
+	if err != nil {
+		return false, err
+	}
+	if err := checkPbkdf2Params(p, salt, key); err != nil {
+		return false, err
+	}
+	other := pbkdf2.Key(password, salt, p["i"], len(key), sha256.New)
+	return subtle.ConstantTimeCompare(key, other) == 1, nil
+}
+
+func (h *pbkdf2Hasher) NeedsRehash(hash PasswordHash) bool {
+	params, _, _, err := splitHash(hash, AlgorithmPBKDF2SHA256)
+	if err != nil {
+		return true
+	}
+	p, err := parseParams(params)
+	if err != nil {
+		return true
+	}
+	return p["i"] != h.iterations
+}
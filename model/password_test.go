@@ -0,0 +1,85 @@
+package model
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/knanao/goauth/server/setting"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestPepperMarker(t *testing.T) {
+	setupTestSetting(t)
+	setting.Password.Pepper = "pepper-secret"
+	if err := initPasswordHasher(); err != nil {
+		t.Fatal(err)
+	}
+
+	hash, err := HashPassword("Password-1234")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(hash), pepperMarker) || !HashPeppered(hash) {
+		t.Fatalf("hash created with a pepper has no marker: %s", hash)
+	}
+	if match, err := VerifyPassword("Password-1234", hash); err != nil || !match {
+		t.Errorf("VerifyPassword(own hash) = %v, %v", match, err)
+	}
+	if algorithm, err := HashAlgorithm(hash); err != nil || algorithm != AlgorithmPBKDF2SHA256 {
+		t.Errorf("HashAlgorithm = %s, %v", algorithm, err)
+	}
+	if PasswordNeedsRehash(hash) {
+		t.Error("own hash needs rehash")
+	}
+
+	// htpasswdなどから取り込んだbcryptのハッシュはペッパーなしで検証する
+	b, err := bcrypt.GenerateFromPassword([]byte("Imported-1234"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	imported := PasswordHash(b)
+	if match, err := VerifyPassword("Imported-1234", imported); err != nil || !match {
+		t.Errorf("VerifyPassword(imported bcrypt) = %v, %v", match, err)
+	}
+	if !PasswordNeedsRehash(imported) {
+		t.Error("imported hash does not need rehash")
+	}
+
+	// 目印を付ける前に作成したハッシュも検証できる
+	legacy, err := passwordHasher.Hash(pepper("Legacy-1234"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if match, err := VerifyPassword("Legacy-1234", legacy); err != nil || !match {
+		t.Errorf("VerifyPassword(legacy hash) = %v, %v", match, err)
+	}
+
+	setting.Password.Pepper = ""
+	if _, err := VerifyPassword("Password-1234", hash); err != ErrorPepperRequired {
+		t.Errorf("marked hash without pepper: err = %v, want %v", err, ErrorPepperRequired)
+	}
+}
+
+func TestVerifyRejectsOutOfRangeParams(t *testing.T) {
+	setupTestSetting(t)
+	if err := initPasswordHasher(); err != nil {
+		t.Fatal(err)
+	}
+	salt := "c2FsdHNhbHRzYWx0c2FsdA"
+	key := "a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2U"
+	tests := []PasswordHash{
+		PasswordHash("$scrypt$n=1073741824,r=8,p=1$" + salt + "$" + key),
+		PasswordHash("$scrypt$n=1000,r=8,p=1$" + salt + "$" + key),
+		PasswordHash("$scrypt$n=16384,r=8,p=1000$" + salt + "$" + key),
+		PasswordHash("$scrypt$n=16384,r=0,p=1$" + salt + "$" + key),
+		PasswordHash("$pbkdf2-sha256$i=2000000000$" + salt + "$" + key),
+		PasswordHash("$pbkdf2-sha256$i=0$" + salt + "$" + key),
+		"$5$rounds=999999999$saltsalt$AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA",
+		"$6$rounds=20000000$saltsalt$AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA",
+	}
+	for _, hash := range tests {
+		if _, err := VerifyPassword("Password-1234", hash); err != ErrorInvalidHash {
+			t.Errorf("VerifyPassword(%s): err = %v, want %v", hash, err, ErrorInvalidHash)
+		}
+	}
+}
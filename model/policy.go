@@ -0,0 +1,190 @@
+package model
+
+import (
+	"context"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/knanao/goauth/server/setting"
+)
+
+// PolicyViolation はパスワードポリシーに違反した1つの項目
+type PolicyViolation struct {
+	Code    string
+	Message string
+}
+
+// PasswordPolicyError はパスワードポリシーの違反をすべて保持する
+type PasswordPolicyError struct {
+	Violations []PolicyViolation
+}
+
+func (err *PasswordPolicyError) Error() string {
+	msgs := make([]string, len(err.Violations))
+	for i, x := range err.Violations {
+		msgs[i] = x.Message
+	}
+	return "Password Policy Violation: " + strings.Join(msgs, " ")
+}
+
+const (
+	ViolationTooShort    = "too_short"
+	ViolationTooLong     = "too_long"
+	ViolationNoUpper     = "no_upper"
+	ViolationNoLower     = "no_lower"
+	ViolationNoDigit     = "no_digit"
+	ViolationNoSymbol    = "no_symbol"
+	ViolationUserInfo    = "contains_user_info"
+	ViolationTooRepeated = "too_repeated"
+)
+
+// CheckPasswordPolicy はパスワードが設定されたポリシーを満たすかを確認する
+//
+// 違反がない場合はnilを返す
+func CheckPasswordPolicy(password string, u *User) error {
+	policy := setting.RealmFor("").PasswordPolicy
+	if u != nil {
+		policy = setting.RealmFor(u.Realm).PasswordPolicy
+	}
+	violations := []PolicyViolation{}
+	length := utf8.RuneCountInString(password)
+	if length < policy.MinLength {
+		violations = append(violations, PolicyViolation{ViolationTooShort,
+			"Password is too short."})
+	}
+	if policy.MaxLength > 0 && length > policy.MaxLength {
+		violations = append(violations, PolicyViolation{ViolationTooLong,
+			"Password is too long."})
+	} else if bcryptLimited() && len(password) > bcryptMaxPassword {
+		violations = append(violations, PolicyViolation{ViolationTooLong,
+			"Password must be at most 72 bytes."})
+	}
+	var upper, lower, digit, symbol bool
+	for _, r := range password {
+		switch {
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsDigit(r):
+			digit = true
+		case unicode.IsPunct(r) || unicode.IsSymbol(r) || unicode.IsSpace(r):
+			symbol = true
+		}
+	}
+	if policy.RequireUpper && !upper {
+		violations = append(violations, PolicyViolation{ViolationNoUpper,
+			"Password must contain an uppercase letter."})
+	}
+	if policy.RequireLower && !lower {
+		violations = append(violations, PolicyViolation{ViolationNoLower,
+			"Password must contain a lowercase letter."})
+	}
+	if policy.RequireDigit && !digit {
+		violations = append(violations, PolicyViolation{ViolationNoDigit,
+			"Password must contain a digit."})
+	}
+	if policy.RequireSymbol && !symbol {
+		violations = append(violations, PolicyViolation{ViolationNoSymbol,
+			"Password must contain a symbol."})
+	}
+	if policy.DisallowUserInfo && u != nil && containsUserInfo(password, u) {
+		violations = append(violations, PolicyViolation{ViolationUserInfo,
+			"Password must not contain the user ID or full name."})
+	}
+	if policy.MaxRepeated > 0 && maxRepeated(password) > policy.MaxRepeated {
+		violations = append(violations, PolicyViolation{ViolationTooRepeated,
+			"Password repeats the same character too many times."})
+	}
+	if len(violations) > 0 {
+		return &PasswordPolicyError{violations}
+	}
+	return nil
+}
+
+// bcryptMaxPassword はbcryptがハッシュ化できるパスワードの最大のバイト数
+const bcryptMaxPassword = 72
+
+// bcryptLimited はパスワードがそのままbcryptに渡されるかを返す
+//
+// ペッパーを付与する場合はHMACをエンコードした43バイトになるため長さの制限はない
+func bcryptLimited() bool {
+	return setting.Password.Algorithm == AlgorithmBcrypt && setting.Password.Pepper == ""
+}
+
+// containsUserInfo はパスワードがUserIDか氏名の一部(3文字以上の語)を含むかを返す
+func containsUserInfo(password string, u *User) bool {
+	lower := strings.ToLower(password)
+	words := append([]string{u.UserID}, strings.Fields(u.FullName)...)
+	for _, x := range words {
+		if utf8.RuneCountInString(x) < 3 {
+			continue
+		}
+		if strings.Contains(lower, strings.ToLower(x)) {
+			return true
+		}
+	}
+	return false
+}
+
+// maxRepeated は同じ文字が連続する最大の回数を返す
+func maxRepeated(password string) int {
+	res, count := 0, 0
+	var prev rune = -1
+	for _, r := range password {
+		if r == prev {
+			count++
+		} else {
+			count = 1
+			prev = r
+		}
+		if count > res {
+			res = count
+		}
+	}
+	return res
+}
+
+// ChangePassword はポリシーを確認してからパスワードを変更する
+func (a *UserDataAccessor) ChangePassword(id ID, password string) error {
+	return a.ChangePasswordContext(context.Background(), id, password)
+}
+
+func (a *UserDataAccessor) ChangePasswordContext(ctx context.Context, id ID, password string) error {
+	return a.setPassword(ctx, id, password, false)
+}
+
+// ResetPassword は管理者が一時パスワードを発行する。
+// mustChangeがtrueの場合は次のログインで変更を求める
+func (a *UserDataAccessor) ResetPassword(id ID, password string, mustChange bool) error {
+	return a.ResetPasswordContext(context.Background(), id, password, mustChange)
+}
+
+func (a *UserDataAccessor) ResetPasswordContext(ctx context.Context, id ID, password string, mustChange bool) error {
+	return a.setPassword(ctx, id, password, mustChange)
+}
+
+func (a *UserDataAccessor) setPassword(ctx context.Context, id ID, password string, mustChange bool) error {
+	user, err := a.FindByIDContext(ctx, id)
+	if err != nil {
+		return err
+	}
+	if err := CheckPasswordPolicy(password, &user); err != nil {
+		return err
+	}
+	if err := checkPasswordHistory(password, &user); err != nil {
+		return err
+	}
+	hash, err := HashPassword(password)
+	if err != nil {
+		return err
+	}
+	req := []interface{}{id, hash, mustChange}
+	resp := a.send(ctx, commandChangePassword, req)
+	if resp.err != nil {
+		e.Logger.Debugf("User[ID=%s] Change password Error. [%s]", id, resp.err)
+		return resp.err
+	}
+	return nil
+}
@@ -0,0 +1,164 @@
+package model
+
+import (
+	"sort"
+	"strings"
+	"time"
+)
+
+type TextMatch int
+
+const (
+	MatchSubstring TextMatch = iota // 部分一致
+	MatchPrefix                     // 前方一致
+)
+
+type SortKey string
+
+const (
+	SortByID       SortKey = "id"
+	SortByUserID   SortKey = "user_id"
+	SortByFullName SortKey = "full_name"
+)
+
+// UserFilter はユーザーの絞り込み条件。空の項目は条件に使用しない
+type UserFilter struct {
+	Realm     string    // このレルムに属するユーザー
+	Roles     []Role    // いずれかのロールを持つユーザー(グループと継承によるロールを含む)
+	Text      string    // UserIDまたはFullNameに対する検索文字列(大文字小文字を区別しない)
+	TextMatch TextMatch // Textの一致方法
+	Locked    bool      // trueの場合はロックされているユーザーのみ
+	Disabled  *bool     // 無効化されているかどうか
+}
+
+type UserQuery struct {
+	Filter UserFilter
+	Sort   SortKey
+	Desc   bool
+	Offset int
+	Limit  int // 0の場合は全件
+}
+
+type UserQueryResult struct {
+	Users []User
+	Total int // ページングする前の件数
+}
+
+func (f *UserFilter) match(u *User, now time.Time) bool {
+	if f.Realm != "" && u.RealmName() != normalizeRealm(f.Realm) {
+		return false
+	}
+	if f.Locked && !u.IsLocked(now) {
+		return false
+	}
+	if f.Disabled != nil && u.Disabled != *f.Disabled {
+		return false
+	}
+	if f.Text == "" {
+		return true
+	}
+	text := strings.ToLower(f.Text)
+	for _, x := range []string{u.UserID, u.FullName} {
+		x = strings.ToLower(x)
+		if f.TextMatch == MatchPrefix && strings.HasPrefix(x, text) {
+			return true
+		}
+		if f.TextMatch == MatchSubstring && strings.Contains(x, text) {
+			return true
+		}
+	}
+	return false
+}
+
+// candidates はロールの条件があればインデックスから対象のIDを絞り込む
+//
+// rbacが指定された場合は、グループや継承によってロールを持つユーザーも対象にする
+func (f *UserFilter) candidates(rbac *RBAC) []ID {
+	res := []ID{}
+	if len(f.Roles) <= 0 {
+		for id := range users {
+			res = append(res, id)
+		}
+		return res
+	}
+	seen := make(map[ID]struct{})
+	add := func(ids []ID) {
+		for _, id := range ids {
+			if _, ok := seen[id]; ok {
+				continue
+			}
+			seen[id] = struct{}{}
+			res = append(res, id)
+		}
+	}
+	for _, role := range f.Roles {
+		if rbac == nil {
+			add(roleIndex.lookup(string(role)))
+			continue
+		}
+		roles, groups := rbac.grantedBy(role)
+		for _, x := range roles {
+			add(roleIndex.lookup(string(x)))
+		}
+		for _, x := range groups {
+			add(groupIndex.lookup(x))
+		}
+	}
+	return res
+}
+
+func sortValue(u *User, key SortKey) string {
+	switch key {
+	case SortByUserID:
+		return u.UserID
+	case SortByFullName:
+		return u.FullName
+	}
+	return string(u.ID)
+}
+
+func queryUsers(q UserQuery, rbac *RBAC) (UserQueryResult, error) {
+	if q.Offset < 0 || q.Limit < 0 {
+		return UserQueryResult{}, ErrorBadParameter
+	}
+	switch q.Sort {
+	case "":
+		q.Sort = SortByID
+	case SortByID, SortByUserID, SortByFullName:
+	default:
+		return UserQueryResult{}, ErrorBadParameter
+	}
+	now := time.Now()
+	matched := []*User{}
+	for _, id := range q.Filter.candidates(rbac) {
+		x := users[id]
+		if q.Filter.match(&x, now) {
+			matched = append(matched, &x)
+		}
+	}
+	sort.Slice(matched, func(i, j int) bool {
+		vi, vj := sortValue(matched[i], q.Sort), sortValue(matched[j], q.Sort)
+		if vi == vj {
+			// 同じ値の場合でも順序が変わらないようにIDで並べる
+			vi, vj = string(matched[i].ID), string(matched[j].ID)
+		}
+		if q.Desc {
+			return vi > vj
+		}
+		return vi < vj
+	})
+	res := UserQueryResult{Users: []User{}, Total: len(matched)}
+	if q.Offset >= len(matched) {
+		return res, nil
+	}
+	end := len(matched)
+	if q.Limit > 0 && q.Offset+q.Limit < end {
+		end = q.Offset + q.Limit
+	}
+	for _, x := range matched[q.Offset:end] {
+		user := User{}
+		user.copyPublic(x)
+		res.Users = append(res.Users, user)
+	}
+	return res, nil
+}
@@ -0,0 +1,59 @@
+package model
+
+import (
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestQueryRolesThroughGroupsAndInheritance(t *testing.T) {
+	setupTestSetting(t)
+	rbac, err := NewRBAC([]RoleDefinition{
+		{Name: RoleAdmin, Inherits: []Role{RoleUser}},
+		{Name: RoleUser},
+		{Name: "guest"},
+	}, []Group{{Name: "staff", Roles: []Role{RoleUser}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "users.json")
+	writeUserFile(t, path, []User{})
+	a := startTestAccessor(t, path)
+	a.RBAC = rbac
+	for _, x := range []User{
+		{UserID: "admin", Roles: []Role{RoleAdmin}},
+		{UserID: "member", Roles: []Role{"guest"}, Groups: []string{"staff"}},
+		{UserID: "user", Roles: []Role{RoleUser}},
+		{UserID: "guest", Roles: []Role{"guest"}},
+	} {
+		x.Password = testHash(t)
+		if _, err := a.Create(x); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		roles []Role
+		want  []string
+	}{
+		{[]Role{RoleUser}, []string{"admin", "member", "user"}},
+		{[]Role{RoleAdmin}, []string{"admin"}},
+		{[]Role{"guest"}, []string{"guest", "member"}},
+		{[]Role{"undefined"}, []string{}},
+	}
+	for _, x := range tests {
+		result, err := a.Query(UserQuery{Filter: UserFilter{Roles: x.roles}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := []string{}
+		for _, u := range result.Users {
+			got = append(got, u.UserID)
+		}
+		sort.Strings(got)
+		if !reflect.DeepEqual(got, x.want) {
+			t.Errorf("roles %v: users = %v, want %v", x.roles, got, x.want)
+		}
+	}
+}
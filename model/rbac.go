@@ -0,0 +1,228 @@
+package model
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+)
+
+type Permission string
+
+const (
+	PermissionAdminAccess Permission = "admin:access"
+	PermissionUsersRead   Permission = "users:read"
+	PermissionUsersWrite  Permission = "users:write"
+)
+
+var (
+	ErrorUnknownRole  = errors.New("Unknown Role")
+	ErrorRoleCycle    = errors.New("Role Inheritance Cycle")
+	ErrorUnknownGroup = errors.New("Unknown Group")
+)
+
+// RoleDefinition はロールが持つ権限と継承元のロール
+type RoleDefinition struct {
+	Name        Role         `json:"name"`
+	Permissions []Permission `json:"permissions"`
+	Inherits    []Role       `json:"inherits"`
+}
+
+// Group はユーザーが所属し、所属するユーザーにロールを与える
+type Group struct {
+	Name  string `json:"name"`
+	Roles []Role `json:"roles"`
+}
+
+type rbacFile struct {
+	Roles  []RoleDefinition `json:"roles"`
+	Groups []Group          `json:"groups"`
+}
+
+// RBAC はロールとグループの定義から権限を判定する
+type RBAC struct {
+	roles  map[Role]RoleDefinition
+	groups map[string]Group
+	// expanded は継承を展開したロールの集合
+	expanded map[Role][]Role
+}
+
+// defaultRBAC は定義ファイルがない場合に使用する従来の2つのロール
+var defaultRBAC = rbacFile{
+	Roles: []RoleDefinition{
+		{RoleAdmin, []Permission{PermissionAdminAccess, PermissionUsersRead, PermissionUsersWrite}, []Role{RoleUser}},
+		{RoleUser, []Permission{}, []Role{}},
+	},
+	Groups: []Group{},
+}
+
+// LoadRBAC は定義ファイルを読み込む。ファイルが存在しない場合は既定の定義を使用する
+func LoadRBAC(path string) (*RBAC, error) {
+	bytes, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return NewRBAC(defaultRBAC.Roles, defaultRBAC.Groups)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var f rbacFile
+	if err := json.Unmarshal(bytes, &f); err != nil {
+		return nil, err
+	}
+	return NewRBAC(f.Roles, f.Groups)
+}
+
+func NewRBAC(roles []RoleDefinition, groups []Group) (*RBAC, error) {
+	r := &RBAC{
+		roles:    make(map[Role]RoleDefinition),
+		groups:   make(map[string]Group),
+		expanded: make(map[Role][]Role),
+	}
+	for _, x := range roles {
+		r.roles[x.Name] = x
+	}
+	for _, x := range groups {
+		for _, role := range x.Roles {
+			if _, ok := r.roles[role]; !ok {
+				return nil, ErrorUnknownRole
+			}
+		}
+		r.groups[x.Name] = x
+	}
+	for name := range r.roles {
+		expanded, err := r.expand(name, map[Role]bool{})
+		if err != nil {
+			return nil, err
+		}
+		r.expanded[name] = expanded
+	}
+	return r, nil
+}
+
+// expand はロールと継承元のロールをすべて返す
+func (r *RBAC) expand(name Role, visiting map[Role]bool) ([]Role, error) {
+	def, ok := r.roles[name]
+	if !ok {
+		return nil, ErrorUnknownRole
+	}
+	if visiting[name] {
+		return nil, ErrorRoleCycle
+	}
+	visiting[name] = true
+	defer delete(visiting, name)
+	res := []Role{name}
+	for _, x := range def.Inherits {
+		inherited, err := r.expand(x, visiting)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, inherited...)
+	}
+	return res, nil
+}
+
+// HasRoleDefinition はロールが定義されているかを返す
+func (r *RBAC) HasRoleDefinition(role Role) bool {
+	_, ok := r.roles[role]
+	return ok
+}
+
+// HasGroup はグループが定義されているかを返す
+func (r *RBAC) HasGroup(name string) bool {
+	_, ok := r.groups[name]
+	return ok
+}
+
+// grantedBy はロールを継承を含めて与えるロールとグループを返す
+//
+// 定義のないロールはそのロール自身のみが与える
+func (r *RBAC) grantedBy(role Role) ([]Role, []string) {
+	roles := []Role{}
+	if _, ok := r.roles[role]; !ok {
+		roles = append(roles, role)
+	}
+	granting := make(map[Role]bool)
+	for name, expanded := range r.expanded {
+		for _, x := range expanded {
+			if x == role {
+				granting[name] = true
+				roles = append(roles, name)
+				break
+			}
+		}
+	}
+	groups := []string{}
+	for name, group := range r.groups {
+		for _, x := range group.Roles {
+			if granting[x] {
+				groups = append(groups, name)
+				break
+			}
+		}
+	}
+	return roles, groups
+}
+
+// EffectiveRoles はユーザーに直接与えられたロールとグループのロールを継承を含めて返す
+func (r *RBAC) EffectiveRoles(u *User) []Role {
+	direct := append([]Role{}, u.Roles...)
+	for _, x := range u.Groups {
+		if group, ok := r.groups[x]; ok {
+			direct = append(direct, group.Roles...)
+		}
+	}
+	seen := make(map[Role]struct{})
+	res := []Role{}
+	for _, x := range direct {
+		expanded, ok := r.expanded[x]
+		if !ok {
+			// 定義のないロールは権限を持たないロールとして扱う
+			expanded = []Role{x}
+		}
+		for _, role := range expanded {
+			if _, ok := seen[role]; ok {
+				continue
+			}
+			seen[role] = struct{}{}
+			res = append(res, role)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i] < res[j] })
+	return res
+}
+
+// HasRole はユーザーが継承を含めてロールを持っているかを返す
+func (r *RBAC) HasRole(u *User, role Role) bool {
+	for _, x := range r.EffectiveRoles(u) {
+		if x == role {
+			return true
+		}
+	}
+	return false
+}
+
+// HasPermission はユーザーが権限を持っているかを返す
+//
+// "users:*" や "*" のように末尾が*の権限は前方一致で判定する
+func (r *RBAC) HasPermission(u *User, perm Permission) bool {
+	for _, role := range r.EffectiveRoles(u) {
+		for _, x := range r.roles[role].Permissions {
+			if matchPermission(x, perm) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func matchPermission(granted Permission, perm Permission) bool {
+	if granted == perm {
+		return true
+	}
+	if strings.HasSuffix(string(granted), "*") {
+		return strings.HasPrefix(string(perm), strings.TrimSuffix(string(granted), "*"))
+	}
+	return false
+}
@@ -0,0 +1,22 @@
+package model
+
+import (
+	"github.com/knanao/goauth/server/setting"
+)
+
+// RealmName はユーザーが属するレルムの名前を返す
+func (u *User) RealmName() string {
+	return normalizeRealm(u.Realm)
+}
+
+func normalizeRealm(name string) string {
+	if name == "" {
+		return setting.DefaultRealm
+	}
+	return name
+}
+
+// realmUserKey はレルムの中で一意なUserIDのインデックスのキー
+func realmUserKey(realm string, userID string) string {
+	return normalizeRealm(realm) + "\x00" + userIDKey(userID)
+}
@@ -0,0 +1,167 @@
+package model
+
+import (
+	"context"
+	"os"
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/knanao/goauth/server/setting"
+)
+
+// WatchableStore は外部からの変更を検出できるUserStore
+type WatchableStore interface {
+	UserStore
+	// Modified は前回の読み書きの後にデータが変更されたかを返す
+	Modified() (bool, error)
+}
+
+// fileStamp はファイルの変更検出に使用する更新日時とサイズ
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+func statFile(path string) (fileStamp, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return fileStamp{}, err
+	}
+	return fileStamp{info.ModTime(), info.Size()}, nil
+}
+
+// reloadUsers はストアから読み直したユーザーでメモリ上のデータを置き換える
+//
+// 読み込みに失敗した場合や、厳格モードで検証エラーがある場合は現在のデータをそのまま残す
+func (a *UserDataAccessor) reloadUsers() error {
+	records, err := a.Store.Load()
+	if err != nil {
+		return err
+	}
+	records = canonicalizeLoaded(records)
+	report := validateUsers(records, a.RBAC)
+	logReport(&report)
+	if report.HasErrors() && setting.UserStore.Strict {
+		a.finishLoad(false)
+		return &ValidationError{report}
+	}
+	a.finishLoad(true)
+	records = loadableUsers(records)
+	a.skipped = recordIssues(&report)
+	oldUsers := users
+	users = make(map[ID]User)
+	initIndexes()
+	for _, x := range records {
+		if old, ok := oldUsers[x.ID]; ok && a.ReadOnly() {
+			// 読み取り専用のストアではログインの記録をメモリ上にのみ保持している
+			copyLoginRecord(&x, &old)
+		}
+		if old, ok := oldUsers[x.ID]; ok && x.Version <= old.Version {
+			// 直接編集されたファイルでも変更されたユーザーのバージョンは進める
+			x.Version = old.Version
+			if !sameUser(&old, &x) {
+				x.Version++
+			}
+		}
+		putUser(x)
+	}
+	events := diffUsers(oldUsers, users)
+	counts := make(map[ChangeType]int)
+	for _, x := range events {
+		counts[x.Type]++
+		a.notify(x)
+	}
+	e.Logger.Infof("User data reloaded. users[%d] added[%d] removed[%d] changed[%d]",
+		len(users), counts[ChangeCreated], counts[ChangeDeleted], counts[ChangeUpdated])
+	return nil
+}
+
+// sameUser は保存される内容が同じかを返す
+//
+// メモリ上で設定した時刻は単調時計の値と場所を持つため、ファイルから読み直した時刻と
+// reflect.DeepEqualでは一致しない。時刻と空のスライスを正規化してから比較する
+func sameUser(a *User, b *User) bool {
+	return reflect.DeepEqual(canonicalUser(*a), canonicalUser(*b))
+}
+
+func canonicalUser(u User) User {
+	u.CreatedAt = canonicalTime(u.CreatedAt)
+	u.UpdatedAt = canonicalTime(u.UpdatedAt)
+	u.PasswordChangedAt = canonicalTime(u.PasswordChangedAt)
+	u.LastLoginAt = canonicalTime(u.LastLoginAt)
+	u.LockedUntil = canonicalTime(u.LockedUntil)
+	if len(u.PasswordHistory) <= 0 {
+		u.PasswordHistory = nil
+	}
+	if len(u.Roles) <= 0 {
+		u.Roles = nil
+	}
+	if len(u.Groups) <= 0 {
+		u.Groups = nil
+	}
+	return u
+}
+
+// canonicalTime は単調時計の値を除き、UTCに揃える
+func canonicalTime(t time.Time) time.Time {
+	return t.Round(0).UTC()
+}
+
+// diffUsers は再読み込みの前後の差分を変更イベントとしてID順に返す
+func diffUsers(oldUsers map[ID]User, newUsers map[ID]User) []ChangeEvent {
+	events := []ChangeEvent{}
+	for id, x := range newUsers {
+		old, ok := oldUsers[id]
+		if ok && sameUser(&old, &x) {
+			continue
+		}
+		event := ChangeEvent{Type: ChangeCreated, ID: id}
+		event.User.copyPublic(&x)
+		if ok {
+			event.Type = ChangeUpdated
+			event.Previous = &User{}
+			event.Previous.copyPublic(&old)
+		}
+		events = append(events, event)
+	}
+	for id, old := range oldUsers {
+		if _, ok := newUsers[id]; !ok {
+			event := ChangeEvent{Type: ChangeDeleted, ID: id, Previous: &User{}}
+			event.User.copyPublic(&old)
+			event.Previous.copyPublic(&old)
+			events = append(events, event)
+		}
+	}
+	sort.Slice(events, func(i, j int) bool { return events[i].ID < events[j].ID })
+	return events
+}
+
+// watchLoop はストアの変更を定期的に確認し、変更があれば再読み込みする
+func (a *UserDataAccessor) watchLoop(store WatchableStore) {
+	defer close(a.stopWatchCh)
+	e.Logger.Info("model.UserDataAccessor Watch:start")
+	t := time.NewTicker(setting.UserStore.ReloadInterval)
+loop:
+	for {
+		select {
+		case <-t.C:
+			modified, err := store.Modified()
+			if err != nil {
+				e.Logger.Errorf("User Store Watch Error. [%s]", err)
+				break
+			}
+			if !modified {
+				break
+			}
+			resp := a.send(context.Background(), commandReload, nil)
+			if resp.err != nil {
+				e.Logger.Errorf("User Store Reload Error. Keep current data. [%s]", resp.err)
+			}
+		case <-a.stopWatchCh:
+			break loop
+		}
+	}
+	t.Stop()
+	e.Logger.Info("model.UserDataAccessor Watch:stop")
+}
@@ -0,0 +1,235 @@
+package model
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"hash"
+	"strconv"
+	"strings"
+)
+
+// SHA-crypt ($5$ SHA-256, $6$ SHA-512) 形式のハッシュ
+//
+// 他のシステムから移行したハッシュを検証するための形式で、
+// 検証に成功すると設定されたアルゴリズムで保存し直される
+const (
+	AlgorithmSHA256Crypt = "sha256-crypt"
+	AlgorithmSHA512Crypt = "sha512-crypt"
+)
+
+const (
+	shaCryptDefaultRounds = 5000
+	shaCryptMinRounds     = 1000
+	shaCryptMaxRounds     = 999999999
+	shaCryptMaxSalt       = 16
+	// shaCryptLimitRounds は検証を受け付けるラウンド数の上限。仕様上の上限では1回の検証に数分かかる
+	shaCryptLimitRounds = 10000000
+)
+
+const cryptAlphabet = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+type shaCryptHasher struct {
+	algorithm string
+	prefix    string
+	newHash   func() hash.Hash
+	// order は出力時に3バイトずつまとめるバイトの順序
+	order [][]int
+}
+
+var sha256CryptOrder = [][]int{
+	{0, 10, 20}, {21, 1, 11}, {12, 22, 2}, {3, 13, 23}, {24, 4, 14},
+	{15, 25, 5}, {6, 16, 26}, {27, 7, 17}, {18, 28, 8}, {9, 19, 29},
+	{-1, 31, 30},
+}
+
+var sha512CryptOrder = [][]int{
+	{0, 21, 42}, {22, 43, 1}, {44, 2, 23}, {3, 24, 45}, {25, 46, 4},
+	{47, 5, 26}, {6, 27, 48}, {28, 49, 7}, {50, 8, 29}, {9, 30, 51},
+	{31, 52, 10}, {53, 11, 32}, {12, 33, 54}, {34, 55, 13}, {56, 14, 35},
+	{15, 36, 57}, {37, 58, 16}, {59, 17, 38}, {18, 39, 60}, {40, 61, 19},
+	{62, 20, 41}, {-1, -1, 63},
+}
+
+func newSHA256CryptHasher() *shaCryptHasher {
+	return &shaCryptHasher{AlgorithmSHA256Crypt, "$5$", sha256.New, sha256CryptOrder}
+}
+
+func newSHA512CryptHasher() *shaCryptHasher {
+	return &shaCryptHasher{AlgorithmSHA512Crypt, "$6$", sha512.New, sha512CryptOrder}
+}
+
+func (h *shaCryptHasher) Algorithm() string {
+	return h.algorithm
+}
+
+func (h *shaCryptHasher) Match(hash PasswordHash) bool {
+	return strings.HasPrefix(string(hash), h.prefix)
+}
+
+func (h *shaCryptHasher) Hash(password []byte) (PasswordHash, error) {
+	salt, err := createSalt()
+	if err != nil {
+		return "", err
+	}
+	encoded := cryptBase64(salt)
+	if len(encoded) > shaCryptMaxSalt {
+		encoded = encoded[:shaCryptMaxSalt]
+	}
+	return h.crypt(password, encoded, shaCryptDefaultRounds, false), nil
+}
+
+func (h *shaCryptHasher) Verify(password []byte, hash PasswordHash) (bool, error) {
+	salt, rounds, custom, err := h.parse(hash)
+	if err != nil {
+		return false, err
+	}
+	if err := checkSHACryptRounds(rounds); err != nil {
+		return false, err
+	}
+	other := h.crypt(password, salt, rounds, custom)
+	return subtle.ConstantTimeCompare([]byte(hash), []byte(other)) == 1, nil
+}
+
+func (h *shaCryptHasher) NeedsRehash(hash PasswordHash) bool {
+	return true
+}
+
+// checkSHACryptRounds はラウンド数がshaCryptLimitRoundsを超えていないかを確認する
+func checkSHACryptRounds(rounds int) error {
+	if rounds > shaCryptLimitRounds {
+		return ErrorInvalidHash
+	}
+	return nil
+}
+
+// parse は "$5$rounds=N$salt$hash" 形式からソルトとラウンド数を取り出す
+func (h *shaCryptHasher) parse(hash PasswordHash) (salt string, rounds int, custom bool, err error) {
+	rest := strings.TrimPrefix(string(hash), h.prefix)
+	rounds = shaCryptDefaultRounds
+	if strings.HasPrefix(rest, "rounds=") {
+		i := strings.Index(rest, "$")
+		if i < 0 {
+			return "", 0, false, ErrorInvalidHash
+		}
+		rounds, err = strconv.Atoi(rest[len("rounds="):i])
+		if err != nil {
+			return "", 0, false, ErrorInvalidHash
+		}
+		custom = true
+		rest = rest[i+1:]
+	}
+	i := strings.LastIndex(rest, "$")
+	if i < 0 {
+		return "", 0, false, ErrorInvalidHash
+	}
+	salt = rest[:i]
+	if len(salt) > shaCryptMaxSalt {
+		salt = salt[:shaCryptMaxSalt]
+	}
+	if rounds < shaCryptMinRounds {
+		rounds = shaCryptMinRounds
+	}
+	if rounds > shaCryptMaxRounds {
+		rounds = shaCryptMaxRounds
+	}
+	return salt, rounds, custom, nil
+}
+
+func (h *shaCryptHasher) crypt(password []byte, salt string, rounds int, custom bool) PasswordHash {
+	s := []byte(salt)
+	b := h.newHash()
+	b.Write(password)
+	b.Write(s)
+	b.Write(password)
+	digestB := b.Sum(nil)
+
+	a := h.newHash()
+	a.Write(password)
+	a.Write(s)
+	a.Write(repeatBytes(digestB, len(password)))
+	for i := len(password); i > 0; i >>= 1 {
+		if i&1 != 0 {
+			a.Write(digestB)
+		} else {
+			a.Write(password)
+		}
+	}
+	digestA := a.Sum(nil)
+
+	dp := h.newHash()
+	for i := 0; i < len(password); i++ {
+		dp.Write(password)
+	}
+	p := repeatBytes(dp.Sum(nil), len(password))
+
+	ds := h.newHash()
+	for i := 0; i < 16+int(digestA[0]); i++ {
+		ds.Write(s)
+	}
+	sBytes := repeatBytes(ds.Sum(nil), len(s))
+
+	for i := 0; i < rounds; i++ {
+		c := h.newHash()
+		if i&1 != 0 {
+			c.Write(p)
+		} else {
+			c.Write(digestA)
+		}
+		if i%3 != 0 {
+			c.Write(sBytes)
+		}
+		if i%7 != 0 {
+			c.Write(p)
+		}
+		if i&1 != 0 {
+			c.Write(digestA)
+		} else {
+			c.Write(p)
+		}
+		digestA = c.Sum(nil)
+	}
+
+	out := strings.Builder{}
+	out.WriteString(h.prefix)
+	if custom {
+		out.WriteString("rounds=" + strconv.Itoa(rounds) + "$")
+	}
+	out.WriteString(salt)
+	out.WriteString("$")
+	out.WriteString(cryptEncode(h.order, digestA))
+	return PasswordHash(out.String())
+}
+
+// repeatBytes はbを繰り返してnバイトにする
+func repeatBytes(b []byte, n int) []byte {
+	res := make([]byte, 0, n)
+	for len(res) < n {
+		rest := n - len(res)
+		if rest > len(b) {
+			rest = len(b)
+		}
+		res = append(res, b[:rest]...)
+	}
+	return res
+}
+
+// cryptBase64 はcrypt形式のアルファベットでエンコードする
+func cryptBase64(b []byte) string {
+	out := strings.Builder{}
+	for i := 0; i < len(b); i += 3 {
+		var w uint
+		n := 0
+		for j := 0; j < 3; j++ {
+			w <<= 8
+			if i+j < len(b) {
+				w |= uint(b[i+j])
+				n++
+			}
+		}
+		for j := 0; j < n+1; j++ {
+			out.WriteByte(cryptAlphabet[(w>>uint(18-6*j))&0x3f])
+		}
+	}
+	return out.String()
+}
@@ -0,0 +1,133 @@
+package model
+
+import (
+	"github.com/knanao/goauth/server/envelope"
+	"github.com/knanao/goauth/server/setting"
+)
+
+// UserStore はユーザーデータの永続化先
+//
+// UserDataAccessorは起動時にLoadで全件を読み込み、
+// 以降の変更をPut/Deleteで書き込む。前回のLoadの後に外部で変更されたストアへの
+// 書き込みは、その変更を上書きしないようにErrorStoreConflictを返す
+type UserStore interface {
+	Load() ([]User, error)
+	Put(user User) error
+	// PutAll は複数のユーザーをまとめて保存する。一部のみが保存されることはない
+	PutAll(users []User) error
+	Delete(id ID) error
+	Close() error
+}
+
+// ReadOnlyStore は外部で管理されるファイルなど、書き込みのできないUserStore
+//
+// Put/PutAll/DeleteはErrorReadOnlyを返す
+type ReadOnlyStore interface {
+	UserStore
+	ReadOnly() bool
+}
+
+// stagedStore はLoadで読み込んだ内容を検証の結果に応じて確定または破棄するUserStore
+//
+// 拒否されたデータが次の書き込みで保存されないようにする
+type stagedStore interface {
+	commitLoad()
+	discardLoad()
+}
+
+// finishLoad は検証の結果に応じて読み込んだ内容を確定または破棄する
+func (a *UserDataAccessor) finishLoad(accepted bool) {
+	store, ok := a.Store.(stagedStore)
+	if !ok {
+		return
+	}
+	if accepted {
+		store.commitLoad()
+	} else {
+		store.discardLoad()
+	}
+}
+
+const (
+	StoreTypeJSON     = "json"
+	StoreTypeSQLite   = "sqlite"
+	StoreTypeBolt     = "bolt"
+	StoreTypeHtpasswd = "htpasswd"
+)
+
+// NewUserStore は設定に応じたUserStoreを作成する
+func NewUserStore() (UserStore, error) {
+	switch setting.UserStore.Type {
+	case StoreTypeJSON, "":
+		keyring, err := envelope.LoadKeyring(setting.UserStore.Key, setting.UserStore.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		store := NewJSONFileStore(setting.UserStore.JSONPath)
+		store.Keyring = keyring
+		return store, nil
+	case StoreTypeSQLite:
+		return NewSQLiteStore(setting.UserStore.SQLitePath)
+	case StoreTypeBolt:
+		return NewBoltStore(setting.UserStore.BoltPath)
+	case StoreTypeHtpasswd:
+		return NewHtpasswdStore(setting.UserStore.HtpasswdPath, setting.UserStore.HtgroupPath), nil
+	}
+	return nil, ErrorUnknownStoreType
+}
+
+// ReadOnly はストアが書き込みのできないReadOnlyStoreかを返す
+func (a *UserDataAccessor) ReadOnly() bool {
+	store, ok := a.Store.(ReadOnlyStore)
+	return ok && store.ReadOnly()
+}
+
+// storeError はストアへの書き込みのエラーを返す。mainLoopからのみ呼び出す
+//
+// 外部で変更されていた場合はストアを読み直す。読み直す前のデータに基づく変更を
+// そのまま保存し直すことはせず、ErrorStoreConflictを返して呼び出し元にやり直させる
+func (a *UserDataAccessor) storeError(err error) error {
+	if err != ErrorStoreConflict {
+		return err
+	}
+	if rerr := a.reloadUsers(); rerr != nil {
+		e.Logger.Errorf("User Store Reload Error. [%s]", rerr)
+	}
+	return err
+}
+
+// putLoginRecord はログインの記録を保存し、保存したユーザーを返す
+//
+// 読み取り専用のストアではメモリ上にのみ保持する。checkWriteによる検証は行わない。
+// ストアが外部で変更されていた場合は読み直したユーザーにログインの記録だけを反映して保存し直す
+func (a *UserDataAccessor) putLoginRecord(user User) (User, error) {
+	if a.ReadOnly() {
+		return user, nil
+	}
+	err := a.Store.Put(user)
+	if err != ErrorStoreConflict {
+		return user, err
+	}
+	if err := a.reloadUsers(); err != nil {
+		return user, err
+	}
+	current, ok := users[user.ID]
+	if !ok {
+		return user, ErrorNotFound
+	}
+	copyLoginRecord(&current, &user)
+	current.Version++
+	if err := a.Store.Put(current); err != nil {
+		return user, err
+	}
+	return current, nil
+}
+
+// copyLoginRecord はログインの記録とロックの状態をコピーする
+func copyLoginRecord(u *User, f *User) {
+	u.LastLoginAt = f.LastLoginAt
+	u.LastLoginIP = f.LastLoginIP
+	u.FailedLogins = f.FailedLogins
+	u.Lockouts = f.Lockouts
+	u.LockedUntil = f.LockedUntil
+}
@@ -0,0 +1,158 @@
+package model
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// HtpasswdStore はApacheのhtpasswdファイルをユーザーとして読み込む読み取り専用のストア
+//
+// ロールはhtgroup形式("ロール: ユーザー ユーザー")のファイルで指定する。
+// どのロールにも含まれないユーザーはRoleUserとして扱う
+type HtpasswdStore struct {
+	path       string
+	groupPath  string // 空の場合はすべてのユーザーをRoleUserとする
+	stamp      fileStamp
+	groupStamp fileStamp
+}
+
+func NewHtpasswdStore(path string, groupPath string) *HtpasswdStore {
+	return &HtpasswdStore{path: path, groupPath: groupPath}
+}
+
+// htpasswdIDPrefix は再読み込みでも変わらないようにユーザー名から作るIDの接頭辞
+const htpasswdIDPrefix = "htpasswd:"
+
+func (s *HtpasswdStore) Load() ([]User, error) {
+	stamp, err := statFile(s.path)
+	if err != nil {
+		return nil, err
+	}
+	groupStamp, roles, err := s.loadGroups()
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(s.path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	records := []User{}
+	seen := make(map[string]int)
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		x := strings.SplitN(text, ":", 2)
+		if len(x) != 2 || x[0] == "" {
+			return nil, fmt.Errorf("%s line %d: invalid entry", s.path, line)
+		}
+		name, hash := x[0], x[1]
+		if prev, ok := seen[name]; ok {
+			return nil, fmt.Errorf("%s line %d: duplicate user %s (line %d)", s.path, line, name, prev)
+		}
+		seen[name] = line
+		user := User{
+			ID:       ID(htpasswdIDPrefix + name),
+			UserID:   name,
+			Password: PasswordHash(hash),
+			Roles:    roles[name],
+		}
+		if len(user.Roles) <= 0 {
+			user.Roles = []Role{RoleUser}
+		}
+		records = append(records, user)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	s.stamp = stamp
+	s.groupStamp = groupStamp
+	return records, nil
+}
+
+// loadGroups はhtgroupファイルからユーザーごとのロールを読み込む。ファイルがない場合は空を返す
+func (s *HtpasswdStore) loadGroups() (fileStamp, map[string][]Role, error) {
+	roles := make(map[string][]Role)
+	if s.groupPath == "" {
+		return fileStamp{}, roles, nil
+	}
+	stamp, err := statFile(s.groupPath)
+	if os.IsNotExist(err) {
+		return fileStamp{}, roles, nil
+	}
+	if err != nil {
+		return fileStamp{}, nil, err
+	}
+	f, err := os.Open(s.groupPath)
+	if err != nil {
+		return fileStamp{}, nil, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		x := strings.SplitN(text, ":", 2)
+		if len(x) != 2 || strings.TrimSpace(x[0]) == "" {
+			return fileStamp{}, nil, fmt.Errorf("%s line %d: invalid entry", s.groupPath, line)
+		}
+		role := Role(strings.TrimSpace(x[0]))
+		for _, name := range strings.Fields(x[1]) {
+			roles[name] = append(roles[name], role)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fileStamp{}, nil, err
+	}
+	return stamp, roles, nil
+}
+
+// Modified はhtpasswdファイルかhtgroupファイルが前回の読み込みの後に変更されたかを返す
+func (s *HtpasswdStore) Modified() (bool, error) {
+	stamp, err := statFile(s.path)
+	if err != nil {
+		return false, err
+	}
+	if stamp != s.stamp {
+		return true, nil
+	}
+	if s.groupPath == "" {
+		return false, nil
+	}
+	groupStamp, err := statFile(s.groupPath)
+	if os.IsNotExist(err) {
+		return s.groupStamp != fileStamp{}, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return groupStamp != s.groupStamp, nil
+}
+
+// ReadOnly はファイルを変更しないことを示す
+func (s *HtpasswdStore) ReadOnly() bool {
+	return true
+}
+
+func (s *HtpasswdStore) Put(user User) error {
+	return ErrorReadOnly
+}
+
+func (s *HtpasswdStore) PutAll(users []User) error {
+	return ErrorReadOnly
+}
+
+func (s *HtpasswdStore) Delete(id ID) error {
+	return ErrorReadOnly
+}
+
+func (s *HtpasswdStore) Close() error {
+	return nil
+}
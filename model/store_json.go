@@ -0,0 +1,192 @@
+package model
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"sort"
+
+	"github.com/knanao/goauth/server/envelope"
+	"github.com/knanao/goauth/server/internal/fileutil"
+)
+
+// JSONFileStore はユーザーの一覧を1つのJSONファイルに保存する
+type JSONFileStore struct {
+	// Keyring が設定されている場合は暗号化して保存する。
+	// 読み込み時は暗号化されているかを自動で判定する
+	Keyring *envelope.Keyring
+
+	path    string
+	records map[ID]User
+	// invalid はIDが空または重複しているため読み込まないレコード。書き込み時にそのまま残す
+	invalid        []User
+	pending        map[ID]User // Loadで読み込み、検証が終わるまで確定していない内容
+	pendingInvalid []User
+	stamp          fileStamp // 最後に読み書きした時点のファイルの状態
+}
+
+func NewJSONFileStore(path string) *JSONFileStore {
+	return &JSONFileStore{path: path, records: make(map[ID]User)}
+}
+
+// Load はファイルを読み込む。解析に失敗した場合は前回読み込んだ内容を保持する
+//
+// 読み込んだ内容はcommitLoadを呼び出すまで書き込みに使用しない
+func (s *JSONFileStore) Load() ([]User, error) {
+	stamp, err := statFile(s.path)
+	if err != nil {
+		return nil, err
+	}
+	bytes, err := ioutil.ReadFile(s.path)
+	if err != nil {
+		return nil, err
+	}
+	bytes, err = s.decode(bytes)
+	if err != nil {
+		s.stamp = stamp
+		return nil, err
+	}
+	var records []User
+	if err := json.Unmarshal(bytes, &records); err != nil {
+		s.stamp = stamp
+		return nil, err
+	}
+	// IDが空または重複しているレコードはvalidateUsersで報告する
+	newRecords := make(map[ID]User)
+	invalid := []User{}
+	for _, x := range records {
+		if _, ok := newRecords[x.ID]; ok || x.ID == "" {
+			invalid = append(invalid, x)
+			continue
+		}
+		newRecords[x.ID] = x
+	}
+	s.pending = newRecords
+	s.pendingInvalid = invalid
+	s.stamp = stamp
+	return records, nil
+}
+
+// commitLoad は検証を通過した直前のLoadの内容を以降の書き込みに使用する
+func (s *JSONFileStore) commitLoad() {
+	if s.pending != nil {
+		s.records = s.pending
+		s.invalid = s.pendingInvalid
+		s.pending = nil
+		s.pendingInvalid = nil
+	}
+}
+
+// discardLoad は検証で拒否された直前のLoadの内容を破棄し、前回の内容を保持する
+func (s *JSONFileStore) discardLoad() {
+	s.pending = nil
+	s.pendingInvalid = nil
+}
+
+// Modified はファイルが前回の読み書きの後に変更されたかを返す
+func (s *JSONFileStore) Modified() (bool, error) {
+	stamp, err := statFile(s.path)
+	if err != nil {
+		return false, err
+	}
+	return stamp != s.stamp, nil
+}
+
+func (s *JSONFileStore) Put(user User) error {
+	old, ok := s.records[user.ID]
+	s.records[user.ID] = user
+	if err := s.write(); err != nil {
+		if ok {
+			s.records[user.ID] = old
+		} else {
+			delete(s.records, user.ID)
+		}
+		return err
+	}
+	return nil
+}
+
+func (s *JSONFileStore) PutAll(users []User) error {
+	old := make(map[ID]User)
+	for k, v := range s.records {
+		old[k] = v
+	}
+	for _, x := range users {
+		s.records[x.ID] = x
+	}
+	if err := s.write(); err != nil {
+		s.records = old
+		return err
+	}
+	return nil
+}
+
+func (s *JSONFileStore) Delete(id ID) error {
+	old, ok := s.records[id]
+	if !ok {
+		return ErrorNotFound
+	}
+	delete(s.records, id)
+	if err := s.write(); err != nil {
+		s.records[id] = old
+		return err
+	}
+	return nil
+}
+
+func (s *JSONFileStore) Close() error {
+	return nil
+}
+
+// write は全件をファイルに書き込む
+//
+// 前回の読み書きの後にファイルが変更されている場合は、手作業での編集やusertoolでの
+// 取り込みを上書きしないようにErrorStoreConflictを返す
+func (s *JSONFileStore) write() error {
+	if stamp, err := statFile(s.path); err == nil && stamp != s.stamp {
+		return ErrorStoreConflict
+	}
+	records := []User{}
+	for _, x := range s.records {
+		records = append(records, x)
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].ID < records[j].ID })
+	records = append(records, s.invalid...)
+	bytes, err := json.MarshalIndent(records, "", "  ")
+	if err != nil {
+		return err
+	}
+	if s.Keyring != nil {
+		bytes, err = s.Keyring.Seal(bytes)
+		if err != nil {
+			return err
+		}
+	}
+	if err := fileutil.WriteAtomic(s.path, bytes, 0600); err != nil {
+		return err
+	}
+	stamp, err := statFile(s.path)
+	if err != nil {
+		return err
+	}
+	s.stamp = stamp
+	return nil
+}
+
+// decode は暗号化されたファイルを復号する。暗号化されていない場合はそのまま返す
+func (s *JSONFileStore) decode(data []byte) ([]byte, error) {
+	if !envelope.IsSealed(data) {
+		if s.Keyring != nil {
+			e.Logger.Infof("User file[%s] is not encrypted. It will be encrypted on next write.", s.path)
+		}
+		return data, nil
+	}
+	plain, keyID, err := s.Keyring.Open(data)
+	if err != nil {
+		return nil, err
+	}
+	if keyID != s.Keyring.PrimaryID() {
+		e.Logger.Infof("User file[%s] is encrypted with key[%s]. It will be re-encrypted with key[%s] on next write.",
+			s.path, keyID, s.Keyring.PrimaryID())
+	}
+	return plain, nil
+}
@@ -0,0 +1,230 @@
+package model
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/knanao/goauth/server/setting"
+	"github.com/labstack/echo"
+)
+
+// setupTestSetting はハッシュを軽くした既定の設定を読み込み、テストの終了時に戻す
+func setupTestSetting(t *testing.T) {
+	t.Helper()
+	password, userStore := setting.Password, setting.UserStore
+	t.Cleanup(func() {
+		setting.Password, setting.UserStore = password, userStore
+	})
+	setting.Load()
+	setting.Password.Algorithm = "pbkdf2-sha256"
+	setting.Password.PBKDF2Iterations = 1000
+	setting.UserStore.ReloadInterval = 0
+	setting.UserStore.Strict = false
+}
+
+// writeUserFile はユーザーの一覧をJSONファイルとして書き込む
+func writeUserFile(t *testing.T, path string, records []User) {
+	t.Helper()
+	data, err := json.MarshalIndent(records, "", "  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// startTestAccessor はpathのJSONファイルを使用するUserDataAccessorを起動する
+func startTestAccessor(t *testing.T, path string) *UserDataAccessor {
+	t.Helper()
+	server := echo.New()
+	server.Logger.SetOutput(ioutil.Discard)
+	a := &UserDataAccessor{Store: NewJSONFileStore(path)}
+	if err := a.Start(server); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(a.Stop)
+	return a
+}
+
+// testHash はテスト用のパスワードのハッシュを返す。UserDataAccessorの起動後に呼び出す
+func testHash(t *testing.T) PasswordHash {
+	t.Helper()
+	hash, err := HashPassword("Password-1234")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hash
+}
+
+func TestJSONFileStoreConflict(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users.json")
+	writeUserFile(t, path, []User{})
+	s := NewJSONFileStore(path)
+	if _, err := s.Load(); err != nil {
+		t.Fatal(err)
+	}
+	s.commitLoad()
+	if err := s.Put(User{ID: "1", UserID: "alice"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// 前回の書き込みの後にファイルが編集された
+	writeUserFile(t, path, []User{{ID: "1", UserID: "alice", FullName: "Edited by hand"}})
+	if err := s.Put(User{ID: "2", UserID: "bob"}); err != ErrorStoreConflict {
+		t.Fatalf("Put after external edit: err = %v, want %v", err, ErrorStoreConflict)
+	}
+	if err := s.Delete("1"); err != ErrorStoreConflict {
+		t.Fatalf("Delete after external edit: err = %v, want %v", err, ErrorStoreConflict)
+	}
+	records, err := s.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.commitLoad()
+	if len(records) != 1 || records[0].FullName != "Edited by hand" {
+		t.Fatalf("external edit was overwritten: %+v", records)
+	}
+	if err := s.Put(User{ID: "2", UserID: "bob"}); err != nil {
+		t.Fatalf("Put after reload: %v", err)
+	}
+	if records, err := s.Load(); err != nil || len(records) != 2 {
+		t.Fatalf("records = %+v, %v", records, err)
+	}
+}
+
+func TestLoginRecordKeepsExternalEdit(t *testing.T) {
+	setupTestSetting(t)
+	path := filepath.Join(t.TempDir(), "users.json")
+	writeUserFile(t, path, []User{})
+	a := startTestAccessor(t, path)
+	alice, err := a.Create(User{UserID: "alice", Password: testHash(t), FullName: "Alice", Roles: []Role{RoleUser}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	edited := alice
+	edited.FullName = "Alice Liddell"
+	writeUserFile(t, path, []User{edited})
+
+	// ログインの記録は読み直したユーザーに反映して保存する
+	failed, err := a.LoginFailed(alice.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if failed.FullName != "Alice Liddell" || failed.FailedLogins != 1 {
+		t.Errorf("after login failure: full_name[%s] failed_logins[%d]", failed.FullName, failed.FailedLogins)
+	}
+	s := NewJSONFileStore(path)
+	records, err := s.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || records[0].FullName != "Alice Liddell" || records[0].FailedLogins != 1 {
+		t.Errorf("stored = %+v", records)
+	}
+}
+
+func TestUpdateAfterExternalEdit(t *testing.T) {
+	setupTestSetting(t)
+	path := filepath.Join(t.TempDir(), "users.json")
+	writeUserFile(t, path, []User{})
+	a := startTestAccessor(t, path)
+	alice, err := a.Create(User{UserID: "alice", Password: testHash(t), FullName: "Alice", Roles: []Role{RoleUser}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	edited := alice
+	edited.Email = "alice@example.com"
+	writeUserFile(t, path, []User{edited})
+
+	update := alice
+	update.FullName = "Alice L."
+	if err := a.Update(update); err != ErrorStoreConflict {
+		t.Fatalf("Update after external edit: err = %v, want %v", err, ErrorStoreConflict)
+	}
+	// 読み直した内容を基にやり直せば両方の変更が残る
+	current, err := a.FindByID(alice.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if current.Email != "alice@example.com" {
+		t.Fatalf("external edit was not reloaded: %+v", current)
+	}
+	current.FullName = "Alice L."
+	if err := a.Update(current); err != nil {
+		t.Fatal(err)
+	}
+	records, err := NewJSONFileStore(path).Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || records[0].Email != "alice@example.com" || records[0].FullName != "Alice L." {
+		t.Errorf("stored = %+v", records)
+	}
+}
+
+func TestLoadInvalidIDs(t *testing.T) {
+	setupTestSetting(t)
+	path := filepath.Join(t.TempDir(), "users.json")
+	records := []User{
+		{ID: "1", UserID: "alice", Source: SourceLDAP},
+		{ID: "", UserID: "bob", Source: SourceLDAP},
+		{ID: "1", UserID: "carol", Source: SourceLDAP},
+	}
+	writeUserFile(t, path, records)
+
+	// 厳格モードでは読み込まない
+	setting.UserStore.Strict = true
+	server := echo.New()
+	server.Logger.SetOutput(ioutil.Discard)
+	strict := &UserDataAccessor{Store: NewJSONFileStore(path)}
+	err := strict.Start(server)
+	verr, ok := err.(*ValidationError)
+	if !ok {
+		t.Fatalf("strict Start: err = %v, want *ValidationError", err)
+	}
+	codes := make(map[string]int)
+	for _, x := range verr.Report.Errors() {
+		codes[x.Code] = x.Record
+	}
+	if codes[IssueEmptyID] != 2 || codes[IssueDuplicateID] != 3 {
+		t.Errorf("strict issues = %+v", verr.Report.Issues)
+	}
+
+	// 厳格モードでなければ最初のレコードのみを読み込み、問題を報告する
+	setting.UserStore.Strict = false
+	a := startTestAccessor(t, path)
+	all, err := a.FindAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 1 || all[0].UserID != "alice" {
+		t.Fatalf("loaded = %+v", all)
+	}
+	report, err := a.Validate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	codes = make(map[string]int)
+	for _, x := range report.Errors() {
+		codes[x.Code] = x.Record
+	}
+	if report.Users != 3 || codes[IssueEmptyID] != 2 || codes[IssueDuplicateID] != 3 {
+		t.Errorf("report = %+v", report)
+	}
+
+	// 読み込まなかったレコードは書き込みで失われない
+	if _, err := a.Create(User{UserID: "dave", Password: testHash(t), Roles: []Role{RoleUser}}); err != nil {
+		t.Fatal(err)
+	}
+	stored, err := NewJSONFileStore(path).Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stored) != 4 {
+		t.Errorf("stored = %+v", stored)
+	}
+}
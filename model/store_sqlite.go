@@ -0,0 +1,109 @@
+package model
+
+import (
+	"database/sql"
+	"encoding/json"
+
+	_ "modernc.org/sqlite"
+)
+
+// SQLiteStore はユーザーを組み込みのSQLiteデータベースに保存する
+//
+// 属性の追加に対応できるように、ユーザーはJSONとして1列に保存する
+type SQLiteStore struct {
+	db *sql.DB
+}
+
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS users (
+	id      TEXT PRIMARY KEY,
+	user_id TEXT NOT NULL,
+	data    TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS users_user_id ON users (user_id);
+`
+
+func NewSQLiteStore(path string) (*SQLiteStore, error) {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, err
+	}
+	// SQLiteは書き込みが直列化されるため接続は1本で十分
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec(sqliteSchema); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &SQLiteStore{db}, nil
+}
+
+func (s *SQLiteStore) Load() ([]User, error) {
+	rows, err := s.db.Query("SELECT data FROM users ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	records := []User{}
+	for rows.Next() {
+		var data string
+		if err := rows.Scan(&data); err != nil {
+			return nil, err
+		}
+		var user User
+		if err := json.Unmarshal([]byte(data), &user); err != nil {
+			return nil, err
+		}
+		records = append(records, user)
+	}
+	return records, rows.Err()
+}
+
+const sqliteUpsert = "INSERT INTO users (id, user_id, data) VALUES (?, ?, ?) " +
+	"ON CONFLICT (id) DO UPDATE SET user_id = excluded.user_id, data = excluded.data"
+
+func (s *SQLiteStore) Put(user User) error {
+	data, err := json.Marshal(user)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec(sqliteUpsert, string(user.ID), user.UserID, string(data))
+	return err
+}
+
+func (s *SQLiteStore) PutAll(users []User) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	for _, x := range users {
+		data, err := json.Marshal(x)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		if _, err := tx.Exec(sqliteUpsert, string(x.ID), x.UserID, string(data)); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *SQLiteStore) Delete(id ID) error {
+	res, err := s.db.Exec("DELETE FROM users WHERE id = ?", string(id))
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n <= 0 {
+		return ErrorNotFound
+	}
+	return nil
+}
+
+func (s *SQLiteStore) Close() error {
+	return s.db.Close()
+}
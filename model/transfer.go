@@ -0,0 +1,708 @@
+package model
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/knanao/goauth/server/setting"
+	"golang.org/x/crypto/bcrypt"
+)
+
+type TransferFormat string
+
+const (
+	FormatCSV       TransferFormat = "csv"
+	FormatJSONLines TransferFormat = "jsonl"
+	FormatLDIF      TransferFormat = "ldif"
+)
+
+var ErrorUnknownFormat = errors.New("Unknown Format")
+
+// ImportRecord は取り込みと書き出しに使用する1件のユーザー
+type ImportRecord struct {
+	Line         int          `json:"-"`
+	ID           ID           `json:"id,omitempty"`
+	Realm        string       `json:"realm,omitempty"`
+	UserID       string       `json:"user_id"`
+	FullName     string       `json:"full_name,omitempty"`
+	Email        string       `json:"email,omitempty"`
+	Roles        []Role       `json:"roles,omitempty"`
+	Groups       []string     `json:"groups,omitempty"`
+	Disabled     bool         `json:"disabled,omitempty"`
+	Password     string       `json:"password,omitempty"`      // 平文のパスワード
+	PasswordHash PasswordHash `json:"password_hash,omitempty"` // ハッシュ済みのパスワード
+}
+
+type ImportOptions struct {
+	Format TransferFormat
+	// DryRun がtrueの場合は確認のみを行い保存しない
+	DryRun bool
+	// AllowPreHashed がtrueの場合はハッシュ済みのパスワードを受け入れる
+	AllowPreHashed bool
+	// RBAC が指定された場合は未定義のロールとグループをエラーにする
+	RBAC *RBAC
+	// Realm が指定された場合はすべてのユーザーをこのレルムに追加する。
+	// 別のレルムが指定された行はエラーにする
+	Realm string
+}
+
+// ImportRowResult は1行ごとの確認結果
+type ImportRowResult struct {
+	Line   int
+	UserID string
+	ID     ID // 保存したユーザーのID
+	Errors []string
+}
+
+type ImportResult struct {
+	Rows     []ImportRowResult
+	Imported int
+	DryRun   bool
+}
+
+// HasErrors はいずれかの行にエラーがあるかを返す
+func (r *ImportResult) HasErrors() bool {
+	for _, x := range r.Rows {
+		if len(x.Errors) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Import はユーザーをまとめて追加する
+//
+// いずれかの行にエラーがある場合はどの行も保存しない
+func (a *UserDataAccessor) Import(r io.Reader, opt ImportOptions) (ImportResult, error) {
+	return a.ImportContext(context.Background(), r, opt)
+}
+
+func (a *UserDataAccessor) ImportContext(ctx context.Context, r io.Reader, opt ImportOptions) (ImportResult, error) {
+	res := ImportResult{DryRun: opt.DryRun}
+	records, err := parseImport(r, opt.Format)
+	if err != nil {
+		return res, err
+	}
+	res.Rows = make([]ImportRowResult, len(records))
+	newUsers := make([]User, len(records))
+	for i, x := range records {
+		res.Rows[i] = ImportRowResult{Line: x.Line, UserID: x.UserID}
+		user, errs := prepareImport(&x, &opt)
+		res.Rows[i].Errors = errs
+		newUsers[i] = user
+	}
+	dryRun := opt.DryRun || res.HasErrors()
+
+	req := []interface{}{newUsers, dryRun}
+	resp := a.send(ctx, commandImport, req)
+	if resp.err != nil {
+		e.Logger.Debugf("User Import Error. [%s]", resp.err)
+		return res, resp.err
+	}
+	rowErrors, ok := resp.result[0].(map[int][]string)
+	if !ok {
+		e.Logger.Debugf("User Import Error. [%s]", ErrorOther)
+		return res, ErrorOther
+	}
+	ids, ok := resp.result[1].([]ID)
+	if !ok {
+		e.Logger.Debugf("User Import Error. [%s]", ErrorOther)
+		return res, ErrorOther
+	}
+	for i, x := range rowErrors {
+		res.Rows[i].Errors = append(res.Rows[i].Errors, x...)
+	}
+	for i, x := range ids {
+		res.Rows[i].ID = x
+	}
+	if !dryRun && !res.HasErrors() {
+		res.Imported = len(newUsers)
+	}
+	return res, nil
+}
+
+// Export はすべてのユーザーをパスワードハッシュを含めて書き出す
+//
+// realmが空でない場合はそのレルムのユーザーのみを書き出す
+func (a *UserDataAccessor) Export(w io.Writer, format TransferFormat, realm string) error {
+	return a.ExportContext(context.Background(), w, format, realm)
+}
+
+func (a *UserDataAccessor) ExportContext(ctx context.Context, w io.Writer, format TransferFormat, realm string) error {
+	all, err := a.FindAllContext(ctx)
+	if err != nil {
+		return err
+	}
+	users := []User{}
+	for _, x := range all {
+		if realm == "" || normalizeRealm(x.Realm) == normalizeRealm(realm) {
+			users = append(users, x)
+		}
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].ID < users[j].ID })
+	records := make([]ImportRecord, len(users))
+	for i, x := range users {
+		records[i] = ImportRecord{
+			ID:           x.ID,
+			Realm:        x.Realm,
+			UserID:       x.DisplayID(),
+			FullName:     x.FullName,
+			Email:        x.Email,
+			Roles:        x.Roles,
+			Groups:       x.Groups,
+			Disabled:     x.Disabled,
+			PasswordHash: x.Password,
+		}
+	}
+	switch format {
+	case FormatCSV:
+		return writeCSV(w, records)
+	case FormatJSONLines:
+		return writeJSONLines(w, records)
+	case FormatLDIF:
+		return writeLDIF(w, records)
+	}
+	return ErrorUnknownFormat
+}
+
+// prepareImport は1件を確認してユーザーに変換する。重複の確認はmainLoopで行う
+func prepareImport(x *ImportRecord, opt *ImportOptions) (User, []string) {
+	errs := []string{}
+	user := User{
+		ID:       x.ID,
+		Realm:    x.Realm,
+		UserID:   x.UserID,
+		FullName: x.FullName,
+		Email:    x.Email,
+		Roles:    x.Roles,
+		Groups:   x.Groups,
+		Disabled: x.Disabled,
+	}
+	if x.UserID == "" {
+		errs = append(errs, "user_id is required")
+	} else if err := canonicalizeUserID(&user); err != nil {
+		errs = append(errs, fmt.Sprintf("invalid user_id: %s", x.UserID))
+	}
+	if opt.Realm != "" {
+		if user.Realm == "" {
+			user.Realm = opt.Realm
+		} else if normalizeRealm(user.Realm) != normalizeRealm(opt.Realm) {
+			errs = append(errs, fmt.Sprintf("realm must be %s", opt.Realm))
+		}
+	}
+	if _, ok := setting.LookupRealm(user.Realm); !ok {
+		errs = append(errs, fmt.Sprintf("unknown realm: %s", user.Realm))
+	}
+	if opt.RBAC != nil {
+		for _, role := range x.Roles {
+			if !opt.RBAC.HasRoleDefinition(role) {
+				errs = append(errs, fmt.Sprintf("unknown role: %s", role))
+			}
+		}
+		for _, group := range x.Groups {
+			if !opt.RBAC.HasGroup(group) {
+				errs = append(errs, fmt.Sprintf("unknown group: %s", group))
+			}
+		}
+	}
+	switch {
+	case x.Password != "" && x.PasswordHash != "":
+		errs = append(errs, "password and password_hash must not both be set")
+	case x.PasswordHash != "":
+		if !opt.AllowPreHashed {
+			errs = append(errs, "pre-hashed passwords are not allowed")
+			break
+		}
+		if err := checkImportedHash(x.PasswordHash); err != nil {
+			errs = append(errs, err.Error())
+			break
+		}
+		user.Password = x.PasswordHash
+	case x.Password != "":
+		if err := CheckPasswordPolicy(x.Password, &user); err != nil {
+			for _, v := range err.(*PasswordPolicyError).Violations {
+				errs = append(errs, v.Message)
+			}
+			break
+		}
+		if opt.DryRun || len(errs) > 0 {
+			// 保存しない場合はハッシュ化を省略する
+			break
+		}
+		hash, err := HashPassword(x.Password)
+		if err != nil {
+			errs = append(errs, err.Error())
+			break
+		}
+		user.Password = hash
+	default:
+		errs = append(errs, "password or password_hash is required")
+	}
+	return user, errs
+}
+
+// checkImportedHash はハッシュ済みのパスワードの形式を確認する
+func checkImportedHash(hash PasswordHash) error {
+	algorithm, err := HashAlgorithm(hash)
+	if err != nil {
+		return errors.New("bad hash format: unknown algorithm")
+	}
+	if HashPeppered(hash) && setting.Password.Pepper == "" {
+		return fmt.Errorf("bad hash format: peppered %s hashes cannot be imported without a pepper", algorithm)
+	}
+	return checkHashFormat(hash)
+}
+
+// checkHashFormat はハッシュのアルゴリズムを判別し、パラメーターを読み取れるかを確認する
+func checkHashFormat(hash PasswordHash) error {
+	hash, _ = splitPepper(hash)
+	algorithm, err := HashAlgorithm(hash)
+	if err != nil {
+		return errors.New("bad hash format: unknown algorithm")
+	}
+	switch algorithm {
+	case AlgorithmBcrypt:
+		_, err = bcrypt.Cost([]byte(hash))
+	case AlgorithmScrypt, AlgorithmPBKDF2SHA256:
+		var params string
+		var salt, key []byte
+		if params, salt, key, err = splitHash(hash, algorithm); err != nil {
+			break
+		}
+		var p map[string]int
+		if p, err = parseParams(params); err != nil {
+			break
+		}
+		check := checkScryptParams
+		if algorithm == AlgorithmPBKDF2SHA256 {
+			check = checkPbkdf2Params
+		}
+		if check(p, salt, key) != nil {
+			return fmt.Errorf("bad hash format: %s parameters out of range", algorithm)
+		}
+	case AlgorithmArgon2id:
+		var p map[string]int
+		var salt, key []byte
+		if p, salt, key, err = (&argon2idHasher{}).parse(hash); err != nil {
+			break
+		}
+		// 範囲外のパラメーターは検証時にpanicやメモリ不足を起こすため取り込まない
+		if checkArgon2idParams(p, salt, key) != nil {
+			return fmt.Errorf("bad hash format: %s parameters out of range", algorithm)
+		}
+	case AlgorithmSHA256Crypt, AlgorithmSHA512Crypt:
+		h := newSHA256CryptHasher()
+		if algorithm == AlgorithmSHA512Crypt {
+			h = newSHA512CryptHasher()
+		}
+		var rounds int
+		if _, rounds, _, err = h.parse(hash); err != nil {
+			break
+		}
+		if checkSHACryptRounds(rounds) != nil {
+			return fmt.Errorf("bad hash format: %s rounds out of range", algorithm)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("bad hash format: %s", algorithm)
+	}
+	return nil
+}
+
+// checkImportDuplicates はIDとUserIDの重複を既存のデータと取り込むデータの中で確認する
+func checkImportDuplicates(newUsers []User) map[int][]string {
+	rowErrors := make(map[int][]string)
+	ids := make(map[ID]int)
+	userIDs := make(map[string]int)
+	for i, x := range newUsers {
+		if x.ID != "" {
+			if _, ok := users[x.ID]; ok {
+				rowErrors[i] = append(rowErrors[i], fmt.Sprintf("duplicate id: %s", x.ID))
+			} else if j, ok := ids[x.ID]; ok {
+				rowErrors[i] = append(rowErrors[i], fmt.Sprintf("duplicate id: %s (row %d)", x.ID, j+1))
+			}
+			ids[x.ID] = i
+		}
+		if x.UserID == "" {
+			continue
+		}
+		key := realmUserKey(x.Realm, x.UserID)
+		if userIDIndex.exists(key, "") {
+			rowErrors[i] = append(rowErrors[i], fmt.Sprintf("duplicate user_id: %s", x.UserID))
+		} else if j, ok := userIDs[key]; ok {
+			rowErrors[i] = append(rowErrors[i], fmt.Sprintf("duplicate user_id: %s (row %d)", x.UserID, j+1))
+		}
+		userIDs[key] = i
+	}
+	return rowErrors
+}
+
+// importUsers は確認済みのユーザーに日時を設定してまとめて保存する
+func (a *UserDataAccessor) importUsers(newUsers []User) error {
+	now := time.Now()
+	for i := range newUsers {
+		x := &newUsers[i]
+		if x.ID == "" {
+			x.ID = ID(createUserID())
+		}
+		x.CreatedAt = now
+		x.UpdatedAt = now
+		x.PasswordChangedAt = now
+		x.Version = 1
+		// prepareImportで確認済みだが、保存する内容を他の書き込みと同じ基準で確認する
+		if err := a.checkWrite(x); err != nil {
+			return err
+		}
+	}
+	if err := a.Store.PutAll(newUsers); err != nil {
+		return a.storeError(err)
+	}
+	for _, x := range newUsers {
+		a.commitUser(x)
+	}
+	return nil
+}
+
+func parseImport(r io.Reader, format TransferFormat) ([]ImportRecord, error) {
+	switch format {
+	case FormatCSV:
+		return parseCSV(r)
+	case FormatJSONLines:
+		return parseJSONLines(r)
+	case FormatLDIF:
+		return parseLDIF(r)
+	}
+	return nil, ErrorUnknownFormat
+}
+
+var csvColumns = []string{"id", "realm", "user_id", "full_name", "email", "roles", "groups", "disabled", "password", "password_hash"}
+
+// parseCSV はヘッダー行の列名で値を読み取る。ロールとグループは;で区切る
+func parseCSV(r io.Reader) ([]ImportRecord, error) {
+	reader := csv.NewReader(r)
+	// 列の数が足りない行も読み取り、足りない値は空として扱う
+	reader.FieldsPerRecord = -1
+	header, err := reader.Read()
+	if err != nil {
+		return nil, err
+	}
+	columns := make(map[string]int)
+	for i, x := range header {
+		columns[strings.TrimSpace(x)] = i
+	}
+	if _, ok := columns["user_id"]; !ok {
+		return nil, errors.New("csv: user_id column is required")
+	}
+	get := func(row []string, name string) string {
+		i, ok := columns[name]
+		if !ok || i >= len(row) {
+			return ""
+		}
+		return strings.TrimSpace(row[i])
+	}
+	records := []ImportRecord{}
+	for {
+		row, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		line, _ := reader.FieldPos(0)
+		x := ImportRecord{
+			Line:         line,
+			ID:           ID(get(row, "id")),
+			Realm:        get(row, "realm"),
+			UserID:       get(row, "user_id"),
+			FullName:     get(row, "full_name"),
+			Email:        get(row, "email"),
+			Password:     get(row, "password"),
+			PasswordHash: PasswordHash(get(row, "password_hash")),
+		}
+		for _, v := range splitList(get(row, "roles")) {
+			x.Roles = append(x.Roles, Role(v))
+		}
+		x.Groups = splitList(get(row, "groups"))
+		if v := get(row, "disabled"); v != "" {
+			x.Disabled, _ = strconv.ParseBool(v)
+		}
+		records = append(records, x)
+	}
+	return records, nil
+}
+
+func splitList(s string) []string {
+	res := []string{}
+	for _, x := range strings.Split(s, ";") {
+		if x = strings.TrimSpace(x); x != "" {
+			res = append(res, x)
+		}
+	}
+	return res
+}
+
+func writeCSV(w io.Writer, records []ImportRecord) error {
+	writer := csv.NewWriter(w)
+	if err := writer.Write(csvColumns); err != nil {
+		return err
+	}
+	for _, x := range records {
+		roles := make([]string, len(x.Roles))
+		for i, v := range x.Roles {
+			roles[i] = string(v)
+		}
+		row := []string{
+			string(x.ID), x.Realm, x.UserID, x.FullName, x.Email,
+			strings.Join(roles, ";"), strings.Join(x.Groups, ";"),
+			strconv.FormatBool(x.Disabled), "", string(x.PasswordHash),
+		}
+		if err := writer.Write(row); err != nil {
+			return err
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+func parseJSONLines(r io.Reader) ([]ImportRecord, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	records := []ImportRecord{}
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := bytes.TrimSpace(scanner.Bytes())
+		if len(text) <= 0 {
+			continue
+		}
+		var x ImportRecord
+		if err := json.Unmarshal(text, &x); err != nil {
+			return nil, fmt.Errorf("jsonl: line %d: %s", line, err)
+		}
+		x.Line = line
+		records = append(records, x)
+	}
+	return records, scanner.Err()
+}
+
+func writeJSONLines(w io.Writer, records []ImportRecord) error {
+	encoder := json.NewEncoder(w)
+	for _, x := range records {
+		if err := encoder.Encode(x); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// LDIFの属性とユーザーの対応
+//
+//	uid          UserID
+//	cn           FullName
+//	mail         Email
+//	goauthID     ID
+//	goauthRealm  Realm
+//	goauthRole   Roles(複数可)
+//	goauthGroup  Groups(複数可)
+//	goauthDisabled Disabled
+//	userPassword {CRYPT}ハッシュ, {MD5}Base64のダイジェスト, またはスキームなしの平文
+const ldifBaseDN = "ou=users,dc=goauth"
+
+func parseLDIF(r io.Reader) ([]ImportRecord, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	records := []ImportRecord{}
+	var entry *ImportRecord
+	var attr string // 継続行を連結中の属性行
+	line, attrLine := 0, 0
+	flush := func() error {
+		if attr != "" {
+			if err := applyLDIFAttr(entry, attr); err != nil {
+				return fmt.Errorf("ldif: line %d: %s", attrLine, err)
+			}
+			attr = ""
+		}
+		return nil
+	}
+	for scanner.Scan() {
+		line++
+		text := strings.TrimRight(scanner.Text(), "\r")
+		if strings.HasPrefix(text, " ") && attr != "" {
+			attr += text[1:]
+			continue
+		}
+		if err := flush(); err != nil {
+			return nil, err
+		}
+		if strings.HasPrefix(text, "#") {
+			continue
+		}
+		if text == "" {
+			if entry != nil {
+				records = append(records, *entry)
+				entry = nil
+			}
+			continue
+		}
+		if entry == nil {
+			if strings.HasPrefix(text, "version:") {
+				continue
+			}
+			entry = &ImportRecord{Line: line}
+		}
+		attr, attrLine = text, line
+	}
+	if err := flush(); err != nil {
+		return nil, err
+	}
+	if entry != nil {
+		records = append(records, *entry)
+	}
+	return records, scanner.Err()
+}
+
+func applyLDIFAttr(x *ImportRecord, attr string) error {
+	i := strings.Index(attr, ":")
+	if i < 0 {
+		return errors.New("missing ':'")
+	}
+	name, value := strings.ToLower(attr[:i]), attr[i+1:]
+	if strings.HasPrefix(value, ":") {
+		b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(value[1:]))
+		if err != nil {
+			return err
+		}
+		value = string(b)
+	} else {
+		value = strings.TrimSpace(value)
+	}
+	switch name {
+	case "uid":
+		x.UserID = value
+	case "cn":
+		x.FullName = value
+	case "mail":
+		x.Email = value
+	case "goauthid":
+		x.ID = ID(value)
+	case "goauthrealm":
+		x.Realm = value
+	case "goauthrole":
+		x.Roles = append(x.Roles, Role(value))
+	case "goauthgroup":
+		x.Groups = append(x.Groups, value)
+	case "goauthdisabled":
+		x.Disabled, _ = strconv.ParseBool(value)
+	case "userpassword":
+		return applyLDIFPassword(x, value)
+	}
+	return nil
+}
+
+func applyLDIFPassword(x *ImportRecord, value string) error {
+	if !strings.HasPrefix(value, "{") {
+		x.Password = value
+		return nil
+	}
+	i := strings.Index(value, "}")
+	if i < 0 {
+		return errors.New("bad userPassword scheme")
+	}
+	scheme, v := strings.ToUpper(value[1:i]), value[i+1:]
+	switch scheme {
+	case "CRYPT":
+		x.PasswordHash = PasswordHash(v)
+	case "MD5":
+		b, err := base64.StdEncoding.DecodeString(v)
+		if err != nil || len(b) != md5.Size {
+			return errors.New("bad {MD5} userPassword")
+		}
+		x.PasswordHash = PasswordHash(hex.EncodeToString(b))
+	default:
+		return fmt.Errorf("unsupported userPassword scheme: %s", scheme)
+	}
+	return nil
+}
+
+func writeLDIF(w io.Writer, records []ImportRecord) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintln(bw, "version: 1")
+	for _, x := range records {
+		fmt.Fprintln(bw)
+		writeLDIFAttr(bw, "dn", "uid="+escapeDN(x.UserID)+","+ldifBaseDN)
+		writeLDIFAttr(bw, "objectClass", "inetOrgPerson")
+		writeLDIFAttr(bw, "uid", x.UserID)
+		cn := x.FullName
+		if cn == "" {
+			cn = x.UserID
+		}
+		writeLDIFAttr(bw, "cn", cn)
+		writeLDIFAttr(bw, "sn", cn)
+		if x.Email != "" {
+			writeLDIFAttr(bw, "mail", x.Email)
+		}
+		writeLDIFAttr(bw, "goauthID", string(x.ID))
+		if x.Realm != "" {
+			writeLDIFAttr(bw, "goauthRealm", x.Realm)
+		}
+		for _, v := range x.Roles {
+			writeLDIFAttr(bw, "goauthRole", string(v))
+		}
+		for _, v := range x.Groups {
+			writeLDIFAttr(bw, "goauthGroup", v)
+		}
+		if x.Disabled {
+			writeLDIFAttr(bw, "goauthDisabled", "true")
+		}
+		if x.PasswordHash != "" {
+			writeLDIFAttr(bw, "userPassword", ldifPassword(x.PasswordHash))
+		}
+	}
+	return bw.Flush()
+}
+
+func ldifPassword(hash PasswordHash) string {
+	if (&md5Hasher{}).Match(hash) {
+		b, _ := hex.DecodeString(strings.ToLower(string(hash)))
+		return "{MD5}" + base64.StdEncoding.EncodeToString(b)
+	}
+	return "{CRYPT}" + string(hash)
+}
+
+// writeLDIFAttr はASCII以外や先頭が特殊な文字の値をBase64で書き出す
+func writeLDIFAttr(w io.Writer, name string, value string) {
+	safe := true
+	for i := 0; i < len(value); i++ {
+		if value[i] < 0x20 || value[i] > 0x7e {
+			safe = false
+			break
+		}
+	}
+	if value != "" && strings.ContainsAny(value[:1], " :<") || strings.HasSuffix(value, " ") {
+		safe = false
+	}
+	if safe {
+		fmt.Fprintf(w, "%s: %s\n", name, value)
+		return
+	}
+	fmt.Fprintf(w, "%s:: %s\n", name, base64.StdEncoding.EncodeToString([]byte(value)))
+}
+
+func escapeDN(value string) string {
+	r := strings.NewReplacer(",", `\,`, "+", `\+`, `"`, `\"`, `\`, `\\`, "<", `\<`, ">", `\>`, ";", `\;`, "=", `\=`)
+	return r.Replace(value)
+}
@@ -0,0 +1,117 @@
+package model
+
+import (
+	"bytes"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestCheckImportedHashRange(t *testing.T) {
+	setupTestSetting(t)
+	if err := initPasswordHasher(); err != nil {
+		t.Fatal(err)
+	}
+	salt := "c2FsdHNhbHRzYWx0c2FsdA"
+	key := "a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2U"
+	valid := []PasswordHash{
+		PasswordHash("$scrypt$n=16384,r=8,p=1$" + salt + "$" + key),
+		PasswordHash("$pbkdf2-sha256$i=310000$" + salt + "$" + key),
+		"$5$rounds=10000$saltsalt$AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA",
+	}
+	for _, hash := range valid {
+		if err := checkImportedHash(hash); err != nil {
+			t.Errorf("checkImportedHash(%s) = %v", hash, err)
+		}
+	}
+	// 検証時に拒否されるハッシュは取り込む前に見つける
+	invalid := []PasswordHash{
+		PasswordHash("$scrypt$n=1073741824,r=8,p=1$" + salt + "$" + key),
+		PasswordHash("$scrypt$n=1000,r=8,p=1$" + salt + "$" + key),
+		PasswordHash("$pbkdf2-sha256$i=2000000000$" + salt + "$" + key),
+		"$5$rounds=999999999$saltsalt$AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA",
+		"$6$rounds=20000000$saltsalt$AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA",
+	}
+	for _, hash := range invalid {
+		if err := checkImportedHash(hash); err == nil {
+			t.Errorf("checkImportedHash(%s) accepted an out of range hash", hash)
+		}
+	}
+}
+
+// startEmptyAccessor はユーザーのいないJSONファイルでUserDataAccessorを起動する
+func startEmptyAccessor(t *testing.T) *UserDataAccessor {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "users.json")
+	writeUserFile(t, path, []User{})
+	return startTestAccessor(t, path)
+}
+
+func TestImportExportRoundTrip(t *testing.T) {
+	for _, format := range []TransferFormat{FormatCSV, FormatJSONLines, FormatLDIF} {
+		t.Run(string(format), func(t *testing.T) {
+			setupTestSetting(t)
+			src := startEmptyAccessor(t)
+			hash := testHash(t)
+			input := `{"user_id":"alice","full_name":"Alice Liddell","email":"alice@example.com","roles":["admin"],"groups":["staff"],"password":"Wonderland-1865"}
+{"user_id":"bob","roles":["user"],"disabled":true,"password_hash":"` + string(hash) + `"}
+`
+			res, err := src.Import(bytes.NewBufferString(input), ImportOptions{Format: FormatJSONLines, AllowPreHashed: true})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res.HasErrors() || res.Imported != 2 {
+				t.Fatalf("import result = %+v", res)
+			}
+			for _, x := range res.Rows {
+				if x.ID == "" {
+					t.Errorf("row %d has no id", x.Line)
+				}
+			}
+
+			var exported bytes.Buffer
+			if err := src.Export(&exported, format, ""); err != nil {
+				t.Fatal(err)
+			}
+			dst := startEmptyAccessor(t)
+			res, err = dst.Import(bytes.NewReader(exported.Bytes()), ImportOptions{Format: format, AllowPreHashed: true})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res.HasErrors() || res.Imported != 2 {
+				t.Fatalf("re-import result = %+v\n%s", res, exported.String())
+			}
+
+			want, err := src.FindAll()
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := dst.FindAll()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != len(want) {
+				t.Fatalf("users = %d, want %d", len(got), len(want))
+			}
+			for _, w := range want {
+				g, err := dst.FindByID(w.ID)
+				if err != nil {
+					t.Fatalf("user %s is not imported: %v", w.UserID, err)
+				}
+				if g.UserID != w.UserID || g.FullName != w.FullName || g.Email != w.Email ||
+					g.Disabled != w.Disabled || g.Password != w.Password ||
+					!reflect.DeepEqual(g.Roles, w.Roles) || !reflect.DeepEqual(g.Groups, w.Groups) {
+					t.Errorf("round trip changed %s:\n got %+v\nwant %+v", w.UserID, g, w)
+				}
+			}
+			// 書き出したハッシュで元のパスワードを確認できる
+			alice, err := dst.FindByUserID("", "alice", FindFirst)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if match, err := VerifyPassword("Wonderland-1865", alice[0].Password); err != nil || !match {
+				t.Errorf("VerifyPassword after round trip = %v, %v", match, err)
+			}
+		})
+	}
+}
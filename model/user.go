@@ -1,14 +1,16 @@
 package model
 
 import (
+	"context"
 	"crypto/md5"
 	"encoding/hex"
-	"encoding/json"
 	"errors"
 	"io"
-	"io/ioutil"
+	"time"
 
+	"github.com/knanao/goauth/server/setting"
 	"github.com/labstack/echo"
+	uuid "github.com/satori/go.uuid"
 )
 
 type (
@@ -22,49 +24,198 @@ const (
 	RoleUser  Role = "user"
 )
 
+// SourceLDAP はディレクトリで認証するユーザーの認証元
+const SourceLDAP = "ldap"
+
 type User struct {
-	ID       ID        `json:"id"`
-	UserID   string    `json:"user_id"`
-	Password StringMD5 `json:"password"`
-	FullName string    `json:"full_name"`
-	Roles    []Role    `json:"roles"`
+	ID ID `json:"id"`
+	// Realm はユーザーが属するレルム。空の場合は既定のレルム
+	Realm  string `json:"realm,omitempty"`
+	UserID string `json:"user_id"` // NormalizeUserIDで正規化した値
+	// DisplayUserID は正規化前に入力されたUserID。UserIDと同じ場合は空
+	DisplayUserID string       `json:"display_user_id,omitempty"`
+	Password      PasswordHash `json:"password"`
+	// Source はユーザーの認証元。空の場合はPasswordで認証する
+	Source string `json:"source,omitempty"`
+	// PasswordHistory は変更前のパスワードハッシュ(新しい順)
+	PasswordHistory []PasswordHash `json:"password_history,omitempty"`
+	FullName        string         `json:"full_name"`
+	Roles           []Role         `json:"roles"`
+	Groups          []string       `json:"groups,omitempty"`
+
+	Email    string `json:"email,omitempty"`
+	Disabled bool   `json:"disabled,omitempty"`
+
+	CreatedAt         time.Time `json:"created_at"`
+	UpdatedAt         time.Time `json:"updated_at"`
+	PasswordChangedAt time.Time `json:"password_changed_at"`
+	// MustChangePassword は次のログインでパスワードの変更を求める
+	MustChangePassword bool      `json:"must_change_password,omitempty"`
+	LastLoginAt        time.Time `json:"last_login_at"`
+	LastLoginIP        string    `json:"last_login_ip,omitempty"`
+
+	FailedLogins int       `json:"failed_logins"` // 連続したログインの失敗回数
+	Lockouts     int       `json:"lockouts"`      // 連続したロックの回数
+	LockedUntil  time.Time `json:"locked_until"`
+
+	// Version は保存のたびに増える。Updateでは読み込んだ時点の値を指定する
+	Version int64 `json:"version"`
 }
 
 func (u *User) Copy(f *User) {
 	u.ID = f.ID
+	u.Realm = f.Realm
 	u.UserID = f.UserID
+	u.DisplayUserID = f.DisplayUserID
 	u.Password = f.Password
+	u.Source = f.Source
+	u.PasswordHistory = nil
+	if f.PasswordHistory != nil {
+		u.PasswordHistory = make([]PasswordHash, len(f.PasswordHistory))
+		copy(u.PasswordHistory, f.PasswordHistory)
+	}
 	u.FullName = f.FullName
 	u.Roles = make([]Role, len(f.Roles))
 	copy(u.Roles, f.Roles)
+	u.Groups = nil
+	if f.Groups != nil {
+		u.Groups = make([]string, len(f.Groups))
+		copy(u.Groups, f.Groups)
+	}
+	u.Email = f.Email
+	u.Disabled = f.Disabled
+	u.CreatedAt = f.CreatedAt
+	u.UpdatedAt = f.UpdatedAt
+	u.PasswordChangedAt = f.PasswordChangedAt
+	u.MustChangePassword = f.MustChangePassword
+	u.LastLoginAt = f.LastLoginAt
+	u.LastLoginIP = f.LastLoginIP
+	u.FailedLogins = f.FailedLogins
+	u.Lockouts = f.Lockouts
+	u.LockedUntil = f.LockedUntil
+	u.Version = f.Version
 }
 
 type UserDataAccessor struct {
-	stopCh    chan struct{}
-	commandCh chan command
+	// Store はユーザーの保存先。nilの場合は設定から作成する
+	Store UserStore
+	// RBAC はロールとグループの検証に使用する。nilの場合は確認しない
+	RBAC *RBAC
+
+	stopCh      chan struct{}
+	doneCh      chan struct{} // mainLoopの終了時に閉じる
+	commandCh   chan command
+	stopWatchCh chan struct{}
+
+	watchers    map[int]chan ChangeEvent // mainLoopからのみ参照する
+	nextWatchID int
+	// skipped は最後の読み込みでIDが空または重複していたために読み込まなかったレコードの問題
+	skipped []ValidationIssue
 }
 
 func (a *UserDataAccessor) Start(echo *echo.Echo) error {
 	e = echo
 	users = make(map[ID]User)
-	if err := a.decodeJSON(); err != nil {
+	initIndexes()
+	if err := initPasswordHasher(); err != nil {
 		return err
 	}
+	if a.Store == nil {
+		store, err := NewUserStore()
+		if err != nil {
+			return err
+		}
+		a.Store = store
+	}
+	records, err := a.Store.Load()
+	if err != nil {
+		return err
+	}
+	records = canonicalizeLoaded(records)
+	report := validateUsers(records, a.RBAC)
+	logReport(&report)
+	if report.HasErrors() && setting.UserStore.Strict {
+		a.finishLoad(false)
+		return &ValidationError{report}
+	}
+	a.finishLoad(true)
+	records = loadableUsers(records)
+	a.skipped = recordIssues(&report)
+	for _, x := range records {
+		putUser(x)
+	}
+	// mainLoopの起動前にコマンドを受け付けられるようにチャネルを作成しておく
+	a.stopCh = make(chan struct{}, 1)
+	a.doneCh = make(chan struct{})
+	a.watchers = make(map[int]chan ChangeEvent)
+	a.commandCh = make(chan command, 1)
 	go a.mainLoop()
+	if store, ok := a.Store.(WatchableStore); ok && setting.UserStore.ReloadInterval > 0 {
+		a.stopWatchCh = make(chan struct{}, 1)
+		go a.watchLoop(store)
+	}
 	return nil
 }
 
+// Stop はmainLoopの終了を待って戻る。以降の呼び出しはErrorStoppedを返す
 func (a *UserDataAccessor) Stop() {
+	if a.doneCh == nil {
+		return
+	}
+	select {
+	case <-a.doneCh:
+		return
+	default:
+	}
+	if a.stopWatchCh != nil {
+		a.stopWatchCh <- struct{}{}
+	}
 	a.stopCh <- struct{}{}
+	<-a.doneCh
 }
 
-func (a *UserDataAccessor) FindAll() ([]User, error) {
+// send はコマンドをmainLoopに渡して応答を待つ
+//
+// ctxが終了した場合やStopの後は待たずにエラーを返す。
+// すでに受け付けられたコマンドはctxが終了しても実行される
+func (a *UserDataAccessor) send(ctx context.Context, cmdType commandType, req []interface{}) response {
+	if a.doneCh == nil {
+		return response{nil, ErrorStopped}
+	}
+	if err := ctx.Err(); err != nil {
+		return response{nil, err}
+	}
 	respCh := make(chan response, 1)
-	defer close(respCh)
+	select {
+	case <-a.doneCh:
+		return response{nil, ErrorStopped}
+	case <-ctx.Done():
+		return response{nil, ctx.Err()}
+	case a.commandCh <- command{cmdType, req, respCh}:
+	}
+	select {
+	case resp := <-respCh:
+		return resp
+	case <-a.doneCh:
+		// 終了の直前に処理された場合は応答が残っている
+		select {
+		case resp := <-respCh:
+			return resp
+		default:
+			return response{nil, ErrorStopped}
+		}
+	case <-ctx.Done():
+		return response{nil, ctx.Err()}
+	}
+}
+
+func (a *UserDataAccessor) FindAll() ([]User, error) {
+	return a.FindAllContext(context.Background())
+}
+
+func (a *UserDataAccessor) FindAllContext(ctx context.Context) ([]User, error) {
 	req := []interface{}{}
-	cmd := command{commandFindAll, req, respCh}
-	a.commandCh <- cmd
-	resp := <-respCh
+	resp := a.send(ctx, commandFindAll, req)
 	var res []User
 	if resp.err != nil {
 		e.Logger.Debugf("User Find Error. [%s]", resp.err)
@@ -77,13 +228,14 @@ func (a *UserDataAccessor) FindAll() ([]User, error) {
 	return res, ErrorOther
 }
 
-func (a *UserDataAccessor) FindByUserID(reqUserID string, option FindOption) ([]User, error) {
-	respCh := make(chan response, 1)
-	defer close(respCh)
-	req := []interface{}{reqUserID, option}
-	cmd := command{commandFindByUserID, req, respCh}
-	a.commandCh <- cmd
-	resp := <-respCh
+// FindByUserID はレルムの中でUserIDが一致するユーザーを探す
+func (a *UserDataAccessor) FindByUserID(realm string, reqUserID string, option FindOption) ([]User, error) {
+	return a.FindByUserIDContext(context.Background(), realm, reqUserID, option)
+}
+
+func (a *UserDataAccessor) FindByUserIDContext(ctx context.Context, realm string, reqUserID string, option FindOption) ([]User, error) {
+	req := []interface{}{realm, reqUserID, option}
+	resp := a.send(ctx, commandFindByUserID, req)
 	var res []User
 	if resp.err != nil {
 		e.Logger.Debugf("User[UserID=%s] Find Error. [%s]", reqUserID, resp.err)
@@ -96,6 +248,130 @@ func (a *UserDataAccessor) FindByUserID(reqUserID string, option FindOption) ([]
 	return res, ErrorOther
 }
 
+// Query は条件に一致するユーザーを並べ替えてページ単位で返す
+func (a *UserDataAccessor) Query(reqQuery UserQuery) (UserQueryResult, error) {
+	return a.QueryContext(context.Background(), reqQuery)
+}
+
+func (a *UserDataAccessor) QueryContext(ctx context.Context, reqQuery UserQuery) (UserQueryResult, error) {
+	req := []interface{}{reqQuery}
+	resp := a.send(ctx, commandQuery, req)
+	var res UserQueryResult
+	if resp.err != nil {
+		e.Logger.Debugf("User Query Error. [%s]", resp.err)
+		return res, resp.err
+	}
+	if res, ok := resp.result[0].(UserQueryResult); ok {
+		return res, nil
+	}
+	e.Logger.Debugf("User Query Error. [%s]", ErrorOther)
+	return res, ErrorOther
+}
+
+func (a *UserDataAccessor) FindByID(reqID ID) (User, error) {
+	return a.FindByIDContext(context.Background(), reqID)
+}
+
+func (a *UserDataAccessor) FindByIDContext(ctx context.Context, reqID ID) (User, error) {
+	req := []interface{}{reqID}
+	resp := a.send(ctx, commandFindByID, req)
+	var res User
+	if resp.err != nil {
+		e.Logger.Debugf("User[ID=%s] Find Error. [%s]", reqID, resp.err)
+		return res, resp.err
+	}
+	if res, ok := resp.result[0].(User); ok {
+		return res, nil
+	}
+	e.Logger.Debugf("User[ID=%s] Find Error. [%s]", reqID, ErrorOther)
+	return res, ErrorOther
+}
+
+func (a *UserDataAccessor) FindByRole(reqRole Role) ([]User, error) {
+	return a.FindByRoleContext(context.Background(), reqRole)
+}
+
+func (a *UserDataAccessor) FindByRoleContext(ctx context.Context, reqRole Role) ([]User, error) {
+	req := []interface{}{reqRole}
+	resp := a.send(ctx, commandFindByRole, req)
+	var res []User
+	if resp.err != nil {
+		e.Logger.Debugf("User[Role=%s] Find Error. [%s]", reqRole, resp.err)
+		return res, resp.err
+	}
+	if res, ok := resp.result[0].([]User); ok {
+		return res, nil
+	}
+	e.Logger.Debugf("User[Role=%s] Find Error. [%s]", reqRole, ErrorOther)
+	return res, ErrorOther
+}
+
+// UpdatePassword はパスワードハッシュを差し替えてファイルに保存する
+func (a *UserDataAccessor) UpdatePassword(id ID, hash PasswordHash) error {
+	return a.UpdatePasswordContext(context.Background(), id, hash)
+}
+
+func (a *UserDataAccessor) UpdatePasswordContext(ctx context.Context, id ID, hash PasswordHash) error {
+	req := []interface{}{id, hash}
+	resp := a.send(ctx, commandUpdatePassword, req)
+	if resp.err != nil {
+		e.Logger.Debugf("User[ID=%s] Update password Error. [%s]", id, resp.err)
+		return resp.err
+	}
+	return nil
+}
+
+// Create はユーザーを追加する。IDが空の場合は新しいIDを割り当てる
+func (a *UserDataAccessor) Create(user User) (User, error) {
+	return a.CreateContext(context.Background(), user)
+}
+
+func (a *UserDataAccessor) CreateContext(ctx context.Context, user User) (User, error) {
+	req := []interface{}{user}
+	resp := a.send(ctx, commandCreate, req)
+	var res User
+	if resp.err != nil {
+		e.Logger.Debugf("User[UserID=%s] Create Error. [%s]", user.UserID, resp.err)
+		return res, resp.err
+	}
+	if res, ok := resp.result[0].(User); ok {
+		return res, nil
+	}
+	e.Logger.Debugf("User[UserID=%s] Create Error. [%s]", user.UserID, ErrorOther)
+	return res, ErrorOther
+}
+
+// Update はuser.Versionが保存されている値と一致する場合のみ更新する
+//
+// 一致しない場合は他の更新が先に行われているためErrorVersionConflictを返す
+func (a *UserDataAccessor) Update(user User) error {
+	return a.UpdateContext(context.Background(), user)
+}
+
+func (a *UserDataAccessor) UpdateContext(ctx context.Context, user User) error {
+	req := []interface{}{user}
+	resp := a.send(ctx, commandUpdate, req)
+	if resp.err != nil {
+		e.Logger.Debugf("User[ID=%s] Update Error. [%s]", user.ID, resp.err)
+		return resp.err
+	}
+	return nil
+}
+
+func (a *UserDataAccessor) Delete(id ID) error {
+	return a.DeleteContext(context.Background(), id)
+}
+
+func (a *UserDataAccessor) DeleteContext(ctx context.Context, id ID) error {
+	req := []interface{}{id}
+	resp := a.send(ctx, commandDelete, req)
+	if resp.err != nil {
+		e.Logger.Debugf("User[ID=%s] Delete Error. [%s]", id, resp.err)
+		return resp.err
+	}
+	return nil
+}
+
 func EncodeStringMD5(str string) StringMD5 {
 	h := md5.New()
 	io.WriteString(h, str)
@@ -114,29 +390,22 @@ const (
 )
 
 var (
-	ErrorNotFound        = errors.New("Not found")
-	ErrorMultipleResults = errors.New("Multiple results")
-	ErrorInvalidCommand  = errors.New("Invalid Command")
-	ErrorBadParameter    = errors.New("Bad Parameter")
-	ErrorNotImplemented  = errors.New("Not Implemented")
-	ErrorOther           = errors.New("Other")
+	ErrorNotFound         = errors.New("Not found")
+	ErrorMultipleResults  = errors.New("Multiple results")
+	ErrorInvalidCommand   = errors.New("Invalid Command")
+	ErrorBadParameter     = errors.New("Bad Parameter")
+	ErrorNotImplemented   = errors.New("Not Implemented")
+	ErrorDuplicateID      = errors.New("Duplicate ID")
+	ErrorDuplicateUserID  = errors.New("Duplicate UserID")
+	ErrorInvalidUserID    = errors.New("Invalid UserID")
+	ErrorVersionConflict  = errors.New("Version Conflict")
+	ErrorStoreConflict    = errors.New("Store Conflict")
+	ErrorStopped          = errors.New("Stopped")
+	ErrorUnknownStoreType = errors.New("Unknown Store Type")
+	ErrorReadOnly         = errors.New("Read Only")
+	ErrorOther            = errors.New("Other")
 )
 
-func (a *UserDataAccessor) decodeJSON() error {
-	bytes, err := ioutil.ReadFile("../data/users.json")
-	if err != nil {
-		return err
-	}
-	var records []User
-	if err := json.Unmarshal(bytes, &records); err != nil {
-		return err
-	}
-	for _, x := range records {
-		users[x.ID] = x
-	}
-	return nil
-}
-
 var e *echo.Echo
 
 var users map[ID]User
@@ -144,9 +413,24 @@ var users map[ID]User
 type commandType int
 
 const (
-	commandFindAll      commandType = iota // 全件検索
-	commandFindByID                        // IDで検索
-	commandFindByUserID                    // UserIDで検索
+	commandFindAll        commandType = iota // 全件検索
+	commandFindByID                          // IDで検索
+	commandFindByUserID                      // UserIDで検索
+	commandUpdatePassword                    // パスワードハッシュの更新
+	commandCreate                            // ユーザーの追加
+	commandUpdate                            // ユーザーの更新
+	commandDelete                            // ユーザーの削除
+	commandFindByRole                        // ロールで検索
+	commandReload                            // ストアからの再読み込み
+	commandQuery                             // 条件を指定して検索
+	commandLoginFailed                       // ログイン失敗の記録
+	commandLoginSucceeded                    // ログイン成功による失敗回数のリセット
+	commandUnlock                            // アカウントのロック解除
+	commandChangePassword                    // パスワードの変更
+	commandImport                            // ユーザーの一括追加
+	commandWatch                             // 変更の購読
+	commandUnwatch                           // 変更の購読の解除
+	commandValidate                          // ユーザーデータの検証
 )
 
 type command struct {
@@ -160,11 +444,25 @@ type response struct {
 	err    error
 }
 
+// findByIDs はIDに一致するユーザーのコピーを返す
+func findByIDs(ids []ID) []User {
+	results := make([]User, 0, len(ids))
+	for _, id := range ids {
+		x := users[id]
+		user := User{}
+		user.Copy(&x)
+		results = append(results, user)
+	}
+	return results
+}
+
+func createUserID() string {
+	u, _ := uuid.NewV4()
+	return u.String()
+}
+
 func (a *UserDataAccessor) mainLoop() {
-	a.stopCh = make(chan struct{}, 1)
-	a.commandCh = make(chan command, 1)
-	defer close(a.commandCh)
-	defer close(a.stopCh)
+	defer close(a.doneCh)
 	e.Logger.Info("model.UserDataAccessor:start")
 loop:
 	for {
@@ -175,47 +473,370 @@ loop:
 				results := []User{}
 				for _, x := range users {
 					user := User{}
-					user.Copy(&x)
+					user.copyPublic(&x)
 					results = append(results, user)
 				}
 				res := []interface{}{results}
 				cmd.responseCh <- response{res, nil}
 				break
 			case commandFindByID:
-				cmd.responseCh <- response{nil, ErrorNotImplemented}
-				break
+				reqID, ok := cmd.req[0].(ID)
+				if !ok {
+					cmd.responseCh <- response{nil, ErrorBadParameter}
+					break
+				}
+				x, ok := users[reqID]
+				if !ok {
+					cmd.responseCh <- response{nil, ErrorNotFound}
+					break
+				}
+				user := User{}
+				user.Copy(&x)
+				res := []interface{}{user}
+				cmd.responseCh <- response{res, nil}
 			case commandFindByUserID:
-				reqUserID, ok := cmd.req[0].(string)
+				reqRealm, ok := cmd.req[0].(string)
 				if !ok {
 					cmd.responseCh <- response{nil, ErrorBadParameter}
 					break
 				}
-				reqOption, ok := cmd.req[1].(FindOption)
+				reqUserID, ok := cmd.req[1].(string)
 				if !ok {
 					cmd.responseCh <- response{nil, ErrorBadParameter}
 					break
 				}
-				results := []User{}
-				for _, x := range users {
-					if x.UserID == reqUserID {
-						user := User{}
-						user.Copy(&x)
-						results = append(results, user)
-						if reqOption == FindFirst {
-							break
-						}
-					}
+				reqOption, ok := cmd.req[2].(FindOption)
+				if !ok {
+					cmd.responseCh <- response{nil, ErrorBadParameter}
+					break
 				}
-				if len(results) <= 0 {
+				ids := userIDIndex.lookup(realmUserKey(reqRealm, reqUserID))
+				if len(ids) <= 0 {
 					cmd.responseCh <- response{nil, ErrorNotFound}
 					break
 				}
-				if reqOption == FindUnique && len(results) > 1 {
+				if reqOption == FindUnique && len(ids) > 1 {
 					cmd.responseCh <- response{nil, ErrorMultipleResults}
 					break
 				}
+				if reqOption == FindFirst {
+					ids = ids[:1]
+				}
+				results := findByIDs(ids)
+				res := []interface{}{results}
+				cmd.responseCh <- response{res, nil}
+			case commandFindByRole:
+				reqRole, ok := cmd.req[0].(Role)
+				if !ok {
+					cmd.responseCh <- response{nil, ErrorBadParameter}
+					break
+				}
+				results := findByIDs(roleIndex.lookup(string(reqRole)))
 				res := []interface{}{results}
 				cmd.responseCh <- response{res, nil}
+			case commandUpdatePassword, commandChangePassword:
+				reqID, ok := cmd.req[0].(ID)
+				if !ok {
+					cmd.responseCh <- response{nil, ErrorBadParameter}
+					break
+				}
+				reqHash, ok := cmd.req[1].(PasswordHash)
+				if !ok {
+					cmd.responseCh <- response{nil, ErrorBadParameter}
+					break
+				}
+				user, ok := users[reqID]
+				if !ok {
+					cmd.responseCh <- response{nil, ErrorNotFound}
+					break
+				}
+				if cmd.cmdType == commandChangePassword {
+					pushPasswordHistory(&user, user.Password)
+				}
+				user.Password = reqHash
+				if cmd.cmdType == commandChangePassword {
+					reqMustChange, ok := cmd.req[2].(bool)
+					if !ok {
+						cmd.responseCh <- response{nil, ErrorBadParameter}
+						break
+					}
+					user.MustChangePassword = reqMustChange
+					user.PasswordChangedAt = time.Now()
+					user.UpdatedAt = user.PasswordChangedAt
+				}
+				user.Version++
+				if err := a.checkWrite(&user); err != nil {
+					cmd.responseCh <- response{nil, err}
+					break
+				}
+				if err := a.Store.Put(user); err != nil {
+					cmd.responseCh <- response{nil, a.storeError(err)}
+					break
+				}
+				a.commitUser(user)
+				e.Logger.Debugf("User[ID=%s] Update password. change[%t]", reqID, cmd.cmdType == commandChangePassword)
+				cmd.responseCh <- response{nil, nil}
+			case commandCreate:
+				reqUser, ok := cmd.req[0].(User)
+				if !ok {
+					cmd.responseCh <- response{nil, ErrorBadParameter}
+					break
+				}
+				user := User{}
+				user.Copy(&reqUser)
+				if err := canonicalizeUserID(&user); err != nil {
+					cmd.responseCh <- response{nil, err}
+					break
+				}
+				if user.ID == "" {
+					user.ID = ID(createUserID())
+				}
+				if _, ok := users[user.ID]; ok {
+					cmd.responseCh <- response{nil, ErrorDuplicateID}
+					break
+				}
+				if userIDIndex.exists(realmUserKey(user.Realm, user.UserID), "") {
+					cmd.responseCh <- response{nil, ErrorDuplicateUserID}
+					break
+				}
+				now := time.Now()
+				user.CreatedAt = now
+				user.UpdatedAt = now
+				if user.Password != "" {
+					user.PasswordChangedAt = now
+				}
+				user.Version = 1
+				if err := a.checkWrite(&user); err != nil {
+					cmd.responseCh <- response{nil, err}
+					break
+				}
+				if err := a.Store.Put(user); err != nil {
+					cmd.responseCh <- response{nil, a.storeError(err)}
+					break
+				}
+				a.commitUser(user)
+				e.Logger.Debugf("User[ID=%s] Create.", user.ID)
+				res := User{}
+				res.Copy(&user)
+				cmd.responseCh <- response{[]interface{}{res}, nil}
+			case commandUpdate:
+				reqUser, ok := cmd.req[0].(User)
+				if !ok {
+					cmd.responseCh <- response{nil, ErrorBadParameter}
+					break
+				}
+				oldUser, ok := users[reqUser.ID]
+				if !ok {
+					cmd.responseCh <- response{nil, ErrorNotFound}
+					break
+				}
+				if reqUser.Version != oldUser.Version {
+					cmd.responseCh <- response{nil, ErrorVersionConflict}
+					break
+				}
+				if userIDIndex.exists(realmUserKey(reqUser.Realm, reqUser.UserID), reqUser.ID) {
+					cmd.responseCh <- response{nil, ErrorDuplicateUserID}
+					break
+				}
+				user := User{}
+				user.Copy(&reqUser)
+				if err := canonicalizeUserID(&user); err != nil {
+					cmd.responseCh <- response{nil, err}
+					break
+				}
+				// 作成日時とログイン記録は更新では変更しない
+				user.CreatedAt = oldUser.CreatedAt
+				user.LastLoginAt = oldUser.LastLoginAt
+				user.LastLoginIP = oldUser.LastLoginIP
+				user.UpdatedAt = time.Now()
+				if user.Password != oldUser.Password {
+					user.PasswordChangedAt = user.UpdatedAt
+				}
+				user.Version++
+				if err := a.checkWrite(&user); err != nil {
+					cmd.responseCh <- response{nil, err}
+					break
+				}
+				if err := a.Store.Put(user); err != nil {
+					cmd.responseCh <- response{nil, a.storeError(err)}
+					break
+				}
+				a.commitUser(user)
+				e.Logger.Debugf("User[ID=%s] Update.", user.ID)
+				cmd.responseCh <- response{nil, nil}
+			case commandDelete:
+				reqID, ok := cmd.req[0].(ID)
+				if !ok {
+					cmd.responseCh <- response{nil, ErrorBadParameter}
+					break
+				}
+				if _, ok := users[reqID]; !ok {
+					cmd.responseCh <- response{nil, ErrorNotFound}
+					break
+				}
+				if err := a.Store.Delete(reqID); err != nil {
+					cmd.responseCh <- response{nil, a.storeError(err)}
+					break
+				}
+				a.commitRemove(reqID)
+				e.Logger.Debugf("User[ID=%s] Delete.", reqID)
+				cmd.responseCh <- response{nil, nil}
+			case commandQuery:
+				reqQuery, ok := cmd.req[0].(UserQuery)
+				if !ok {
+					cmd.responseCh <- response{nil, ErrorBadParameter}
+					break
+				}
+				result, err := queryUsers(reqQuery, a.RBAC)
+				if err != nil {
+					cmd.responseCh <- response{nil, err}
+					break
+				}
+				res := []interface{}{result}
+				cmd.responseCh <- response{res, nil}
+			case commandLoginFailed:
+				reqID, ok := cmd.req[0].(ID)
+				if !ok {
+					cmd.responseCh <- response{nil, ErrorBadParameter}
+					break
+				}
+				reqNow, ok := cmd.req[1].(time.Time)
+				if !ok {
+					cmd.responseCh <- response{nil, ErrorBadParameter}
+					break
+				}
+				user, ok := users[reqID]
+				if !ok {
+					cmd.responseCh <- response{nil, ErrorNotFound}
+					break
+				}
+				recordLoginFailure(&user, reqNow)
+				user.Version++
+				user, err := a.putLoginRecord(user)
+				if err != nil {
+					cmd.responseCh <- response{nil, err}
+					break
+				}
+				a.commitUser(user)
+				res := User{}
+				res.Copy(&user)
+				cmd.responseCh <- response{[]interface{}{res}, nil}
+			case commandLoginSucceeded:
+				reqID, ok := cmd.req[0].(ID)
+				if !ok {
+					cmd.responseCh <- response{nil, ErrorBadParameter}
+					break
+				}
+				reqNow, ok := cmd.req[1].(time.Time)
+				if !ok {
+					cmd.responseCh <- response{nil, ErrorBadParameter}
+					break
+				}
+				reqIP, ok := cmd.req[2].(string)
+				if !ok {
+					cmd.responseCh <- response{nil, ErrorBadParameter}
+					break
+				}
+				user, ok := users[reqID]
+				if !ok {
+					cmd.responseCh <- response{nil, ErrorNotFound}
+					break
+				}
+				resetLockout(&user)
+				user.LastLoginAt = reqNow
+				user.LastLoginIP = reqIP
+				user.Version++
+				user, err := a.putLoginRecord(user)
+				if err != nil {
+					cmd.responseCh <- response{nil, err}
+					break
+				}
+				a.commitUser(user)
+				cmd.responseCh <- response{nil, nil}
+			case commandUnlock:
+				reqID, ok := cmd.req[0].(ID)
+				if !ok {
+					cmd.responseCh <- response{nil, ErrorBadParameter}
+					break
+				}
+				user, ok := users[reqID]
+				if !ok {
+					cmd.responseCh <- response{nil, ErrorNotFound}
+					break
+				}
+				if user.FailedLogins == 0 && user.Lockouts == 0 && user.LockedUntil.IsZero() {
+					cmd.responseCh <- response{nil, nil}
+					break
+				}
+				resetLockout(&user)
+				user.Version++
+				user, err := a.putLoginRecord(user)
+				if err != nil {
+					cmd.responseCh <- response{nil, err}
+					break
+				}
+				a.commitUser(user)
+				cmd.responseCh <- response{nil, nil}
+			case commandImport:
+				reqUsers, ok := cmd.req[0].([]User)
+				if !ok {
+					cmd.responseCh <- response{nil, ErrorBadParameter}
+					break
+				}
+				reqDryRun, ok := cmd.req[1].(bool)
+				if !ok {
+					cmd.responseCh <- response{nil, ErrorBadParameter}
+					break
+				}
+				rowErrors := checkImportDuplicates(reqUsers)
+				ids := []ID{}
+				if !reqDryRun && len(rowErrors) <= 0 {
+					if err := a.importUsers(reqUsers); err != nil {
+						cmd.responseCh <- response{nil, err}
+						break
+					}
+					e.Logger.Infof("User Import. users[%d]", len(reqUsers))
+					for _, x := range reqUsers {
+						ids = append(ids, x.ID)
+					}
+				}
+				res := []interface{}{rowErrors, ids}
+				cmd.responseCh <- response{res, nil}
+			case commandValidate:
+				records := make([]User, 0, len(users))
+				for _, x := range users {
+					records = append(records, x)
+				}
+				report := validateUsers(records, a.RBAC)
+				// 読み込まなかったレコードはメモリ上にないため、読み込み時の結果を加える
+				report.Users += len(a.skipped)
+				report.Issues = append(report.Issues, a.skipped...)
+				sortIssues(report.Issues)
+				cmd.responseCh <- response{[]interface{}{report}, nil}
+			case commandWatch:
+				reqCh, ok := cmd.req[0].(chan ChangeEvent)
+				if !ok {
+					cmd.responseCh <- response{nil, ErrorBadParameter}
+					break
+				}
+				a.nextWatchID++
+				a.watchers[a.nextWatchID] = reqCh
+				res := []interface{}{a.nextWatchID}
+				cmd.responseCh <- response{res, nil}
+			case commandUnwatch:
+				reqID, ok := cmd.req[0].(int)
+				if !ok {
+					cmd.responseCh <- response{nil, ErrorBadParameter}
+					break
+				}
+				if ch, ok := a.watchers[reqID]; ok {
+					close(ch)
+					delete(a.watchers, reqID)
+				}
+				cmd.responseCh <- response{nil, nil}
+			case commandReload:
+				err := a.reloadUsers()
+				cmd.responseCh <- response{nil, err}
 			default:
 				cmd.responseCh <- response{nil, ErrorInvalidCommand}
 			}
@@ -223,5 +844,9 @@ loop:
 			break loop
 		}
 	}
+	a.closeWatchers()
+	if err := a.Store.Close(); err != nil {
+		e.Logger.Debugf("User Store Close Error. [%s]", err)
+	}
 	e.Logger.Info("model.UserDataAccessor:stop")
 }
@@ -0,0 +1,68 @@
+package model
+
+import (
+	"golang.org/x/text/secure/precis"
+)
+
+// NormalizeUserID はUserIDをPRECISのUsernameCaseMappedで正規化する
+//
+// 大文字小文字や互換文字の違いだけのUserIDは同じ値になる
+func NormalizeUserID(userID string) (string, error) {
+	normalized, err := precis.UsernameCaseMapped.String(userID)
+	if err != nil {
+		return "", ErrorInvalidUserID
+	}
+	return normalized, nil
+}
+
+// userIDKey はインデックスで使用するUserIDの比較用の値を返す
+//
+// 正規化できない古いデータはそのままの値で比較する
+func userIDKey(userID string) string {
+	if normalized, err := NormalizeUserID(userID); err == nil {
+		return normalized
+	}
+	return userID
+}
+
+// DisplayID は画面に表示するUserIDを返す
+func (u *User) DisplayID() string {
+	if u.DisplayUserID != "" {
+		return u.DisplayUserID
+	}
+	return u.UserID
+}
+
+// canonicalizeUserID はUserIDを正規化し、入力された形を表示用に残す
+func canonicalizeUserID(u *User) error {
+	normalized, err := NormalizeUserID(u.UserID)
+	if err != nil {
+		return err
+	}
+	if normalized != u.UserID {
+		u.DisplayUserID = u.UserID
+	} else if u.DisplayUserID != "" && userIDKey(u.DisplayUserID) != normalized {
+		// UserIDが変更された場合は古い表示用の値を残さない
+		u.DisplayUserID = ""
+	}
+	u.UserID = normalized
+	return nil
+}
+
+// canonicalizeLoaded は読み込んだユーザーのUserIDを正規化する
+//
+// 正規化すると他のユーザーと重複する場合や正規化できない場合は元の値のまま残す。
+// 重複はvalidateUsersでエラーとして報告する
+func canonicalizeLoaded(records []User) []User {
+	groups := make(map[string][]int)
+	for i, x := range records {
+		key := realmUserKey(x.Realm, x.UserID)
+		groups[key] = append(groups[key], i)
+	}
+	for _, indexes := range groups {
+		if len(indexes) == 1 {
+			canonicalizeUserID(&records[indexes[0]])
+		}
+	}
+	return records
+}
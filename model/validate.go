@@ -0,0 +1,288 @@
+package model
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/knanao/goauth/server/setting"
+)
+
+// Severity は検証で見つかった問題の重要度
+type Severity string
+
+const (
+	SeverityError   Severity = "error"   // ログインや検索が正しく動作しない
+	SeverityWarning Severity = "warning" // 動作はするが設定の誤りと考えられる
+)
+
+// 検証で見つかる問題の種類
+const (
+	IssueEmptyID         = "empty_id"
+	IssueDuplicateID     = "duplicate_id"
+	IssueEmptyUserID     = "empty_user_id"
+	IssueInvalidUserID   = "invalid_user_id"
+	IssueDuplicateUserID = "duplicate_user_id"
+	IssueEmptyPassword   = "empty_password"
+	IssueBadPasswordHash = "bad_password_hash"
+	IssueUnknownRealm    = "unknown_realm"
+	IssueUnknownRole     = "unknown_role"
+	IssueUnknownGroup    = "unknown_group"
+)
+
+// ValidationIssue はユーザー1件について見つかった問題
+type ValidationIssue struct {
+	Severity Severity `json:"severity"`
+	Code     string   `json:"code"`
+	Record   int      `json:"record,omitempty"` // IDで特定できないレコードのストアでの位置(1から)
+	ID       ID       `json:"id,omitempty"`
+	Realm    string   `json:"realm,omitempty"`
+	UserID   string   `json:"user_id,omitempty"`
+	Message  string   `json:"message"`
+}
+
+// ValidationReport はユーザーデータ全体の検証結果
+type ValidationReport struct {
+	CheckedAt time.Time         `json:"checked_at"`
+	Users     int               `json:"users"`
+	Issues    []ValidationIssue `json:"issues"`
+}
+
+// Errors はエラーの問題のみを返す
+func (r *ValidationReport) Errors() []ValidationIssue {
+	return r.filter(SeverityError)
+}
+
+// Warnings は警告の問題のみを返す
+func (r *ValidationReport) Warnings() []ValidationIssue {
+	return r.filter(SeverityWarning)
+}
+
+// HasErrors はエラーがあるかを返す
+func (r *ValidationReport) HasErrors() bool {
+	return len(r.Errors()) > 0
+}
+
+func (r *ValidationReport) filter(severity Severity) []ValidationIssue {
+	issues := []ValidationIssue{}
+	for _, x := range r.Issues {
+		if x.Severity == severity {
+			issues = append(issues, x)
+		}
+	}
+	return issues
+}
+
+// ValidationError は検証でエラーが見つかったために拒否された操作のエラー
+type ValidationError struct {
+	Report ValidationReport
+}
+
+func (err *ValidationError) Error() string {
+	errs := err.Report.Errors()
+	if len(errs) == 1 {
+		return fmt.Sprintf("Validation Failed: %s", errs[0].Message)
+	}
+	return fmt.Sprintf("Validation Failed: %d errors", len(errs))
+}
+
+// Validate はメモリ上のすべてのユーザーを検証した結果を返す
+func (a *UserDataAccessor) Validate() (ValidationReport, error) {
+	return a.ValidateContext(context.Background())
+}
+
+func (a *UserDataAccessor) ValidateContext(ctx context.Context) (ValidationReport, error) {
+	resp := a.send(ctx, commandValidate, nil)
+	if resp.err != nil {
+		e.Logger.Debugf("User Validate Error. [%s]", resp.err)
+		return ValidationReport{}, resp.err
+	}
+	report, ok := resp.result[0].(ValidationReport)
+	if !ok {
+		e.Logger.Debugf("User Validate Error. [%s]", ErrorOther)
+		return ValidationReport{}, ErrorOther
+	}
+	return report, nil
+}
+
+// validateUsers はユーザーごとの検証に加えて、レルム内のUserIDの重複を確認する
+func validateUsers(records []User, rbac *RBAC) ValidationReport {
+	report := ValidationReport{CheckedAt: time.Now(), Users: len(records), Issues: []ValidationIssue{}}
+	groups := make(map[string][]int)
+	byID := make(map[ID][]int)
+	for i, x := range records {
+		report.Issues = append(report.Issues, validateUser(&x, rbac)...)
+		if x.ID == "" {
+			issue := newIssue(&x, SeverityError, IssueEmptyID,
+				fmt.Sprintf("record %d has no id and is not loaded", i+1))
+			issue.Record = i + 1
+			report.Issues = append(report.Issues, issue)
+		} else {
+			byID[x.ID] = append(byID[x.ID], i)
+		}
+		if x.UserID != "" {
+			key := realmUserKey(x.Realm, x.UserID)
+			groups[key] = append(groups[key], i)
+		}
+	}
+	for id, indexes := range byID {
+		if len(indexes) <= 1 {
+			continue
+		}
+		positions := make([]int, 0, len(indexes))
+		for _, i := range indexes {
+			positions = append(positions, i+1)
+		}
+		// 最初のレコードのみを読み込む
+		for _, i := range indexes[1:] {
+			issue := newIssue(&records[i], SeverityError, IssueDuplicateID,
+				fmt.Sprintf("id %s is shared by records %v and is not loaded", id, positions))
+			issue.Record = i + 1
+			report.Issues = append(report.Issues, issue)
+		}
+	}
+	for _, indexes := range groups {
+		if len(indexes) <= 1 {
+			continue
+		}
+		ids := make([]ID, 0, len(indexes))
+		for _, i := range indexes {
+			ids = append(ids, records[i].ID)
+		}
+		for _, i := range indexes {
+			x := &records[i]
+			report.Issues = append(report.Issues, newIssue(x, SeverityError, IssueDuplicateUserID,
+				fmt.Sprintf("user_id %s is shared by %s", userIDKey(x.UserID), ids)))
+		}
+	}
+	sortIssues(report.Issues)
+	return report
+}
+
+// sortIssues はエラーを先に、ID順に並べる
+func sortIssues(issues []ValidationIssue) {
+	sort.SliceStable(issues, func(i, j int) bool {
+		if issues[i].Severity != issues[j].Severity {
+			return issues[i].Severity == SeverityError
+		}
+		if issues[i].ID != issues[j].ID {
+			return issues[i].ID < issues[j].ID
+		}
+		return issues[i].Record < issues[j].Record
+	})
+}
+
+// recordIssues はIDで特定できないために読み込まなかったレコードの問題を返す
+func recordIssues(report *ValidationReport) []ValidationIssue {
+	issues := []ValidationIssue{}
+	for _, x := range report.Issues {
+		if x.Code == IssueEmptyID || x.Code == IssueDuplicateID {
+			issues = append(issues, x)
+		}
+	}
+	return issues
+}
+
+// loadableUsers はIDが空のユーザーと、IDが重複した2件目以降のユーザーを除く
+//
+// 除いたユーザーはvalidateUsersで報告する
+func loadableUsers(records []User) []User {
+	results := make([]User, 0, len(records))
+	seen := make(map[ID]bool)
+	for _, x := range records {
+		if x.ID == "" || seen[x.ID] {
+			continue
+		}
+		seen[x.ID] = true
+		results = append(results, x)
+	}
+	return results
+}
+
+// validateUser はユーザー1件を検証する。rbacがnilの場合はロールとグループを確認しない
+func validateUser(u *User, rbac *RBAC) []ValidationIssue {
+	issues := []ValidationIssue{}
+	if u.UserID == "" {
+		issues = append(issues, newIssue(u, SeverityError, IssueEmptyUserID, "user_id is empty"))
+	} else if _, err := NormalizeUserID(u.UserID); err != nil {
+		issues = append(issues, newIssue(u, SeverityError, IssueInvalidUserID,
+			fmt.Sprintf("user_id %q cannot be normalized", u.UserID)))
+	}
+	switch {
+	case u.Password == "" && u.Source != "":
+		// 外部で認証するユーザーはパスワードを持たない
+	case u.Password == "":
+		// 無効化されたユーザーはログインできないため警告にとどめる
+		severity := SeverityError
+		if u.Disabled {
+			severity = SeverityWarning
+		}
+		issues = append(issues, newIssue(u, severity, IssueEmptyPassword, "password is empty"))
+	default:
+		if err := checkHashFormat(u.Password); err != nil {
+			issues = append(issues, newIssue(u, SeverityError, IssueBadPasswordHash, err.Error()))
+		}
+	}
+	if _, ok := setting.LookupRealm(u.Realm); !ok {
+		issues = append(issues, newIssue(u, SeverityError, IssueUnknownRealm,
+			fmt.Sprintf("unknown realm: %s", u.Realm)))
+	}
+	if rbac != nil {
+		for _, role := range u.Roles {
+			if !rbac.HasRoleDefinition(role) {
+				issues = append(issues, newIssue(u, SeverityWarning, IssueUnknownRole,
+					fmt.Sprintf("unknown role: %s", role)))
+			}
+		}
+		for _, group := range u.Groups {
+			if !rbac.HasGroup(group) {
+				issues = append(issues, newIssue(u, SeverityWarning, IssueUnknownGroup,
+					fmt.Sprintf("unknown group: %s", group)))
+			}
+		}
+	}
+	return issues
+}
+
+func newIssue(u *User, severity Severity, code string, msg string) ValidationIssue {
+	return ValidationIssue{
+		Severity: severity,
+		Code:     code,
+		ID:       u.ID,
+		Realm:    u.RealmName(),
+		UserID:   u.DisplayID(),
+		Message:  msg,
+	}
+}
+
+// checkWrite は保存する前のユーザーを検証する
+//
+// エラーがある場合は保存を拒否し、警告はログに出力する。
+// 作成、更新、パスワードの変更、取り込みで使用する。ログインの記録とロックの解除
+// (putLoginRecord)は検証の対象外の項目のみを変更し、厳格でないモードで読み込んだ
+// エラーのあるユーザーでもロックアウトを記録する必要があるため検証しない。
+// 削除は保存する内容がないため検証しない
+func (a *UserDataAccessor) checkWrite(u *User) error {
+	report := ValidationReport{CheckedAt: time.Now(), Users: 1, Issues: validateUser(u, a.RBAC)}
+	for _, x := range report.Warnings() {
+		e.Logger.Warnf("User[ID=%s] Validation warning. code[%s] %s", x.ID, x.Code, x.Message)
+	}
+	if report.HasErrors() {
+		return &ValidationError{report}
+	}
+	return nil
+}
+
+// logReport は検証結果をログに出力する
+func logReport(report *ValidationReport) {
+	for _, x := range report.Issues {
+		if x.Severity == SeverityError {
+			e.Logger.Errorf("User[ID=%s] Validation error. code[%s] %s", x.ID, x.Code, x.Message)
+		} else {
+			e.Logger.Warnf("User[ID=%s] Validation warning. code[%s] %s", x.ID, x.Code, x.Message)
+		}
+	}
+	e.Logger.Infof("User data validated. users[%d] errors[%d] warnings[%d]",
+		report.Users, len(report.Errors()), len(report.Warnings()))
+}
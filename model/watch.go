@@ -0,0 +1,104 @@
+package model
+
+import (
+	"context"
+)
+
+// ChangeType はユーザーの変更の種類
+type ChangeType string
+
+const (
+	ChangeCreated ChangeType = "created"
+	ChangeUpdated ChangeType = "updated"
+	ChangeDeleted ChangeType = "deleted"
+)
+
+// ChangeEvent は保存が完了したユーザーの変更
+type ChangeEvent struct {
+	Type ChangeType
+	ID   ID
+	// User は変更後のユーザー。削除の場合は削除前のユーザー
+	User User
+	// Previous は変更前のユーザー。作成の場合はnil
+	Previous *User
+}
+
+// Watch はユーザーの変更を受け取るチャネルを登録する
+//
+// mainLoopを止めないよう、バッファが一杯になった購読者には送信せずに
+// チャネルを閉じて登録を解除する。そのときの変更とそれ以降の変更は届かないため、
+// チャネルが閉じられた購読者は再登録した後にFindAllなどで現在のデータを読み直して
+// 取りこぼした変更を補う必要がある。停止による場合は再登録がErrorStoppedを返す。
+// 返された関数で登録を解除する
+func (a *UserDataAccessor) Watch(bufferSize int) (<-chan ChangeEvent, func(), error) {
+	return a.WatchContext(context.Background(), bufferSize)
+}
+
+func (a *UserDataAccessor) WatchContext(ctx context.Context, bufferSize int) (<-chan ChangeEvent, func(), error) {
+	if bufferSize < 1 {
+		bufferSize = 1
+	}
+	ch := make(chan ChangeEvent, bufferSize)
+	req := []interface{}{ch}
+	resp := a.send(ctx, commandWatch, req)
+	if resp.err != nil {
+		e.Logger.Debugf("User Watch Error. [%s]", resp.err)
+		return nil, nil, resp.err
+	}
+	watchID, ok := resp.result[0].(int)
+	if !ok {
+		e.Logger.Debugf("User Watch Error. [%s]", ErrorOther)
+		return nil, nil, ErrorOther
+	}
+	cancel := func() {
+		// 停止後はmainLoopがすでにチャネルを閉じている
+		a.send(context.Background(), commandUnwatch, []interface{}{watchID})
+	}
+	return ch, cancel, nil
+}
+
+// notify は購読者に変更を送る。mainLoopからのみ呼び出す
+func (a *UserDataAccessor) notify(event ChangeEvent) {
+	for id, ch := range a.watchers {
+		select {
+		case ch <- event:
+		default:
+			e.Logger.Warnf("User Watcher[%d] is too slow. Unsubscribed.", id)
+			close(ch)
+			delete(a.watchers, id)
+		}
+	}
+}
+
+// commitUser は保存済みのユーザーをメモリに反映して購読者に通知する
+func (a *UserDataAccessor) commitUser(u User) {
+	event := ChangeEvent{Type: ChangeCreated, ID: u.ID}
+	if old, ok := users[u.ID]; ok {
+		event.Type = ChangeUpdated
+		event.Previous = &User{}
+		event.Previous.copyPublic(&old)
+	}
+	putUser(u)
+	event.User.copyPublic(&u)
+	a.notify(event)
+}
+
+// commitRemove は削除済みのユーザーをメモリから除いて購読者に通知する
+func (a *UserDataAccessor) commitRemove(id ID) {
+	old, ok := users[id]
+	removeUser(id)
+	if !ok {
+		return
+	}
+	event := ChangeEvent{Type: ChangeDeleted, ID: id, Previous: &User{}}
+	event.User.copyPublic(&old)
+	event.Previous.copyPublic(&old)
+	a.notify(event)
+}
+
+func (a *UserDataAccessor) closeWatchers() {
+	for id, ch := range a.watchers {
+		close(ch)
+		delete(a.watchers, id)
+	}
+}
@@ -0,0 +1,130 @@
+package audit
+
+import (
+	"errors"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+var (
+	ErrorBadParameter   = errors.New("Bad Parameter")
+	ErrorInvalidCommand = errors.New("Invalid Command")
+	ErrorBrokenChain    = errors.New("Broken Chain")
+	ErrorStopped        = errors.New("Stopped")
+	ErrorOther          = errors.New("Other")
+)
+
+type Action string
+
+const (
+	ActionLogin          Action = "login"
+	ActionLoginFailed    Action = "login_failed"
+	ActionAccountLocked  Action = "account_locked"
+	ActionLogout         Action = "logout"
+	ActionAccessDenied   Action = "access_denied"
+	ActionPasswordChange Action = "password_change"
+	ActionPasswordReset  Action = "password_reset"
+	ActionPasswordRehash Action = "password_rehash"
+	ActionUserCreate     Action = "user_create"
+	ActionUserUpdate     Action = "user_update"
+	ActionUserDelete     Action = "user_delete"
+	ActionUserUnlock     Action = "user_unlock"
+	ActionUserImport     Action = "user_import"
+)
+
+type Outcome string
+
+const (
+	OutcomeSuccess Outcome = "success"
+	OutcomeFailure Outcome = "failure"
+)
+
+// Event は監査ログの1件
+//
+// Hash はPrevHashを含むこのイベントの内容から計算するため、
+// 途中のイベントを書き換えたり削除したりすると以降の連鎖が一致しなくなる
+type Event struct {
+	Seq         int64     `json:"seq"`
+	Time        time.Time `json:"time"`
+	Realm       string    `json:"realm,omitempty"`
+	Actor       string    `json:"actor"`
+	Target      string    `json:"target,omitempty"`
+	Action      Action    `json:"action"`
+	IP          string    `json:"ip,omitempty"`
+	UserAgent   string    `json:"user_agent,omitempty"`
+	Outcome     Outcome   `json:"outcome"`
+	Reason      string    `json:"reason,omitempty"`
+	SessionHash string    `json:"session_hash,omitempty"`
+	PrevHash    string    `json:"prev_hash"`
+	Hash        string    `json:"hash"`
+}
+
+type Logger struct {
+	stopCh    chan struct{}
+	doneCh    chan struct{} // mainLoopの終了時に閉じる
+	commandCh chan command
+}
+
+func (l *Logger) Start(echo *echo.Echo) error {
+	e = echo
+	state, err := openLog()
+	if err != nil {
+		return err
+	}
+	l.stopCh = make(chan struct{}, 1)
+	l.doneCh = make(chan struct{})
+	l.commandCh = make(chan command, 1)
+	go l.mainLoop(state)
+	return nil
+}
+
+// Stop は書き込み中のイベントの完了を待って戻る
+func (l *Logger) Stop() {
+	if l.doneCh == nil {
+		return
+	}
+	select {
+	case <-l.doneCh:
+		return
+	default:
+	}
+	l.stopCh <- struct{}{}
+	<-l.doneCh
+}
+
+// Record はイベントに連番とハッシュを付けて追記する
+//
+// リクエストが中断されても記録は残すため、コンテキストは受け取らない
+func (l *Logger) Record(event Event) error {
+	req := []interface{}{event}
+	resp := l.send(commandRecord, req)
+	if resp.err != nil {
+		e.Logger.Errorf("Audit Record Error. action[%s] [%s]", event.Action, resp.err)
+		return resp.err
+	}
+	return nil
+}
+
+func (l *Logger) send(cmdType commandType, req []interface{}) response {
+	if l.doneCh == nil {
+		return response{nil, ErrorStopped}
+	}
+	respCh := make(chan response, 1)
+	select {
+	case <-l.doneCh:
+		return response{nil, ErrorStopped}
+	case l.commandCh <- command{cmdType, req, respCh}:
+	}
+	select {
+	case resp := <-respCh:
+		return resp
+	case <-l.doneCh:
+		select {
+		case resp := <-respCh:
+			return resp
+		default:
+			return response{nil, ErrorStopped}
+		}
+	}
+}
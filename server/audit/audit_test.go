@@ -0,0 +1,162 @@
+package audit
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/knanao/goauth/server/setting"
+	"github.com/labstack/echo"
+)
+
+// setupAuditLog は一時ディレクトリのログを使用する設定にする
+func setupAuditLog(t *testing.T) string {
+	t.Helper()
+	saved := setting.Audit
+	t.Cleanup(func() { setting.Audit = saved })
+	setting.Audit.Path = filepath.Join(t.TempDir(), "audit.log")
+	setting.Audit.Key = "audit-key"
+	return setting.Audit.Path
+}
+
+func startLogger(t *testing.T) (*Logger, error) {
+	t.Helper()
+	server := echo.New()
+	server.Logger.SetOutput(ioutil.Discard)
+	l := &Logger{}
+	if err := l.Start(server); err != nil {
+		return nil, err
+	}
+	t.Cleanup(l.Stop)
+	return l, nil
+}
+
+func TestOpenLogMissingWithHead(t *testing.T) {
+	path := setupAuditLog(t)
+	l, err := startLogger(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Record(Event{Actor: "alice", Action: ActionLogin, Outcome: OutcomeSuccess}); err != nil {
+		t.Fatal(err)
+	}
+	l.Stop()
+
+	// ログだけを削除した場合は起動しない
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := startLogger(t); err == nil {
+		t.Error("started with a deleted log and a remaining head record")
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("log was recreated: %v", err)
+	}
+}
+
+// writeEvents はn件のイベントを記録したログを作成し、その行を返す
+func writeEvents(t *testing.T, n int) []string {
+	t.Helper()
+	l, err := startLogger(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < n; i++ {
+		if err := l.Record(Event{Actor: "alice", Action: ActionLogin, Outcome: OutcomeSuccess}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	l.Stop()
+	data, err := ioutil.ReadFile(setting.Audit.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+}
+
+func writeLines(t *testing.T, path string, lines []string) {
+	t.Helper()
+	data := ""
+	if len(lines) > 0 {
+		data = strings.Join(lines, "\n") + "\n"
+	}
+	if err := ioutil.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVerifyDetectsTampering(t *testing.T) {
+	tests := []struct {
+		name   string
+		tamper func(lines []string) []string
+		line   int
+	}{
+		{"edited event", func(lines []string) []string {
+			lines[1] = strings.Replace(lines[1], `"actor":"alice"`, `"actor":"mallory"`, 1)
+			return lines
+		}, 2},
+		{"deleted event", func(lines []string) []string {
+			return append(lines[:1], lines[2:]...)
+		}, 2},
+		{"swapped events", func(lines []string) []string {
+			lines[1], lines[2] = lines[2], lines[1]
+			return lines
+		}, 2},
+		{"malformed event", func(lines []string) []string {
+			lines[2] = "{"
+			return lines
+		}, 3},
+		{"truncated log", func(lines []string) []string {
+			return lines[:2]
+		}, 3},
+	}
+	for _, x := range tests {
+		t.Run(x.name, func(t *testing.T) {
+			path := setupAuditLog(t)
+			lines := writeEvents(t, 4)
+			if result, err := Verify(path, []byte(setting.Audit.Key)); err != nil || !result.OK() || result.Events != 4 {
+				t.Fatalf("untampered log: %+v, %v", result, err)
+			}
+			writeLines(t, path, x.tamper(lines))
+			result, err := Verify(path, []byte(setting.Audit.Key))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.OK() || result.BrokenLine != x.line {
+				t.Errorf("result = %+v, want broken at line %d", result, x.line)
+			}
+			// 改ざんされたログには追記しない
+			if _, err := startLogger(t); err == nil {
+				t.Error("started with a tampered log")
+			}
+		})
+	}
+}
+
+func TestVerifyRequiresKey(t *testing.T) {
+	path := setupAuditLog(t)
+	writeEvents(t, 2)
+	// 鍵を知らなければハッシュを計算し直して改ざんを隠せない
+	result, err := Verify(path, []byte("other-key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.OK() || result.BrokenLine != 1 {
+		t.Errorf("result with a wrong key = %+v, want broken at line 1", result)
+	}
+}
+
+func TestLoggerContinuesChain(t *testing.T) {
+	path := setupAuditLog(t)
+	writeEvents(t, 2)
+	writeEvents(t, 1)
+	result, err := Verify(path, []byte(setting.Audit.Key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.OK() || result.Events != 3 || result.LastSeq != 3 {
+		t.Errorf("result after restart = %+v", result)
+	}
+}
@@ -0,0 +1,192 @@
+package audit
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/knanao/goauth/server/setting"
+	"github.com/labstack/echo"
+)
+
+var e *echo.Echo
+
+type commandType int
+
+const (
+	commandRecord commandType = iota // イベントの追記
+)
+
+type command struct {
+	cmdType    commandType
+	req        []interface{}
+	responseCh chan response
+}
+
+type response struct {
+	result []interface{}
+	err    error
+}
+
+// logState は追記先のファイルと最後に書き込んだイベント
+type logState struct {
+	file     *os.File
+	lastSeq  int64
+	lastHash string
+}
+
+func (l *Logger) mainLoop(state *logState) {
+	defer close(l.doneCh)
+	e.Logger.Info("audit.Logger:start")
+loop:
+	for {
+		select {
+		case cmd := <-l.commandCh:
+			switch cmd.cmdType {
+			case commandRecord:
+				reqEvent, ok := cmd.req[0].(Event)
+				if !ok {
+					cmd.responseCh <- response{nil, ErrorBadParameter}
+					break
+				}
+				err := state.append(reqEvent)
+				cmd.responseCh <- response{nil, err}
+			default:
+				cmd.responseCh <- response{nil, ErrorInvalidCommand}
+			}
+		case <-l.stopCh:
+			break loop
+		}
+	}
+	state.file.Close()
+	e.Logger.Info("audit.Logger:stop")
+}
+
+// openLog は既存のログを検証して最後のイベントから連鎖を続ける
+func openLog() (*logState, error) {
+	result, err := Verify(setting.Audit.Path, []byte(setting.Audit.Key))
+	if os.IsNotExist(err) {
+		// 末尾の記録だけが残っている場合はログが削除されている
+		if _, headErr := os.Stat(headPath(setting.Audit.Path)); !os.IsNotExist(headErr) {
+			return nil, fmt.Errorf("audit log %s is missing but its head record exists", setting.Audit.Path)
+		}
+	} else if err != nil {
+		return nil, err
+	}
+	if err == nil && !result.OK() {
+		return nil, fmt.Errorf("audit log %s is broken at line %d: %s",
+			setting.Audit.Path, result.BrokenLine, result.Reason)
+	}
+	f, err := os.OpenFile(setting.Audit.Path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	state := &logState{file: f}
+	if result != nil {
+		state.lastSeq = result.LastSeq
+		state.lastHash = result.LastHash
+	}
+	return state, nil
+}
+
+func (s *logState) append(event Event) error {
+	event.Seq = s.lastSeq + 1
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	event.Time = event.Time.UTC()
+	event.PrevHash = s.lastHash
+	sum, err := eventHash(&event, []byte(setting.Audit.Key))
+	if err != nil {
+		return err
+	}
+	event.Hash = sum
+	line, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	if _, err := s.file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	if err := s.file.Sync(); err != nil {
+		return err
+	}
+	s.lastSeq = event.Seq
+	s.lastHash = event.Hash
+	// 末尾の切り詰めを検出できるように最後のイベントを別のファイルに記録する
+	return writeHead(setting.Audit.Path, s.lastSeq, s.lastHash)
+}
+
+// eventHash はHashを除いたイベントのハッシュを計算する。鍵が設定されている場合はHMACを使用する
+func eventHash(event *Event, key []byte) (string, error) {
+	x := *event
+	x.Hash = ""
+	b, err := json.Marshal(x)
+	if err != nil {
+		return "", err
+	}
+	var h hash.Hash
+	if len(key) > 0 {
+		h = hmac.New(sha256.New, key)
+	} else {
+		h = sha256.New()
+	}
+	h.Write(b)
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func headPath(path string) string {
+	return path + ".head"
+}
+
+func writeHead(path string, seq int64, sum string) error {
+	head := headPath(path)
+	tmp, err := ioutil.TempFile(filepath.Dir(head), "."+filepath.Base(head)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := fmt.Fprintf(tmp, "%d %s\n", seq, sum); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), head)
+}
+
+func readHead(path string) (int64, string, error) {
+	f, err := os.Open(headPath(path))
+	if err != nil {
+		return 0, "", err
+	}
+	defer f.Close()
+	line, err := bufio.NewReader(f).ReadString('\n')
+	if err != nil {
+		return 0, "", err
+	}
+	fields := strings.Fields(line)
+	if len(fields) != 2 {
+		return 0, "", ErrorBrokenChain
+	}
+	seq, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		return 0, "", ErrorBrokenChain
+	}
+	return seq, fields[1], nil
+}
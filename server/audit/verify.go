@@ -0,0 +1,82 @@
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+)
+
+// VerifyResult は監査ログの検証結果
+type VerifyResult struct {
+	Events     int64
+	LastSeq    int64
+	LastHash   string
+	BrokenLine int    // 最初に不整合を検出した行(0の場合は不整合なし)
+	Reason     string // 不整合の内容
+}
+
+func (r *VerifyResult) OK() bool {
+	return r.BrokenLine == 0
+}
+
+// Verify は各イベントのハッシュと連鎖を確認し、
+// 最後のイベントが別に記録した末尾と一致するかで切り詰めを検出する
+func Verify(path string, key []byte) (*VerifyResult, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	res := &VerifyResult{}
+	broken := func(line int, reason string) (*VerifyResult, error) {
+		res.BrokenLine = line
+		res.Reason = reason
+		return res, nil
+	}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	line := 0
+	lastPrev := ""
+	for scanner.Scan() {
+		line++
+		var event Event
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			return broken(line, "malformed entry")
+		}
+		if event.Seq != res.LastSeq+1 {
+			return broken(line, "sequence gap")
+		}
+		if event.PrevHash != res.LastHash {
+			return broken(line, "previous hash mismatch")
+		}
+		sum, err := eventHash(&event, key)
+		if err != nil {
+			return nil, err
+		}
+		if sum != event.Hash {
+			return broken(line, "hash mismatch")
+		}
+		res.Events++
+		lastPrev = event.PrevHash
+		res.LastSeq = event.Seq
+		res.LastHash = event.Hash
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	seq, sum, err := readHead(path)
+	if os.IsNotExist(err) && res.Events == 0 {
+		return res, nil
+	}
+	if err != nil {
+		return broken(line+1, "missing head record")
+	}
+	if seq == res.LastSeq-1 && sum == lastPrev {
+		// 追記の後、末尾を記録する前に停止した場合
+		return res, nil
+	}
+	if seq != res.LastSeq || sum != res.LastHash {
+		return broken(line+1, "log is truncated or head record does not match")
+	}
+	return res, nil
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+
+	"github.com/knanao/goauth/server/audit"
+	"github.com/knanao/goauth/server/session"
+	"github.com/labstack/echo"
+)
+
+// recordAudit はリクエストの情報を補って監査ログに記録する
+//
+// Actorが空の場合はセッションのユーザーを使用する
+func recordAudit(c echo.Context, event audit.Event) {
+	event.Realm = currentRealm(c).Name
+	event.IP = c.RealIP()
+	event.UserAgent = c.Request().UserAgent()
+	sessionID, err := session.ReadCookie(c)
+	if event.SessionHash == "" && err == nil {
+		event.SessionHash = hashSessionID(sessionID)
+	}
+	if event.Actor == "" {
+		event.Actor = "anonymous"
+		if err == nil {
+			if store, err := sessionManager.LoadStoreContext(c.Request().Context(), sessionID); err == nil && store.Data["user_id"] != "" {
+				event.Actor = store.Data["user_id"]
+			}
+		}
+	}
+	if err := auditLog.Record(event); err != nil {
+		c.Echo().Logger.Errorf("Audit Error. action[%s] actor[%s] [%s]", event.Action, event.Actor, err)
+	}
+}
+
+// hashSessionID はセッションIDそのものを残さないようにハッシュ化する
+func hashSessionID(sessionID session.ID) string {
+	sum := sha256.Sum256([]byte(sessionID))
+	return hex.EncodeToString(sum[:16])
+}
+
+func auditOutcome(err error) (audit.Outcome, string) {
+	if err != nil {
+		return audit.OutcomeFailure, err.Error()
+	}
+	return audit.OutcomeSuccess, ""
+}
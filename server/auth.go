@@ -1,52 +1,214 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"net/http"
+	"time"
 
+	"github.com/knanao/goauth/server/audit"
 	"github.com/knanao/goauth/server/model"
 	"github.com/knanao/goauth/server/session"
 	"github.com/labstack/echo"
 )
 
 var (
-	ErrorInvalidUserID   = errors.New("Invalid UserID")
-	ErrorInvalidPassword = errors.New("Invalid Password")
-	ErrorNotLoggedIn     = errors.New("Not Logged In")
+	ErrorInvalidUserID    = errors.New("Invalid UserID")
+	ErrorInvalidPassword  = errors.New("Invalid Password")
+	ErrorNotLoggedIn      = errors.New("Not Logged In")
+	ErrorAccountLocked    = errors.New("Account Locked")
+	ErrorAccountDisabled  = errors.New("Account Disabled")
+	ErrorPasswordMismatch = errors.New("Password Mismatch")
+	// ErrorExternalUser はパスワードを外部で管理するユーザーに対するパスワードの操作で返す
+	ErrorExternalUser = errors.New("External User")
+	// ErrorPasswordChangeRequired はパスワードの変更のみを許可されたセッションで返す
+	ErrorPasswordChangeRequired = errors.New("Password Change Required")
 )
 
 func UserLogin(c echo.Context, userID string, password string) error {
-	users, err := userDA.FindByUserID(userID, model.FindFirst)
+	sessionID, err := userLogin(c, userID, password)
+	event := audit.Event{Actor: userID, Target: userID, Action: audit.ActionLogin}
+	event.Outcome, event.Reason = auditOutcome(err)
 	if err != nil {
-		return err
+		event.Action = audit.ActionLoginFailed
+	} else {
+		event.SessionHash = hashSessionID(sessionID)
+	}
+	recordAudit(c, event)
+	return err
+}
+
+// userLogin はユーザーを認証してセッションを作成する
+//
+// LDAPが有効なレルムでは、ローカルのパスワードを持つユーザー以外はディレクトリで認証する。
+// ローカルのユーザーはディレクトリに接続できない場合の緊急用のアカウントとして使用できる
+func userLogin(c echo.Context, userID string, password string) (session.ID, error) {
+	users, err := userDA.FindByUserIDContext(c.Request().Context(), currentRealm(c).Name, userID, model.FindFirst)
+	if err != nil && err != model.ErrorNotFound {
+		return "", err
+	}
+	if ldapEnabled(c) && (err == model.ErrorNotFound || users[0].Source == model.SourceLDAP) {
+		var local *model.User
+		if err == nil {
+			local = &users[0]
+		}
+		user, err := ldapLogin(c, userID, password, local)
+		if err != nil {
+			return "", err
+		}
+		return startSession(c, &user)
+	}
+	if err != nil {
+		return "", err
 	}
 	user := &users[0]
-	encodePassword := model.EncodeStringMD5(password)
-	if user.Password != encodePassword {
-		return ErrorInvalidPassword
+	if user.Source != "" {
+		return "", ErrorExternalUser
+	}
+	if user.Disabled {
+		return "", ErrorAccountDisabled
+	}
+	if user.IsLocked(time.Now()) {
+		return "", ErrorAccountLocked
 	}
-	sessionID, err := sessionManager.Create()
+	match, err := model.VerifyPassword(password, user.Password)
 	if err != nil {
-		return err
+		return "", err
+	}
+	if !match {
+		recordLoginFailure(c, userID, user.ID)
+		return "", ErrorInvalidPassword
+	}
+	if err := userDA.LoginSucceededContext(c.Request().Context(), user.ID, c.RealIP()); err != nil {
+		c.Echo().Logger.Debugf("User[%s] Record login Error. [%s]", userID, err)
+	}
+	if model.PasswordNeedsRehash(user.Password) && !userDA.ReadOnly() {
+		// 旧形式のハッシュは設定されたアルゴリズムで保存し直す
+		hash, err := model.HashPassword(password)
+		if err == nil {
+			err = userDA.UpdatePasswordContext(c.Request().Context(), user.ID, hash)
+		}
+		if err != nil {
+			c.Echo().Logger.Debugf("User[%s] Rehash password Error. [%s]", userID, err)
+		}
+		event := audit.Event{Actor: userID, Target: userID, Action: audit.ActionPasswordRehash}
+		event.Outcome, event.Reason = auditOutcome(err)
+		recordAudit(c, event)
+	}
+	return startSession(c, user)
+}
+
+// recordLoginFailure はパスワードの誤りを記録し、ロックされた場合は監査ログに残す
+func recordLoginFailure(c echo.Context, userID string, id model.ID) {
+	failed, err := userDA.LoginFailedContext(c.Request().Context(), id)
+	if err != nil {
+		c.Echo().Logger.Debugf("User[%s] Record login failure Error. [%s]", userID, err)
+	} else if failed.IsLocked(time.Now()) {
+		c.Echo().Logger.Warnf("User[%s] Account locked until %s.", userID, failed.LockedUntil)
+		recordAudit(c, audit.Event{Actor: userID, Target: userID, Action: audit.ActionAccountLocked,
+			Outcome: audit.OutcomeSuccess, Reason: "locked until " + failed.LockedUntil.String()})
+	}
+}
+
+// startSession は認証されたユーザーのセッションを作成してクッキーに書き込む
+func startSession(c echo.Context, user *model.User) (session.ID, error) {
+	realm := currentRealm(c)
+	sessionID, err := sessionManager.CreateWithExpireContext(c.Request().Context(), realm.SessionExpire)
+	if err != nil {
+		return "", err
 	}
 	err = session.WriteCookie(c, sessionID)
 	if err != nil {
-		return err
+		return "", err
 	}
-	sessionStore, err := sessionManager.LoadStore(sessionID)
+	sessionStore, err := sessionManager.LoadStoreContext(c.Request().Context(), sessionID)
 	if err != nil {
-		return err
+		return "", err
 	}
 	sessionData := map[string]string{
-		"user_id": userID,
+		"realm":   realm.Name,
+		"user_id": user.UserID,
+	}
+	if user.PasswordChangeRequired(time.Now()) {
+		// パスワードを変更するまではパスワードの変更画面のみ使用できる
+		sessionData["must_change_password"] = "1"
 	}
 	sessionStore.Data = sessionData
-	err = sessionManager.SaveStore(sessionID, sessionStore)
+	err = sessionManager.SaveStoreContext(c.Request().Context(), sessionID, sessionStore)
+	if err != nil {
+		return "", err
+	}
+
+	return sessionID, nil
+}
+
+// UserChangePassword は現在のパスワードを確認してから新しいパスワードに変更する
+func UserChangePassword(c echo.Context, userID string, current string, password string, confirm string) error {
+	err := userChangePassword(c, userID, current, password, confirm)
+	event := audit.Event{Actor: userID, Target: userID, Action: audit.ActionPasswordChange}
+	event.Outcome, event.Reason = auditOutcome(err)
+	recordAudit(c, event)
+	return err
+}
+
+func userChangePassword(c echo.Context, userID string, current string, password string, confirm string) error {
+	users, err := userDA.FindByUserIDContext(c.Request().Context(), currentRealm(c).Name, userID, model.FindFirst)
+	if err != nil {
+		return err
+	}
+	user := &users[0]
+	if user.Source != "" {
+		return ErrorExternalUser
+	}
+	// 現在のパスワードの確認もログインと同じくロックの対象とする
+	if user.Disabled {
+		return ErrorAccountDisabled
+	}
+	if user.IsLocked(time.Now()) {
+		return ErrorAccountLocked
+	}
+	match, err := model.VerifyPassword(current, user.Password)
+	if err != nil {
+		return err
+	}
+	if !match {
+		recordLoginFailure(c, userID, user.ID)
+		return ErrorInvalidPassword
+	}
+	if password != confirm {
+		return ErrorPasswordMismatch
+	}
+	err = userDA.ChangePasswordContext(c.Request().Context(), user.ID, password)
 	if err != nil {
 		return err
 	}
+	return clearPasswordChangeRequired(c)
+}
 
-	return nil
+// clearPasswordChangeRequired はパスワードの変更後にセッションの制限を解除する
+func clearPasswordChangeRequired(c echo.Context) error {
+	sessionID, err := session.ReadCookie(c)
+	if err != nil {
+		return err
+	}
+	sessionStore, err := sessionManager.LoadStoreContext(c.Request().Context(), sessionID)
+	if err != nil {
+		return err
+	}
+	if _, ok := sessionStore.Data["must_change_password"]; !ok {
+		return nil
+	}
+	delete(sessionStore.Data, "must_change_password")
+	return sessionManager.SaveStoreContext(c.Request().Context(), sessionID, sessionStore)
+}
+
+// PasswordChangeRequiredByUserID はユーザーがパスワードを変更する必要があるかを返す
+func PasswordChangeRequiredByUserID(ctx context.Context, realm string, userID string) (bool, error) {
+	users, err := userDA.FindByUserIDContext(ctx, realm, userID, model.FindFirst)
+	if err != nil {
+		return false, err
+	}
+	return users[0].PasswordChangeRequired(time.Now()), nil
 }
 
 func UserLogout(c echo.Context) error {
@@ -54,7 +216,14 @@ func UserLogout(c echo.Context) error {
 	if err != nil {
 		return err
 	}
-	err = sessionManager.Delete(sessionID)
+	event := audit.Event{Action: audit.ActionLogout, SessionHash: hashSessionID(sessionID)}
+	if store, err := sessionManager.LoadStoreContext(c.Request().Context(), sessionID); err == nil {
+		event.Actor = store.Data["user_id"]
+		event.Target = event.Actor
+	}
+	err = sessionManager.DeleteContext(c.Request().Context(), sessionID)
+	event.Outcome, event.Reason = auditOutcome(err)
+	recordAudit(c, event)
 	if err != nil {
 		return err
 	}
@@ -63,68 +232,121 @@ func UserLogout(c echo.Context) error {
 }
 
 func CheckUserID(c echo.Context, userID string) error {
+	return checkUserID(c, userID, false)
+}
+
+// CheckUserIDForPasswordChange はパスワードの変更のみを許可されたセッションも受け入れる
+func CheckUserIDForPasswordChange(c echo.Context, userID string) error {
+	return checkUserID(c, userID, true)
+}
+
+func checkUserID(c echo.Context, userID string, allowRestricted bool) error {
 	sessionID, err := session.ReadCookie(c)
 	if err != nil {
 		return err
 	}
-	sessionStore, err := sessionManager.LoadStore(sessionID)
+	sessionStore, err := sessionManager.LoadStoreContext(c.Request().Context(), sessionID)
 	if err != nil {
 		return err
 	}
 	sessionUserID, ok := sessionStore.Data["user_id"]
-	if !ok {
+	if !ok || !sessionInRealm(c, &sessionStore) {
 		return ErrorNotLoggedIn
 	}
-	if sessionUserID != userID {
+	if normalized, err := model.NormalizeUserID(userID); err != nil || sessionUserID != normalized {
 		return ErrorInvalidUserID
 	}
+	if _, ok := sessionStore.Data["must_change_password"]; ok && !allowRestricted {
+		return ErrorPasswordChangeRequired
+	}
 
 	return nil
 }
 
+// sessionInRealm はセッションがリクエストのレルムで作成されたかを返す
+func sessionInRealm(c echo.Context, sessionStore *session.Store) bool {
+	return sessionStore.Data["realm"] == currentRealm(c).Name
+}
+
 func CheckRole(c echo.Context, role model.Role) (bool, error) {
-	sessionID, err := session.ReadCookie(c)
+	sessionUserID, err := loadSessionUserID(c)
 	if err != nil {
 		return false, err
 	}
-	sessionStore, err := sessionManager.LoadStore(sessionID)
+	return CheckRoleByUserID(c.Request().Context(), currentRealm(c).Name, sessionUserID, role)
+}
+
+// CheckRoleByUserID はユーザーが継承を含めてロールを持っているかを返す
+func CheckRoleByUserID(ctx context.Context, realm string, userID string, role model.Role) (bool, error) {
+	users, err := userDA.FindByUserIDContext(ctx, realm, userID, model.FindFirst)
 	if err != nil {
 		return false, err
 	}
-	sessionUserID, ok := sessionStore.Data["user_id"]
-	if !ok {
-		return false, ErrorNotLoggedIn
-	}
-	haveRole, err := CheckRoleByUserID(sessionUserID, role)
-	return haveRole, nil
+	return rbac.HasRole(&users[0], role), nil
+}
+
+// HasPermission はユーザーがロールやグループを通じて権限を持っているかを返す
+func HasPermission(user *model.User, perm model.Permission) bool {
+	return rbac.HasPermission(user, perm)
 }
 
-func CheckRoleByUserID(userID string, role model.Role) (bool, error) {
-	users, err := userDA.FindByUserID(userID, model.FindFirst)
+func CheckPermission(c echo.Context, perm model.Permission) (bool, error) {
+	sessionUserID, err := loadSessionUserID(c)
 	if err != nil {
 		return false, err
 	}
-	user := &users[0]
-	for _, v := range user.Roles {
-		if v == role {
-			return true, nil
-		}
+	return CheckPermissionByUserID(c.Request().Context(), currentRealm(c).Name, sessionUserID, perm)
+}
+
+func CheckPermissionByUserID(ctx context.Context, realm string, userID string, perm model.Permission) (bool, error) {
+	users, err := userDA.FindByUserIDContext(ctx, realm, userID, model.FindFirst)
+	if err != nil {
+		return false, err
 	}
+	return HasPermission(&users[0], perm), nil
+}
 
-	return false, nil
+func loadSessionUserID(c echo.Context) (string, error) {
+	sessionID, err := session.ReadCookie(c)
+	if err != nil {
+		return "", err
+	}
+	sessionStore, err := sessionManager.LoadStoreContext(c.Request().Context(), sessionID)
+	if err != nil {
+		return "", err
+	}
+	sessionUserID, ok := sessionStore.Data["user_id"]
+	if !ok || !sessionInRealm(c, &sessionStore) {
+		return "", ErrorNotLoggedIn
+	}
+	if _, ok := sessionStore.Data["must_change_password"]; ok {
+		return "", ErrorPasswordChangeRequired
+	}
+	return sessionUserID, nil
 }
 
-func MiddlewareAuthAdmin(next echo.HandlerFunc) echo.HandlerFunc {
-	return func(c echo.Context) error {
-		isAdmin, err := CheckRole(c, model.RoleAdmin)
-		if err != nil {
-			c.Echo().Logger.Debugf("Admin Page Role Error. [%s]", err)
-			isAdmin = false
-		}
-		if !isAdmin {
-			msg := "You have not logged in as an admin."
-			return c.Render(http.StatusOK, "error", msg)
+// MiddlewareRequirePermission はすべての権限を持つユーザーのみ通過させる
+func MiddlewareRequirePermission(perms ...model.Permission) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			for _, perm := range perms {
+				allowed, err := CheckPermission(c, perm)
+				if err != nil {
+					c.Echo().Logger.Debugf("Permission[%s] Check Error. [%s]", perm, err)
+					allowed = false
+				}
+				if !allowed {
+					recordAudit(c, audit.Event{Target: c.Request().URL.Path, Action: audit.ActionAccessDenied,
+						Outcome: audit.OutcomeFailure, Reason: "missing permission " + string(perm)})
+					msg := "You do not have permission to access this page."
+					return c.Render(http.StatusOK, "error", msg)
+				}
+			}
+			return next(c)
 		}
-		return next(c)
 	}
 }
+
+func MiddlewareAuthAdmin(next echo.HandlerFunc) echo.HandlerFunc {
+	return MiddlewareRequirePermission(model.PermissionAdminAccess)(next)
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/knanao/goauth/server/audit"
+	"github.com/knanao/goauth/server/ldapauth"
+	"github.com/knanao/goauth/server/model"
+	"github.com/knanao/goauth/server/setting"
+	"github.com/labstack/echo"
+)
+
+// ldapEnabled はリクエストのレルムでLDAPによる認証を使用するかを返す
+func ldapEnabled(c echo.Context) bool {
+	return ldapAuth != nil && setting.LDAP.Realm == currentRealm(c).Name
+}
+
+// ldapLogin はディレクトリで認証し、ローカルのユーザーを作成または更新する
+//
+// ロールはログインのたびにディレクトリのグループから設定し直す。
+// localはすでに作成されているユーザー(初回のログインではnil)で、
+// ローカルのユーザーと同じくロック中は認証せず、パスワードの誤りを記録する
+func ldapLogin(c echo.Context, userID string, password string, local *model.User) (model.User, error) {
+	ctx := c.Request().Context()
+	if local != nil && local.Disabled {
+		return model.User{}, ErrorAccountDisabled
+	}
+	if local != nil && local.IsLocked(time.Now()) {
+		return model.User{}, ErrorAccountLocked
+	}
+	entry, err := ldapAuth.AuthenticateContext(ctx, userID, password)
+	if err != nil {
+		// ディレクトリに接続できない場合などは利用者の誤りではないため記録しない
+		if local != nil && err == ldapauth.ErrorInvalidPassword {
+			recordLoginFailure(c, userID, local.ID)
+		}
+		return model.User{}, err
+	}
+	var user model.User
+	if local == nil {
+		user, err = userDA.CreateContext(ctx, model.User{
+			Realm:    currentRealm(c).Name,
+			UserID:   entry.UserID,
+			FullName: entry.FullName,
+			Email:    entry.Email,
+			Roles:    entry.Roles,
+			Source:   model.SourceLDAP,
+		})
+		event := audit.Event{Actor: userID, Target: string(user.ID), Action: audit.ActionUserCreate}
+		if err != nil {
+			event.Target = entry.UserID
+		}
+		event.Outcome, event.Reason = auditOutcome(err)
+		recordAudit(c, event)
+		if err != nil {
+			return model.User{}, err
+		}
+		c.Echo().Logger.Infof("User[ID=%s] Created from LDAP. dn[%s]", user.ID, entry.DN)
+	} else {
+		user = *local
+		if user.FullName != entry.FullName || user.Email != entry.Email || !sameRoles(user.Roles, entry.Roles) {
+			event := audit.Event{Actor: userID, Target: string(user.ID), Action: audit.ActionUserUpdate}
+			if !sameRoles(user.Roles, entry.Roles) {
+				// ロールの変更は権限の変更のため、変更前後を残す
+				event.Reason = fmt.Sprintf("roles %v changed to %v", user.Roles, entry.Roles)
+			}
+			user.FullName = entry.FullName
+			user.Email = entry.Email
+			user.Roles = entry.Roles
+			err := userDA.UpdateContext(ctx, user)
+			event.Outcome = audit.OutcomeSuccess
+			if err != nil {
+				event.Outcome, event.Reason = auditOutcome(err)
+			}
+			recordAudit(c, event)
+			if err != nil {
+				return model.User{}, err
+			}
+			c.Echo().Logger.Infof("User[ID=%s] Updated from LDAP. dn[%s] roles%s", user.ID, entry.DN, user.Roles)
+		}
+	}
+	if err := userDA.LoginSucceededContext(ctx, user.ID, c.RealIP()); err != nil {
+		c.Echo().Logger.Debugf("User[%s] Record login Error. [%s]", userID, err)
+	}
+	return user, nil
+}
+
+func sameRoles(a []model.Role, b []model.Role) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/knanao/goauth/server/audit"
+	"github.com/knanao/goauth/server/ldapauth"
+	"github.com/knanao/goauth/server/ldapauth/ldaptest"
+	"github.com/knanao/goauth/server/model"
+	"github.com/knanao/goauth/server/session"
+	"github.com/knanao/goauth/server/setting"
+	"github.com/labstack/echo"
+)
+
+// setupLDAPLogin はディレクトリとLDAPで認証するレルムを用意し、各コンポーネントを起動する
+func setupLDAPLogin(t *testing.T) (*echo.Echo, *ldaptest.Server) {
+	t.Helper()
+	dir := t.TempDir()
+	directory, err := ldaptest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(directory.Close)
+	directory.AddEntry(ldaptest.Entry{
+		DN:       "uid=alice,ou=people,dc=example,dc=com",
+		Password: "alice-secret",
+		Attributes: map[string][]string{
+			"uid":      {"alice"},
+			"cn":       {"Alice"},
+			"memberOf": {"cn=staff,ou=groups,dc=example,dc=com"},
+		},
+	})
+
+	setting.Load()
+	setting.Realm.Path = ""
+	if err := setting.LoadRealms(); err != nil {
+		t.Fatal(err)
+	}
+	setting.Password.Algorithm = "pbkdf2-sha256"
+	setting.Password.PBKDF2Iterations = 1000
+	setting.UserStore.ReloadInterval = 0
+	setting.Session.Backend = "memory"
+	setting.Session.SnapshotPath = ""
+	setting.Audit.Path = filepath.Join(dir, "audit.log")
+	setting.Lockout.MaxFailures = 3
+	setting.LDAP.URL = directory.URL
+	setting.LDAP.BaseDN = "dc=example,dc=com"
+	setting.LDAP.UserFilter = "(uid=%s)"
+	setting.LDAP.NameAttribute = "cn"
+	setting.LDAP.GroupAttribute = "memberOf"
+	setting.LDAP.GroupRoles = map[string][]string{"staff": {string(model.RoleUser)}}
+	setting.LDAP.Realm = setting.DefaultRealm
+	setting.LDAP.Timeout = 5 * time.Second
+	setting.LDAP.Enabled = true
+
+	e := echo.New()
+	e.Logger.SetOutput(ioutil.Discard)
+	auditLog = &audit.Logger{}
+	if err := auditLog.Start(e); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(auditLog.Stop)
+	sessionManager = &session.Manager{}
+	if err := sessionManager.Start(e); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(sessionManager.Stop)
+	path := filepath.Join(dir, "users.json")
+	if err := ioutil.WriteFile(path, []byte("[]"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	userDA = &model.UserDataAccessor{Store: model.NewJSONFileStore(path)}
+	if err := userDA.Start(e); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(userDA.Stop)
+	ldapAuth = &ldapauth.Authenticator{}
+	if err := ldapAuth.Start(e); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		ldapAuth.Stop()
+		ldapAuth = nil
+	})
+	return e, directory
+}
+
+func newLoginContext(e *echo.Echo) echo.Context {
+	req := httptest.NewRequest("POST", "/login", nil)
+	return e.NewContext(req, httptest.NewRecorder())
+}
+
+func TestLDAPLoginCreatesUser(t *testing.T) {
+	e, _ := setupLDAPLogin(t)
+
+	if _, err := userLogin(newLoginContext(e), "alice", "alice-secret"); err != nil {
+		t.Fatal(err)
+	}
+	users, err := userDA.FindByUserID(setting.DefaultRealm, "alice", model.FindFirst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if users[0].Source != model.SourceLDAP || users[0].FullName != "Alice" {
+		t.Errorf("created user = %+v", users[0])
+	}
+	if len(users[0].Roles) != 1 || users[0].Roles[0] != model.RoleUser {
+		t.Errorf("roles = %v, want [%s]", users[0].Roles, model.RoleUser)
+	}
+}
+
+func TestLDAPLoginBreakGlassLocalUser(t *testing.T) {
+	e, directory := setupLDAPLogin(t)
+	hash, err := model.HashPassword("Break-glass-123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := userDA.Create(model.User{UserID: "root", Password: hash, Roles: []model.Role{model.RoleAdmin}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := userLogin(newLoginContext(e), "alice", "alice-secret"); err != nil {
+		t.Fatal(err)
+	}
+
+	// ディレクトリが止まっていてもローカルのユーザーはログインできる
+	directory.Close()
+	if _, err := userLogin(newLoginContext(e), "root", "Break-glass-123"); err != nil {
+		t.Errorf("local user: err = %v, want nil", err)
+	}
+	if _, err := userLogin(newLoginContext(e), "root", "wrong"); err != ErrorInvalidPassword {
+		t.Errorf("local user with wrong password: err = %v, want %v", err, ErrorInvalidPassword)
+	}
+	// ディレクトリのユーザーはローカルで認証しない
+	if _, err := userLogin(newLoginContext(e), "alice", "alice-secret"); err != ldapauth.ErrorUnavailable {
+		t.Errorf("directory user: err = %v, want %v", err, ldapauth.ErrorUnavailable)
+	}
+	users, err := userDA.FindByUserID(setting.DefaultRealm, "alice", model.FindFirst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if users[0].FailedLogins != 0 {
+		t.Errorf("unavailable directory was recorded as a failure: %d", users[0].FailedLogins)
+	}
+}
+
+func TestLDAPLoginLockout(t *testing.T) {
+	e, _ := setupLDAPLogin(t)
+	if _, err := userLogin(newLoginContext(e), "alice", "alice-secret"); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < setting.Lockout.MaxFailures; i++ {
+		if _, err := userLogin(newLoginContext(e), "alice", "wrong"); err != ldapauth.ErrorInvalidPassword {
+			t.Fatalf("attempt %d: err = %v, want %v", i, err, ldapauth.ErrorInvalidPassword)
+		}
+	}
+	users, err := userDA.FindByUserID(setting.DefaultRealm, "alice", model.FindFirst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !users[0].IsLocked(time.Now()) {
+		t.Fatalf("user is not locked after %d failures", users[0].FailedLogins)
+	}
+	// ロック中は正しいパスワードでもディレクトリに問い合わせない
+	if _, err := userLogin(newLoginContext(e), "alice", "alice-secret"); err != ErrorAccountLocked {
+		t.Errorf("locked user: err = %v, want %v", err, ErrorAccountLocked)
+	}
+	data, err := ioutil.ReadFile(setting.Audit.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), string(audit.ActionAccountLocked)) {
+		t.Error("account lock is not in the audit log")
+	}
+}
+
+func TestLDAPLoginAuditsUserChanges(t *testing.T) {
+	e, _ := setupLDAPLogin(t)
+	if _, err := userLogin(newLoginContext(e), "alice", "alice-secret"); err != nil {
+		t.Fatal(err)
+	}
+	users, err := userDA.FindByUserID(setting.DefaultRealm, "alice", model.FindFirst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// ローカルで変更したロールは次のログインでディレクトリの値に戻る
+	alice := users[0]
+	alice.Roles = []model.Role{model.RoleAdmin}
+	if err := userDA.Update(alice); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := userLogin(newLoginContext(e), "alice", "alice-secret"); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile(setting.Audit.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var created, updated bool
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		if !strings.Contains(line, `"target":"`+string(alice.ID)+`"`) {
+			continue
+		}
+		switch {
+		case strings.Contains(line, `"action":"`+string(audit.ActionUserCreate)+`"`):
+			created = true
+		case strings.Contains(line, `"action":"`+string(audit.ActionUserUpdate)+`"`):
+			updated = strings.Contains(line, "roles ["+string(model.RoleAdmin)+"] changed to ["+string(model.RoleUser)+"]")
+		}
+	}
+	if !created {
+		t.Error("user creation from LDAP is not in the audit log")
+	}
+	if !updated {
+		t.Error("role change from LDAP is not in the audit log")
+	}
+}
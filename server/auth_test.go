@@ -0,0 +1,55 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/knanao/goauth/server/model"
+	"github.com/knanao/goauth/server/setting"
+)
+
+func TestChangePasswordLockout(t *testing.T) {
+	e, _ := setupLDAPLogin(t)
+	hash, err := model.HashPassword("Password-1234")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := userDA.Create(model.User{UserID: "bob", Password: hash, Roles: []model.Role{model.RoleUser}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// 現在のパスワードの誤りはログインの失敗と同じく数える
+	for i := 0; i < setting.Lockout.MaxFailures; i++ {
+		err := userChangePassword(newLoginContext(e), "bob", "wrong", "New-password-1234", "New-password-1234")
+		if err != ErrorInvalidPassword {
+			t.Fatalf("attempt %d: err = %v, want %v", i, err, ErrorInvalidPassword)
+		}
+	}
+	users, err := userDA.FindByUserID(setting.DefaultRealm, "bob", model.FindFirst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !users[0].IsLocked(time.Now()) {
+		t.Fatalf("user is not locked after %d failures", users[0].FailedLogins)
+	}
+	err = userChangePassword(newLoginContext(e), "bob", "Password-1234", "New-password-1234", "New-password-1234")
+	if err != ErrorAccountLocked {
+		t.Errorf("locked user: err = %v, want %v", err, ErrorAccountLocked)
+	}
+
+	if err := userDA.Unlock(users[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	bob, err := userDA.FindByID(users[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob.Disabled = true
+	if err := userDA.Update(bob); err != nil {
+		t.Fatal(err)
+	}
+	err = userChangePassword(newLoginContext(e), "bob", "Password-1234", "New-password-1234", "New-password-1234")
+	if err != ErrorAccountDisabled {
+		t.Errorf("disabled user: err = %v, want %v", err, ErrorAccountDisabled)
+	}
+}
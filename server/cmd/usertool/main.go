@@ -0,0 +1,276 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/knanao/goauth/server/audit"
+	"github.com/knanao/goauth/server/envelope"
+	"github.com/knanao/goauth/server/model"
+	"github.com/knanao/goauth/server/setting"
+	"github.com/labstack/echo"
+	"github.com/labstack/gommon/log"
+)
+
+const usage = `usage:
+  usertool import [-format csv|jsonl|ldif] [-realm REALM] [-dry-run] [-allow-prehashed] FILE
+  usertool export [-format csv|jsonl|ldif] [-realm REALM] [FILE]
+  usertool validate [-json]
+  usertool audit-verify [FILE]
+  usertool encrypt [FILE]
+  usertool decrypt [FILE]
+  usertool genkey ID
+`
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	setting.Load()
+	// ツールの実行中はファイルの変更を監視しない
+	setting.UserStore.ReloadInterval = 0
+	if err := setting.LoadRealms(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	var err error
+	switch os.Args[1] {
+	case "import":
+		err = runImport(os.Args[2:])
+	case "export":
+		err = runExport(os.Args[2:])
+	case "validate":
+		err = runValidate(os.Args[2:])
+	case "audit-verify":
+		err = runAuditVerify(os.Args[2:])
+	case "encrypt", "decrypt":
+		err = runCrypt(os.Args[1], os.Args[2:])
+	case "genkey":
+		err = runGenKey(os.Args[2:])
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// startUserDA はユーザーデータを読み込む。rbacがnilの場合はロールを検証しない
+func startUserDA(rbac *model.RBAC) (*model.UserDataAccessor, error) {
+	e := echo.New()
+	e.Logger.SetLevel(log.WARN)
+	// 標準出力はエクスポートや検証結果の出力に使用する
+	e.Logger.SetOutput(os.Stderr)
+	userDA := &model.UserDataAccessor{RBAC: rbac}
+	if err := userDA.Start(e); err != nil {
+		return nil, err
+	}
+	return userDA, nil
+}
+
+func runImport(args []string) error {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	format := fs.String("format", "csv", "input format (csv, jsonl, ldif)")
+	dryRun := fs.Bool("dry-run", false, "validate only and do not save")
+	allowPreHashed := fs.Bool("allow-prehashed", false, "accept pre-hashed passwords")
+	realm := fs.String("realm", "", "add all users to this realm")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	rbac, err := model.LoadRBAC(setting.RBAC.Path)
+	if err != nil {
+		return err
+	}
+	userDA, err := startUserDA(rbac)
+	if err != nil {
+		return err
+	}
+	defer userDA.Stop()
+	opt := model.ImportOptions{
+		Format:         model.TransferFormat(*format),
+		DryRun:         *dryRun,
+		AllowPreHashed: *allowPreHashed,
+		RBAC:           rbac,
+		Realm:          *realm,
+	}
+	result, err := userDA.Import(f, opt)
+	if !opt.DryRun {
+		recordImport(result, err)
+	}
+	if err != nil {
+		return err
+	}
+	for _, x := range result.Rows {
+		for _, msg := range x.Errors {
+			fmt.Printf("line %d [%s]: %s\n", x.Line, x.UserID, msg)
+		}
+	}
+	switch {
+	case result.HasErrors():
+		return fmt.Errorf("no users were imported")
+	case result.DryRun:
+		fmt.Printf("dry run: %d users can be imported\n", len(result.Rows))
+	default:
+		fmt.Printf("%d users were imported\n", result.Imported)
+	}
+	return nil
+}
+
+func runExport(args []string) error {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	format := fs.String("format", "csv", "output format (csv, jsonl, ldif)")
+	realm := fs.String("realm", "", "export only users in this realm")
+	fs.Parse(args)
+	var w io.Writer = os.Stdout
+	if fs.NArg() == 1 {
+		f, err := os.OpenFile(fs.Arg(0), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	userDA, err := startUserDA(nil)
+	if err != nil {
+		return err
+	}
+	defer userDA.Stop()
+	return userDA.Export(w, model.TransferFormat(*format), *realm)
+}
+
+// runValidate はユーザーデータを検証して結果を出力する。エラーがある場合は失敗を返す
+func runValidate(args []string) error {
+	fs := flag.NewFlagSet("validate", flag.ExitOnError)
+	asJSON := fs.Bool("json", false, "print the report as JSON")
+	fs.Parse(args)
+	rbac, err := model.LoadRBAC(setting.RBAC.Path)
+	if err != nil {
+		return err
+	}
+	// 厳格モードではエラーのあるデータを読み込めないため、検証では無効にする
+	setting.UserStore.Strict = false
+	userDA, err := startUserDA(rbac)
+	if err != nil {
+		return err
+	}
+	defer userDA.Stop()
+	report, err := userDA.Validate()
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(report); err != nil {
+			return err
+		}
+	} else {
+		for _, x := range report.Issues {
+			fmt.Printf("%s %s realm[%s] id[%s] user_id[%s]: %s\n",
+				x.Severity, x.Code, x.Realm, x.ID, x.UserID, x.Message)
+		}
+		fmt.Printf("%d users checked: %d errors, %d warnings\n",
+			report.Users, len(report.Errors()), len(report.Warnings()))
+	}
+	if report.HasErrors() {
+		return fmt.Errorf("user data has %d errors", len(report.Errors()))
+	}
+	return nil
+}
+
+// recordImport はツールからのインポートを監査ログに記録する
+func recordImport(result model.ImportResult, importErr error) {
+	e := echo.New()
+	e.Logger.SetLevel(log.WARN)
+	auditLog := &audit.Logger{}
+	if err := auditLog.Start(e); err != nil {
+		fmt.Fprintln(os.Stderr, "audit:", err)
+		return
+	}
+	defer auditLog.Stop()
+	event := audit.Event{Actor: "cli:" + os.Getenv("USER"), Action: audit.ActionUserImport, Outcome: audit.OutcomeSuccess}
+	if importErr != nil {
+		event.Outcome, event.Reason = audit.OutcomeFailure, importErr.Error()
+	} else if result.HasErrors() {
+		event.Outcome, event.Reason = audit.OutcomeFailure, "validation errors"
+	}
+	event.Target = fmt.Sprintf("%d users", result.Imported)
+	if err := auditLog.Record(event); err != nil {
+		fmt.Fprintln(os.Stderr, "audit:", err)
+	}
+	for _, x := range result.Rows {
+		if x.ID == "" {
+			continue
+		}
+		created := audit.Event{Actor: event.Actor, Target: string(x.ID), Action: audit.ActionUserCreate, Outcome: audit.OutcomeSuccess}
+		if err := auditLog.Record(created); err != nil {
+			fmt.Fprintln(os.Stderr, "audit:", err)
+		}
+	}
+}
+
+func runAuditVerify(args []string) error {
+	path := setting.Audit.Path
+	if len(args) == 1 {
+		path = args[0]
+	}
+	result, err := audit.Verify(path, []byte(setting.Audit.Key))
+	if err != nil {
+		return err
+	}
+	if !result.OK() {
+		return fmt.Errorf("audit log is broken at line %d: %s", result.BrokenLine, result.Reason)
+	}
+	fmt.Printf("%d events verified (last seq %d)\n", result.Events, result.LastSeq)
+	return nil
+}
+
+// runCrypt はユーザーファイルを設定された鍵で暗号化または復号する
+//
+// 暗号化済みのファイルをencryptすると現在の鍵で暗号化し直す
+func runCrypt(cmd string, args []string) error {
+	path := setting.UserStore.JSONPath
+	if len(args) == 1 {
+		path = args[0]
+	}
+	keyring, err := envelope.LoadKeyring(setting.UserStore.Key, setting.UserStore.KeyFile)
+	if err != nil {
+		return err
+	}
+	if cmd == "decrypt" {
+		return model.DecryptUserFile(path, keyring)
+	}
+	if err := model.EncryptUserFile(path, keyring); err != nil {
+		return err
+	}
+	fmt.Printf("%s was encrypted with key %s\n", path, keyring.PrimaryID())
+	return nil
+}
+
+func runGenKey(args []string) error {
+	if len(args) != 1 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	key, err := envelope.GenerateKey(args[0])
+	if err != nil {
+		return err
+	}
+	fmt.Println(key)
+	return nil
+}
@@ -0,0 +1,242 @@
+// Package envelope はデータごとに生成した鍵でAES-GCM暗号化し、
+// その鍵をさらに鍵IDで識別される鍵で暗号化するエンベロープ暗号化を提供する
+package envelope
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"strings"
+)
+
+var (
+	ErrorBadKey      = errors.New("Bad Key")
+	ErrorUnknownKey  = errors.New("Unknown Key")
+	ErrorNoKey       = errors.New("No Key")
+	ErrorBadEnvelope = errors.New("Bad Envelope")
+)
+
+const (
+	formatV1 = "goauth-envelope-v1"
+	keySize  = 32
+)
+
+// Key は鍵IDと256bitの鍵
+type Key struct {
+	ID     string
+	Secret []byte
+}
+
+// Keyring は暗号化に使用する鍵と復号できる鍵の一覧
+//
+// 暗号化には常に先頭の鍵を使用し、それ以外の鍵は古いデータの復号にのみ使用する
+type Keyring struct {
+	keys    map[string][]byte
+	primary string
+}
+
+type envelope struct {
+	Format     string `json:"format"`
+	KeyID      string `json:"key_id"`
+	KeyNonce   []byte `json:"key_nonce"`
+	WrappedKey []byte `json:"wrapped_key"`
+	Nonce      []byte `json:"nonce"`
+	Data       []byte `json:"data"`
+}
+
+func NewKeyring(keys ...Key) (*Keyring, error) {
+	if len(keys) <= 0 {
+		return nil, ErrorNoKey
+	}
+	k := &Keyring{keys: make(map[string][]byte), primary: keys[0].ID}
+	for _, x := range keys {
+		if x.ID == "" || strings.ContainsAny(x.ID, " \t:") || len(x.Secret) != keySize {
+			return nil, ErrorBadKey
+		}
+		if _, ok := k.keys[x.ID]; ok {
+			continue
+		}
+		k.keys[x.ID] = x.Secret
+	}
+	return k, nil
+}
+
+// ParseKey は"ID:鍵(base64)"の形式の鍵を読み込む
+func ParseKey(text string) (Key, error) {
+	fields := strings.SplitN(strings.TrimSpace(text), ":", 2)
+	if len(fields) != 2 {
+		return Key{}, ErrorBadKey
+	}
+	secret, err := base64.StdEncoding.DecodeString(strings.TrimSpace(fields[1]))
+	if err != nil {
+		return Key{}, ErrorBadKey
+	}
+	return Key{strings.TrimSpace(fields[0]), secret}, nil
+}
+
+// LoadKeyring は環境変数などで指定された鍵と鍵ファイルから鍵の一覧を作成する
+//
+// 鍵ファイルは1行に1つ"ID:鍵(base64)"を記述する。#で始まる行は無視する。
+// keyが空でない場合はkeyを、そうでない場合は鍵ファイルの先頭の鍵を暗号化に使用する。
+// どちらも指定されていない場合はnilを返す
+func LoadKeyring(key string, path string) (*Keyring, error) {
+	keys := []Key{}
+	if key != "" {
+		x, err := ParseKey(key)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, x)
+	}
+	if path != "" {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		scanner := bufio.NewScanner(bytes.NewReader(data))
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			x, err := ParseKey(line)
+			if err != nil {
+				return nil, err
+			}
+			keys = append(keys, x)
+		}
+	}
+	if len(keys) <= 0 {
+		return nil, nil
+	}
+	return NewKeyring(keys...)
+}
+
+// GenerateKey は新しい鍵を作成する
+func GenerateKey(id string) (Key, error) {
+	secret := make([]byte, keySize)
+	if _, err := io.ReadFull(rand.Reader, secret); err != nil {
+		return Key{}, err
+	}
+	return Key{id, secret}, nil
+}
+
+// String は鍵ファイルに記述する形式を返す
+func (k Key) String() string {
+	return k.ID + ":" + base64.StdEncoding.EncodeToString(k.Secret)
+}
+
+// PrimaryID は暗号化に使用する鍵IDを返す
+func (k *Keyring) PrimaryID() string {
+	return k.primary
+}
+
+// IsSealed はデータが暗号化されているかを返す
+func IsSealed(data []byte) bool {
+	data = bytes.TrimSpace(data)
+	if len(data) <= 0 || data[0] != '{' {
+		return false
+	}
+	var x struct {
+		Format string `json:"format"`
+	}
+	if err := json.Unmarshal(data, &x); err != nil {
+		return false
+	}
+	return x.Format == formatV1
+}
+
+// Seal はデータを暗号化する
+func (k *Keyring) Seal(plain []byte) ([]byte, error) {
+	if k == nil {
+		return nil, ErrorNoKey
+	}
+	dataKey := make([]byte, keySize)
+	if _, err := io.ReadFull(rand.Reader, dataKey); err != nil {
+		return nil, err
+	}
+	x := envelope{Format: formatV1, KeyID: k.primary}
+	aad := x.additionalData()
+	var err error
+	x.KeyNonce, x.WrappedKey, err = seal(k.keys[k.primary], dataKey, aad)
+	if err != nil {
+		return nil, err
+	}
+	x.Nonce, x.Data, err = seal(dataKey, plain, aad)
+	if err != nil {
+		return nil, err
+	}
+	data, err := json.Marshal(x)
+	if err != nil {
+		return nil, err
+	}
+	return append(data, '\n'), nil
+}
+
+// Open は暗号化されたデータを復号し、暗号化に使用された鍵IDとともに返す
+func (k *Keyring) Open(data []byte) ([]byte, string, error) {
+	if k == nil {
+		return nil, "", ErrorNoKey
+	}
+	var x envelope
+	if err := json.Unmarshal(data, &x); err != nil || x.Format != formatV1 {
+		return nil, "", ErrorBadEnvelope
+	}
+	kek, ok := k.keys[x.KeyID]
+	if !ok {
+		return nil, x.KeyID, ErrorUnknownKey
+	}
+	aad := x.additionalData()
+	dataKey, err := open(kek, x.KeyNonce, x.WrappedKey, aad)
+	if err != nil {
+		return nil, x.KeyID, ErrorBadEnvelope
+	}
+	plain, err := open(dataKey, x.Nonce, x.Data, aad)
+	if err != nil {
+		return nil, x.KeyID, ErrorBadEnvelope
+	}
+	return plain, x.KeyID, nil
+}
+
+// additionalData は形式と鍵IDの改ざんを検出できるように認証対象に含める
+func (x *envelope) additionalData() []byte {
+	return []byte(x.Format + "\x00" + x.KeyID)
+}
+
+func seal(key []byte, plain []byte, aad []byte) ([]byte, []byte, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, nil, err
+	}
+	return nonce, aead.Seal(nil, nonce, plain, aad), nil
+}
+
+func open(key []byte, nonce []byte, data []byte, aad []byte) ([]byte, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(nonce) != aead.NonceSize() {
+		return nil, ErrorBadEnvelope
+	}
+	return aead.Open(nil, nonce, data, aad)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,155 @@
+package envelope
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+)
+
+func newTestKeyring(t *testing.T, ids ...string) *Keyring {
+	t.Helper()
+	keys := []Key{}
+	for _, id := range ids {
+		key, err := GenerateKey(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, key)
+	}
+	k, err := NewKeyring(keys...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+// modify は暗号化されたデータを読み込み、fで書き換えて返す
+func modify(t *testing.T, sealed []byte, f func(x *envelope)) []byte {
+	t.Helper()
+	var x envelope
+	if err := json.Unmarshal(sealed, &x); err != nil {
+		t.Fatal(err)
+	}
+	f(&x)
+	data, err := json.Marshal(x)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestSealOpen(t *testing.T) {
+	k := newTestKeyring(t, "k1")
+	plain := []byte(`[{"id":"1","user_id":"alice"}]`)
+	sealed, err := k.Seal(plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsSealed(sealed) || IsSealed(plain) {
+		t.Errorf("IsSealed(sealed) = %t, IsSealed(plain) = %t", IsSealed(sealed), IsSealed(plain))
+	}
+	if bytes.Contains(sealed, []byte("alice")) {
+		t.Error("sealed data contains the plain text")
+	}
+	opened, keyID, err := k.Open(sealed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(opened, plain) || keyID != "k1" {
+		t.Errorf("Open = %q, %q", opened, keyID)
+	}
+}
+
+func TestOpenWithRotatedKeys(t *testing.T) {
+	old := newTestKeyring(t, "k1")
+	sealed, err := old.Seal([]byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := GenerateKey("k2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rotated, err := NewKeyring(key, Key{"k1", old.keys["k1"]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 古い鍵で暗号化したデータも復号でき、鍵IDで作り直しが必要かを判断できる
+	opened, keyID, err := rotated.Open(sealed)
+	if err != nil || string(opened) != "secret" || keyID != "k1" {
+		t.Errorf("Open = %q, %q, %v", opened, keyID, err)
+	}
+	if rotated.PrimaryID() != "k2" {
+		t.Errorf("PrimaryID = %s, want k2", rotated.PrimaryID())
+	}
+}
+
+func TestOpenWrongKey(t *testing.T) {
+	sealed, err := newTestKeyring(t, "k1").Seal([]byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 同じ鍵IDでも鍵が異なれば復号できない
+	if _, _, err := newTestKeyring(t, "k1").Open(sealed); err != ErrorBadEnvelope {
+		t.Errorf("same id, different key: err = %v, want %v", err, ErrorBadEnvelope)
+	}
+	if _, keyID, err := newTestKeyring(t, "k2").Open(sealed); err != ErrorUnknownKey || keyID != "k1" {
+		t.Errorf("unknown key: keyID = %q, err = %v, want %v", keyID, err, ErrorUnknownKey)
+	}
+	var nilKeyring *Keyring
+	if _, _, err := nilKeyring.Open(sealed); err != ErrorNoKey {
+		t.Errorf("no keyring: err = %v, want %v", err, ErrorNoKey)
+	}
+}
+
+func TestOpenCorruptCiphertext(t *testing.T) {
+	k := newTestKeyring(t, "k1", "k2")
+	sealed, err := k.Seal([]byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		modify func(x *envelope)
+	}{
+		{"data", func(x *envelope) { x.Data[0] ^= 0x01 }},
+		{"truncated data", func(x *envelope) { x.Data = x.Data[:len(x.Data)-1] }},
+		{"nonce", func(x *envelope) { x.Nonce[0] ^= 0x01 }},
+		{"short nonce", func(x *envelope) { x.Nonce = x.Nonce[:4] }},
+		{"wrapped key", func(x *envelope) { x.WrappedKey[0] ^= 0x01 }},
+		{"key nonce", func(x *envelope) { x.KeyNonce[0] ^= 0x01 }},
+		// 鍵IDは認証の対象に含まれるため、復号できる別の鍵IDに書き換えても検出する
+		{"key id", func(x *envelope) { x.KeyID = "k2" }},
+	}
+	for _, x := range tests {
+		data := modify(t, sealed, x.modify)
+		if _, _, err := k.Open(data); err != ErrorBadEnvelope {
+			t.Errorf("%s: err = %v, want %v", x.name, err, ErrorBadEnvelope)
+		}
+	}
+	for _, data := range [][]byte{[]byte("{"), []byte(`{"format":"other"}`), sealed[:len(sealed)/2]} {
+		if _, _, err := k.Open(data); err != ErrorBadEnvelope {
+			t.Errorf("Open(%q): err = %v, want %v", data, err, ErrorBadEnvelope)
+		}
+	}
+}
+
+func TestParseKey(t *testing.T) {
+	key, err := GenerateKey("k1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := ParseKey(key.String())
+	if err != nil || parsed.ID != "k1" || !bytes.Equal(parsed.Secret, key.Secret) {
+		t.Errorf("ParseKey(%s) = %+v, %v", key, parsed, err)
+	}
+	for _, text := range []string{"no-separator", "k1:not base64!", "k1:c2hvcnQ="} {
+		key, err := ParseKey(text)
+		if err == nil {
+			_, err = NewKeyring(key)
+		}
+		if err != ErrorBadKey {
+			t.Errorf("%q: err = %v, want %v", text, err, ErrorBadKey)
+		}
+	}
+}
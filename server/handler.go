@@ -2,23 +2,54 @@ package main
 
 import (
 	"net/http"
+	"strconv"
+	"strings"
 
+	"github.com/knanao/goauth/server/audit"
 	"github.com/knanao/goauth/server/model"
 	"github.com/labstack/echo"
 )
 
 func setRoute(e *echo.Echo) {
+	e.Use(MiddlewareRealm)
+	addRoutes(e.Group(""))
+	addRoutes(e.Group("/realms/:realm"))
+}
+
+// addRoutes はレルムのルートを基準にしたルートを登録する
+func addRoutes(e *echo.Group) {
 	e.GET("/", handleIndexGet)
 	e.GET("/login", handleLoginGet)
 	e.POST("/login", handleLoginPost)
 	e.POST("/logout", handleLogoutPost)
 	e.GET("/users/:user_id", handleUsers)
 	e.POST("/users/:user_id", handleUsers)
+	e.GET("/users/:user_id/password", handleUserPasswordGet)
+	e.POST("/users/:user_id/password", handleUserPasswordPost)
 
 	admin := e.Group("/admin", MiddlewareAuthAdmin)
 	admin.GET("", handleAdmin)
 	admin.POST("", handleAdmin)
-	admin.GET("/users", handleAdminUsersGet)
+	admin.GET("/users", handleAdminUsersGet,
+		MiddlewareRequirePermission(model.PermissionUsersRead))
+	admin.GET("/users/:id", handleAdminUserGet,
+		MiddlewareRequirePermission(model.PermissionUsersRead))
+	admin.POST("/users/:id", handleAdminUserPost,
+		MiddlewareRequirePermission(model.PermissionUsersWrite))
+	admin.POST("/users/:id/delete", handleAdminUserDeletePost,
+		MiddlewareRequirePermission(model.PermissionUsersWrite))
+	admin.POST("/users/:id/unlock", handleAdminUserUnlockPost,
+		MiddlewareRequirePermission(model.PermissionUsersWrite))
+	admin.POST("/users/:id/password", handleAdminUserPasswordPost,
+		MiddlewareRequirePermission(model.PermissionUsersWrite))
+	admin.GET("/users/import", handleAdminUsersImportGet,
+		MiddlewareRequirePermission(model.PermissionUsersWrite))
+	admin.POST("/users/import", handleAdminUsersImportPost,
+		MiddlewareRequirePermission(model.PermissionUsersWrite))
+	admin.GET("/users/export", handleAdminUsersExportGet,
+		MiddlewareRequirePermission(model.PermissionUsersRead))
+	admin.GET("/users/validation", handleAdminUsersValidationGet,
+		MiddlewareRequirePermission(model.PermissionUsersRead))
 }
 
 func handleIndexGet(c echo.Context) error {
@@ -28,12 +59,15 @@ func handleIndexGet(c echo.Context) error {
 func handleUsers(c echo.Context) error {
 	userID := c.Param("user_id")
 	err := CheckUserID(c, userID)
+	if err == ErrorPasswordChangeRequired {
+		return c.Redirect(http.StatusSeeOther, realmPath(c, "/users/"+userID+"/password"))
+	}
 	if err != nil {
 		c.Echo().Logger.Debugf("User Page[%s] Role Error. [%s]", userID, err)
 		msg := "You have not logged in."
 		return c.Render(http.StatusOK, "error", msg)
 	}
-	users, err := userDA.FindByUserID(c.Param("user_id"), model.FindFirst)
+	users, err := userDA.FindByUserIDContext(c.Request().Context(), currentRealm(c).Name, c.Param("user_id"), model.FindFirst)
 	if err != nil {
 		return c.Render(http.StatusOK, "error", err)
 	}
@@ -41,16 +75,346 @@ func handleUsers(c echo.Context) error {
 	return c.Render(http.StatusOK, "user", user)
 }
 
+func handleUserPasswordGet(c echo.Context) error {
+	userID := c.Param("user_id")
+	err := CheckUserIDForPasswordChange(c, userID)
+	if err != nil {
+		c.Echo().Logger.Debugf("User Page[%s] Role Error. [%s]", userID, err)
+		msg := "You have not logged in."
+		return c.Render(http.StatusOK, "error", msg)
+	}
+	data := map[string]interface{}{"user_id": userID, "base": realmPath(c, "")}
+	return c.Render(http.StatusOK, "change_password", data)
+}
+
+func handleUserPasswordPost(c echo.Context) error {
+	userID := c.Param("user_id")
+	err := CheckUserIDForPasswordChange(c, userID)
+	if err != nil {
+		c.Echo().Logger.Debugf("User Page[%s] Role Error. [%s]", userID, err)
+		msg := "You have not logged in."
+		return c.Render(http.StatusOK, "error", msg)
+	}
+	data := map[string]interface{}{"user_id": userID, "base": realmPath(c, "")}
+	err = UserChangePassword(c, userID, c.FormValue("current_password"),
+		c.FormValue("new_password"), c.FormValue("confirm_password"))
+	if policyErr, ok := err.(*model.PasswordPolicyError); ok {
+		data["msg"] = "The new password does not meet the password policy."
+		data["violations"] = policyErr.Violations
+		return c.Render(http.StatusOK, "change_password", data)
+	}
+	if err != nil {
+		c.Echo().Logger.Debugf("User[%s] Change password Error. [%s]", userID, err)
+		data["msg"] = changePasswordMessage(err)
+		return c.Render(http.StatusOK, "change_password", data)
+	}
+	data["msg"] = "The password has been changed."
+	data["changed"] = true
+	return c.Render(http.StatusOK, "change_password", data)
+}
+
+func changePasswordMessage(err error) string {
+	switch err {
+	case ErrorInvalidPassword:
+		return "The current password is incorrect."
+	case ErrorPasswordMismatch:
+		return "The new passwords do not match."
+	case ErrorAccountLocked:
+		return "The account is locked. Please try again later."
+	}
+	return "The password could not be changed."
+}
+
 func handleAdmin(c echo.Context) error {
 	return c.Render(http.StatusOK, "admin", nil)
 }
 
+const adminUsersPageSize = 20
+
 func handleAdminUsersGet(c echo.Context) error {
-	users, err := userDA.FindAll()
+	page, err := strconv.Atoi(c.QueryParam("page"))
+	if err != nil || page < 1 {
+		page = 1
+	}
+	query := model.UserQuery{
+		Filter: model.UserFilter{
+			Realm:  currentRealm(c).Name,
+			Text:   c.QueryParam("q"),
+			Locked: c.QueryParam("locked") == "1",
+		},
+		Sort:   model.SortKey(c.QueryParam("sort")),
+		Desc:   c.QueryParam("order") == "desc",
+		Offset: (page - 1) * adminUsersPageSize,
+		Limit:  adminUsersPageSize,
+	}
+	if role := c.QueryParam("role"); role != "" {
+		query.Filter.Roles = []model.Role{model.Role(role)}
+	}
+	if disabled, err := strconv.ParseBool(c.QueryParam("disabled")); err == nil {
+		query.Filter.Disabled = &disabled
+	}
+	result, err := userDA.QueryContext(c.Request().Context(), query)
+	if err != nil {
+		return c.Render(http.StatusOK, "error", err)
+	}
+	data := map[string]interface{}{
+		"users":    result.Users,
+		"total":    result.Total,
+		"q":        c.QueryParam("q"),
+		"role":     c.QueryParam("role"),
+		"sort":     c.QueryParam("sort"),
+		"order":    c.QueryParam("order"),
+		"locked":   c.QueryParam("locked"),
+		"disabled": c.QueryParam("disabled"),
+		"page":     page,
+	}
+	if page > 1 {
+		data["prev_page"] = page - 1
+	}
+	if page*adminUsersPageSize < result.Total {
+		data["next_page"] = page + 1
+	}
+	return c.Render(http.StatusOK, "admin_users", data)
+}
+
+func handleAdminUserGet(c echo.Context) error {
+	user, err := findRealmUser(c, model.ID(c.Param("id")))
+	if err != nil {
+		return c.Render(http.StatusOK, "error", err)
+	}
+	return c.Render(http.StatusOK, "admin_user_edit", adminUserEditData(c, user, ""))
+}
+
+// handleAdminUserPost はフォームで読み込んだ時点のバージョンを指定して更新する
+//
+// 他の管理者が先に更新していた場合は現在の値でフォームを表示し直す
+func handleAdminUserPost(c echo.Context) error {
+	id := model.ID(c.Param("id"))
+	user, err := findRealmUser(c, id)
+	if err != nil {
+		return c.Render(http.StatusOK, "error", err)
+	}
+	version, err := strconv.ParseInt(c.FormValue("version"), 10, 64)
+	if err != nil {
+		return c.Render(http.StatusOK, "error", model.ErrorBadParameter)
+	}
+	user.Version = version
+	user.UserID = c.FormValue("user_id")
+	user.FullName = c.FormValue("full_name")
+	user.Email = c.FormValue("email")
+	user.Disabled = c.FormValue("disabled") != ""
+	user.Roles = nil
+	for _, x := range splitFormList(c.FormValue("roles")) {
+		role := model.Role(x)
+		if !rbac.HasRoleDefinition(role) {
+			return c.Render(http.StatusOK, "admin_user_edit", adminUserEditData(c, user, "Unknown role: "+x))
+		}
+		user.Roles = append(user.Roles, role)
+	}
+	user.Groups = nil
+	for _, x := range splitFormList(c.FormValue("groups")) {
+		if !rbac.HasGroup(x) {
+			return c.Render(http.StatusOK, "admin_user_edit", adminUserEditData(c, user, "Unknown group: "+x))
+		}
+		user.Groups = append(user.Groups, x)
+	}
+	err = userDA.UpdateContext(c.Request().Context(), user)
+	event := audit.Event{Target: string(id), Action: audit.ActionUserUpdate}
+	event.Outcome, event.Reason = auditOutcome(err)
+	recordAudit(c, event)
+	if verr, ok := err.(*model.ValidationError); ok {
+		return c.Render(http.StatusOK, "admin_user_edit", adminUserEditData(c, user, verr.Error()))
+	}
+	switch err {
+	case nil:
+	case model.ErrorVersionConflict, model.ErrorStoreConflict:
+		current, err := userDA.FindByIDContext(c.Request().Context(), id)
+		if err != nil {
+			return c.Render(http.StatusOK, "error", err)
+		}
+		msg := "This user was changed by someone else. The current values are shown below."
+		return c.Render(http.StatusConflict, "admin_user_edit", adminUserEditData(c, current, msg))
+	case model.ErrorDuplicateUserID:
+		return c.Render(http.StatusOK, "admin_user_edit", adminUserEditData(c, user, "The user ID is already in use."))
+	default:
+		return c.Render(http.StatusOK, "error", err)
+	}
+	c.Echo().Logger.Infof("User[ID=%s] Updated by admin.", id)
+	return c.Redirect(http.StatusSeeOther, realmPath(c, "/admin/users/"+string(id)))
+}
+
+// findRealmUser はリクエストのレルムに属するユーザーのみを返す
+func findRealmUser(c echo.Context, id model.ID) (model.User, error) {
+	user, err := userDA.FindByIDContext(c.Request().Context(), id)
+	if err != nil {
+		return user, err
+	}
+	if user.RealmName() != currentRealm(c).Name {
+		return model.User{}, model.ErrorNotFound
+	}
+	return user, nil
+}
+
+func adminUserEditData(c echo.Context, user model.User, msg string) map[string]interface{} {
+	roles := make([]string, 0, len(user.Roles))
+	for _, x := range user.Roles {
+		roles = append(roles, string(x))
+	}
+	return map[string]interface{}{
+		"user":   user,
+		"roles":  strings.Join(roles, ", "),
+		"groups": strings.Join(user.Groups, ", "),
+		"msg":    msg,
+		"base":   realmPath(c, ""),
+	}
+}
+
+// splitFormList はカンマ区切りの入力を空白を除いて分割する
+func splitFormList(value string) []string {
+	results := []string{}
+	for _, x := range strings.Split(value, ",") {
+		if x = strings.TrimSpace(x); x != "" {
+			results = append(results, x)
+		}
+	}
+	return results
+}
+
+func handleAdminUserDeletePost(c echo.Context) error {
+	id := model.ID(c.Param("id"))
+	if _, err := findRealmUser(c, id); err != nil {
+		return c.Render(http.StatusOK, "error", err)
+	}
+	err := userDA.DeleteContext(c.Request().Context(), id)
+	event := audit.Event{Target: string(id), Action: audit.ActionUserDelete}
+	event.Outcome, event.Reason = auditOutcome(err)
+	recordAudit(c, event)
 	if err != nil {
 		return c.Render(http.StatusOK, "error", err)
 	}
-	return c.Render(http.StatusOK, "admin_users", users)
+	c.Echo().Logger.Infof("User[ID=%s] Deleted by admin.", id)
+	return c.Redirect(http.StatusSeeOther, realmPath(c, "/admin/users"))
+}
+
+func handleAdminUserUnlockPost(c echo.Context) error {
+	id := model.ID(c.Param("id"))
+	if _, err := findRealmUser(c, id); err != nil {
+		return c.Render(http.StatusOK, "error", err)
+	}
+	err := userDA.UnlockContext(c.Request().Context(), id)
+	event := audit.Event{Target: string(id), Action: audit.ActionUserUnlock}
+	event.Outcome, event.Reason = auditOutcome(err)
+	recordAudit(c, event)
+	if err != nil {
+		return c.Render(http.StatusOK, "error", err)
+	}
+	c.Echo().Logger.Infof("User[ID=%s] Unlocked by admin.", id)
+	return c.Redirect(http.StatusSeeOther, realmPath(c, "/admin/users?locked=1"))
+}
+
+// handleAdminUserPasswordPost は一時パスワードを発行する
+func handleAdminUserPasswordPost(c echo.Context) error {
+	id := model.ID(c.Param("id"))
+	mustChange := c.FormValue("must_change_password") != ""
+	if _, err := findRealmUser(c, id); err != nil {
+		return c.Render(http.StatusOK, "error", err)
+	}
+	err := userDA.ResetPasswordContext(c.Request().Context(), id, c.FormValue("password"), mustChange)
+	event := audit.Event{Target: string(id), Action: audit.ActionPasswordReset}
+	event.Outcome, event.Reason = auditOutcome(err)
+	recordAudit(c, event)
+	if policyErr, ok := err.(*model.PasswordPolicyError); ok {
+		return c.Render(http.StatusOK, "error", policyErr.Error())
+	}
+	if err != nil {
+		return c.Render(http.StatusOK, "error", err)
+	}
+	c.Echo().Logger.Infof("User[ID=%s] Password reset by admin. must_change[%t]", id, mustChange)
+	return c.Redirect(http.StatusSeeOther, realmPath(c, "/admin/users"))
+}
+
+func handleAdminUsersImportGet(c echo.Context) error {
+	return c.Render(http.StatusOK, "admin_users_import", map[string]interface{}{"base": realmPath(c, "")})
+}
+
+func handleAdminUsersImportPost(c echo.Context) error {
+	file, err := c.FormFile("file")
+	if err != nil {
+		return c.Render(http.StatusOK, "error", err)
+	}
+	src, err := file.Open()
+	if err != nil {
+		return c.Render(http.StatusOK, "error", err)
+	}
+	defer src.Close()
+	opt := model.ImportOptions{
+		Format:         model.TransferFormat(c.FormValue("format")),
+		DryRun:         c.FormValue("dry_run") != "",
+		AllowPreHashed: c.FormValue("allow_prehashed") != "",
+		RBAC:           rbac,
+		Realm:          currentRealm(c).Name,
+	}
+	result, err := userDA.ImportContext(c.Request().Context(), src, opt)
+	if !opt.DryRun {
+		event := audit.Event{Action: audit.ActionUserImport}
+		event.Outcome, event.Reason = auditOutcome(err)
+		if err == nil && result.HasErrors() {
+			event.Outcome, event.Reason = audit.OutcomeFailure, "validation errors"
+		}
+		event.Target = strconv.Itoa(result.Imported) + " users"
+		recordAudit(c, event)
+		for _, x := range result.Rows {
+			if x.ID != "" {
+				recordAudit(c, audit.Event{Target: string(x.ID), Action: audit.ActionUserCreate, Outcome: audit.OutcomeSuccess})
+			}
+		}
+	}
+	if err != nil {
+		c.Echo().Logger.Debugf("User Import Error. [%s]", err)
+		data := map[string]interface{}{"msg": err.Error(), "base": realmPath(c, "")}
+		return c.Render(http.StatusOK, "admin_users_import", data)
+	}
+	data := map[string]interface{}{
+		"result":     result,
+		"has_errors": result.HasErrors(),
+		"base":       realmPath(c, ""),
+	}
+	return c.Render(http.StatusOK, "admin_users_import", data)
+}
+
+func handleAdminUsersExportGet(c echo.Context) error {
+	format := model.TransferFormat(c.QueryParam("format"))
+	switch format {
+	case model.FormatCSV, model.FormatJSONLines, model.FormatLDIF:
+	default:
+		return c.Render(http.StatusOK, "error", model.ErrorUnknownFormat)
+	}
+	c.Response().Header().Set(echo.HeaderContentDisposition, "attachment; filename=users."+string(format))
+	c.Response().Header().Set(echo.HeaderContentType, "application/octet-stream")
+	c.Response().WriteHeader(http.StatusOK)
+	return userDA.ExportContext(c.Request().Context(), c.Response(), format, currentRealm(c).Name)
+}
+
+// handleAdminUsersValidationGet はリクエストのレルムのユーザーの検証結果を表示する
+func handleAdminUsersValidationGet(c echo.Context) error {
+	report, err := userDA.ValidateContext(c.Request().Context())
+	if err != nil {
+		return c.Render(http.StatusOK, "error", err)
+	}
+	issues := []model.ValidationIssue{}
+	for _, x := range report.Issues {
+		if x.Realm == currentRealm(c).Name {
+			issues = append(issues, x)
+		}
+	}
+	report.Issues = issues
+	data := map[string]interface{}{
+		"report":   report,
+		"errors":   report.Errors(),
+		"warnings": report.Warnings(),
+		"base":     realmPath(c, ""),
+	}
+	return c.Render(http.StatusOK, "admin_users_validation", data)
 }
 
 func handleLoginGet(c echo.Context) error {
@@ -61,22 +425,40 @@ func handleLoginPost(c echo.Context) error {
 	userID := c.FormValue("userid")
 	password := c.FormValue("password")
 	err := UserLogin(c, userID, password)
+	if err == nil {
+		// 以降のページは正規化したUserIDで表示する
+		userID, _ = model.NormalizeUserID(userID)
+	}
+	switch err {
+	case ErrorAccountLocked:
+		c.Echo().Logger.Warnf("User[%s] Login rejected. Account is locked.", userID)
+	case ErrorAccountDisabled:
+		c.Echo().Logger.Warnf("User[%s] Login rejected. Account is disabled.", userID)
+	}
 	if err != nil {
 		c.Echo().Logger.Debugf("User[%s] Login Error. [%s]", userID, err)
 		msg := "The user ID or password is incorrect."
 		data := map[string]string{"user_id": userID, "password": "", "msg": msg}
 		return c.Render(http.StatusOK, "login", data)
 	}
-	isAdmin, err := CheckRoleByUserID(userID, model.RoleAdmin)
+	mustChange, err := PasswordChangeRequiredByUserID(c.Request().Context(), currentRealm(c).Name, userID)
+	if err != nil {
+		c.Echo().Logger.Debugf("User[%s] Password expiration Check Error. [%s]", userID, err)
+	}
+	if mustChange {
+		c.Echo().Logger.Debugf("User must change password. [%s]", userID)
+		return c.Redirect(http.StatusSeeOther, realmPath(c, "/users/"+userID+"/password"))
+	}
+	isAdmin, err := CheckPermissionByUserID(c.Request().Context(), currentRealm(c).Name, userID, model.PermissionAdminAccess)
 	if err != nil {
 		c.Echo().Logger.Debugf("Admin Role Check Error. [%s]", userID, err)
 		isAdmin = false
 	}
 	if isAdmin {
 		c.Echo().Logger.Debugf("User is Admin. [%s]", userID)
-		return c.Redirect(http.StatusTemporaryRedirect, "/admin")
+		return c.Redirect(http.StatusTemporaryRedirect, realmPath(c, "/admin"))
 	}
-	return c.Redirect(http.StatusTemporaryRedirect, "/users/"+userID)
+	return c.Redirect(http.StatusTemporaryRedirect, realmPath(c, "/users/"+userID))
 }
 
 func handleLogoutPost(c echo.Context) error {
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/knanao/goauth/server/audit"
+	"github.com/knanao/goauth/server/model"
+	"github.com/knanao/goauth/server/setting"
+)
+
+func TestAdminUserDeleteIsAudited(t *testing.T) {
+	e, _ := setupLDAPLogin(t)
+	hash, err := model.HashPassword("Password-1234")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob, err := userDA.Create(model.User{UserID: "bob", Password: hash, Roles: []model.Role{model.RoleUser}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest("POST", "/admin/users/"+string(bob.ID)+"/delete", nil)
+	c := e.NewContext(req, httptest.NewRecorder())
+	c.SetParamNames("id")
+	c.SetParamValues(string(bob.ID))
+	if err := handleAdminUserDeletePost(c); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := userDA.FindByUserID(setting.DefaultRealm, "bob", model.FindFirst); err != model.ErrorNotFound {
+		t.Errorf("deleted user: err = %v, want %v", err, model.ErrorNotFound)
+	}
+	data, err := ioutil.ReadFile(setting.Audit.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), `"action":"`+string(audit.ActionUserDelete)+`"`) {
+		t.Error("user deletion is not in the audit log")
+	}
+}
@@ -0,0 +1,104 @@
+package ldapauth
+
+import (
+	"crypto/hmac"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+var e *echo.Echo
+
+type cacheEntry struct {
+	verifier []byte
+	entry    Entry
+	expire   time.Time
+}
+
+type commandType int
+
+const (
+	commandGet commandType = iota // キャッシュの参照
+	commandPut                    // キャッシュへの追加
+)
+
+type command struct {
+	cmdType    commandType
+	req        []interface{}
+	responseCh chan response
+}
+
+type response struct {
+	result []interface{}
+	err    error
+}
+
+func (a *Authenticator) mainLoop() {
+	cache := make(map[string]cacheEntry)
+	defer close(a.doneCh)
+	e.Logger.Info("ldapauth.Authenticator:start")
+loop:
+	for {
+		select {
+		case cmd := <-a.commandCh:
+			switch cmd.cmdType {
+			case commandGet:
+				reqUserID, ok := cmd.req[0].(string)
+				if !ok {
+					cmd.responseCh <- response{nil, ErrorBadParameter}
+					break
+				}
+				reqVerifier, ok := cmd.req[1].([]byte)
+				if !ok {
+					cmd.responseCh <- response{nil, ErrorBadParameter}
+					break
+				}
+				x, ok := cache[reqUserID]
+				if ok && time.Now().After(x.expire) {
+					delete(cache, reqUserID)
+					ok = false
+				}
+				if !ok || !hmac.Equal(x.verifier, reqVerifier) {
+					// パスワードが異なる場合はディレクトリで確認し直す
+					cmd.responseCh <- response{[]interface{}{nil}, nil}
+					break
+				}
+				cmd.responseCh <- response{[]interface{}{x.entry}, nil}
+			case commandPut:
+				reqUserID, ok := cmd.req[0].(string)
+				if !ok {
+					cmd.responseCh <- response{nil, ErrorBadParameter}
+					break
+				}
+				reqVerifier, ok := cmd.req[1].([]byte)
+				if !ok {
+					cmd.responseCh <- response{nil, ErrorBadParameter}
+					break
+				}
+				reqEntry, ok := cmd.req[2].(Entry)
+				if !ok {
+					cmd.responseCh <- response{nil, ErrorBadParameter}
+					break
+				}
+				reqExpire, ok := cmd.req[3].(time.Time)
+				if !ok {
+					cmd.responseCh <- response{nil, ErrorBadParameter}
+					break
+				}
+				now := time.Now()
+				for k, v := range cache {
+					if now.After(v.expire) {
+						delete(cache, k)
+					}
+				}
+				cache[reqUserID] = cacheEntry{reqVerifier, reqEntry, reqExpire}
+				cmd.responseCh <- response{nil, nil}
+			default:
+				cmd.responseCh <- response{nil, ErrorInvalidCommand}
+			}
+		case <-a.stopCh:
+			break loop
+		}
+	}
+	e.Logger.Info("ldapauth.Authenticator:stop")
+}
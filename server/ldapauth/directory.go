@@ -0,0 +1,164 @@
+package ldapauth
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+
+	"github.com/go-ldap/ldap/v3"
+	"github.com/knanao/goauth/server/model"
+	"github.com/knanao/goauth/server/setting"
+)
+
+// authenticate はサービスアカウントでユーザーを検索し、ユーザーのDNでバインドし直す
+func authenticate(ctx context.Context, userID string, password string) (Entry, error) {
+	config := &setting.LDAP
+	conn, err := dial()
+	if err != nil {
+		e.Logger.Warnf("LDAP Connect Error. url[%s] [%s]", config.URL, err)
+		return Entry{}, ErrorUnavailable
+	}
+	defer conn.Close()
+	// リクエストが中断された場合は実行中の操作も打ち切る
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	if config.BindDN != "" {
+		if err := conn.Bind(config.BindDN, config.BindPassword); err != nil {
+			e.Logger.Warnf("LDAP Service Bind Error. dn[%s] [%s]", config.BindDN, err)
+			return Entry{}, ErrorUnavailable
+		}
+	}
+	attributes := []string{config.NameAttribute, config.EmailAttribute, config.GroupAttribute}
+	req := ldap.NewSearchRequest(
+		config.BaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases,
+		2, int(config.Timeout.Seconds()), false,
+		fmt.Sprintf(config.UserFilter, ldap.EscapeFilter(userID)),
+		attributes, nil,
+	)
+	result, err := conn.Search(req)
+	switch {
+	case ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchObject):
+		return Entry{}, ErrorNotFound
+	case ldap.IsErrorWithCode(err, ldap.LDAPResultSizeLimitExceeded):
+		return Entry{}, ErrorMultipleEntries
+	case err != nil:
+		if ctx.Err() != nil {
+			return Entry{}, ctx.Err()
+		}
+		e.Logger.Warnf("LDAP Search Error. [%s]", err)
+		return Entry{}, ErrorUnavailable
+	}
+	switch len(result.Entries) {
+	case 0:
+		return Entry{}, ErrorNotFound
+	case 1:
+	default:
+		return Entry{}, ErrorMultipleEntries
+	}
+	found := result.Entries[0]
+	if err := conn.Bind(found.DN, password); err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			return Entry{}, ErrorInvalidPassword
+		}
+		if ctx.Err() != nil {
+			return Entry{}, ctx.Err()
+		}
+		e.Logger.Warnf("LDAP User Bind Error. dn[%s] [%s]", found.DN, err)
+		return Entry{}, ErrorUnavailable
+	}
+	entry := Entry{
+		DN:       found.DN,
+		UserID:   userID,
+		FullName: found.GetAttributeValue(config.NameAttribute),
+		Email:    found.GetAttributeValue(config.EmailAttribute),
+		Groups:   found.GetAttributeValues(config.GroupAttribute),
+	}
+	entry.Roles = mapRoles(entry.Groups)
+	if len(entry.Roles) <= 0 {
+		return Entry{}, ErrorNoRoles
+	}
+	return entry, nil
+}
+
+func dial() (*ldap.Conn, error) {
+	config := &setting.LDAP
+	u, err := url.Parse(config.URL)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{
+		ServerName:         u.Hostname(),
+		InsecureSkipVerify: config.InsecureSkipVerify,
+	}
+	dialer := &net.Dialer{Timeout: config.Timeout}
+	conn, err := ldap.DialURL(config.URL, ldap.DialWithDialer(dialer), ldap.DialWithTLSConfig(tlsConfig))
+	if err != nil {
+		return nil, err
+	}
+	conn.SetTimeout(config.Timeout)
+	if config.StartTLS && u.Scheme == "ldap" {
+		if err := conn.StartTLS(tlsConfig); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// mapRoles はグループのDNまたはCNに対応するロールを返す
+//
+// どのグループにも一致しない場合はDefaultRolesを返す
+func mapRoles(groups []string) []model.Role {
+	config := &setting.LDAP
+	mapping := make(map[string][]string, len(config.GroupRoles))
+	for k, v := range config.GroupRoles {
+		mapping[groupKeys(k)[0]] = v
+	}
+	roles := []model.Role{}
+	seen := make(map[string]bool)
+	add := func(names []string) {
+		for _, x := range names {
+			if !seen[x] {
+				seen[x] = true
+				roles = append(roles, model.Role(x))
+			}
+		}
+	}
+	for _, group := range groups {
+		for _, key := range groupKeys(group) {
+			add(mapping[key])
+		}
+	}
+	if len(roles) <= 0 {
+		add(config.DefaultRoles)
+	}
+	return roles
+}
+
+// groupKeys はグループのDNを比較用の値に変換し、先頭のCNがあれば合わせて返す
+func groupKeys(group string) []string {
+	dn, err := ldap.ParseDN(group)
+	if err != nil {
+		return []string{strings.ToLower(group)}
+	}
+	keys := []string{strings.ToLower(dn.String())}
+	if len(dn.RDNs) > 0 {
+		for _, x := range dn.RDNs[0].Attributes {
+			if strings.EqualFold(x.Type, "cn") {
+				keys = append(keys, strings.ToLower(x.Value))
+			}
+		}
+	}
+	return keys
+}
@@ -0,0 +1,150 @@
+package ldapauth
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"time"
+
+	"github.com/knanao/goauth/server/model"
+	"github.com/knanao/goauth/server/setting"
+	"github.com/labstack/echo"
+)
+
+var (
+	ErrorBadParameter    = errors.New("Bad Parameter")
+	ErrorInvalidCommand  = errors.New("Invalid Command")
+	ErrorNotFound        = errors.New("Not found")
+	ErrorMultipleEntries = errors.New("Multiple Entries")
+	ErrorInvalidPassword = errors.New("Invalid Password")
+	ErrorNoRoles         = errors.New("No Roles")
+	ErrorUnavailable     = errors.New("Directory Unavailable")
+	ErrorStopped         = errors.New("Stopped")
+	ErrorOther           = errors.New("Other")
+)
+
+// Entry はディレクトリで認証されたユーザー
+type Entry struct {
+	DN       string
+	UserID   string // 正規化したUserID
+	FullName string
+	Email    string
+	Groups   []string // 属するグループのDN
+	Roles    []model.Role
+}
+
+// Authenticator はディレクトリでユーザーを検索し、見つかったDNとパスワードでバインドして認証する
+//
+// setting.LDAPの設定を使用する。認証に成功した結果はCacheTTLの間保持する
+type Authenticator struct {
+	stopCh    chan struct{}
+	doneCh    chan struct{} // mainLoopの終了時に閉じる
+	commandCh chan command
+
+	cacheKey []byte // キャッシュにパスワードを平文で残さないためのHMACの鍵
+}
+
+func (a *Authenticator) Start(echo *echo.Echo) error {
+	e = echo
+	a.cacheKey = make([]byte, 32)
+	if _, err := rand.Read(a.cacheKey); err != nil {
+		return err
+	}
+	a.stopCh = make(chan struct{}, 1)
+	a.doneCh = make(chan struct{})
+	a.commandCh = make(chan command, 1)
+	go a.mainLoop()
+	return nil
+}
+
+// Stop はmainLoopの終了を待って戻る。キャッシュは破棄する
+func (a *Authenticator) Stop() {
+	if a.doneCh == nil {
+		return
+	}
+	select {
+	case <-a.doneCh:
+		return
+	default:
+	}
+	a.stopCh <- struct{}{}
+	<-a.doneCh
+}
+
+// Authenticate はUserIDとパスワードをディレクトリで確認する
+//
+// ディレクトリに接続できない場合はErrorUnavailableを返す
+func (a *Authenticator) Authenticate(userID string, password string) (Entry, error) {
+	return a.AuthenticateContext(context.Background(), userID, password)
+}
+
+func (a *Authenticator) AuthenticateContext(ctx context.Context, userID string, password string) (Entry, error) {
+	if password == "" {
+		// 空のパスワードでのバインドは匿名バインドとして成功してしまう
+		return Entry{}, ErrorInvalidPassword
+	}
+	normalized, err := model.NormalizeUserID(userID)
+	if err != nil {
+		return Entry{}, ErrorNotFound
+	}
+	verifier := a.verifier(normalized, password)
+	if setting.LDAP.CacheTTL > 0 {
+		resp := a.send(ctx, commandGet, []interface{}{normalized, verifier})
+		if resp.err != nil {
+			return Entry{}, resp.err
+		}
+		if entry, ok := resp.result[0].(Entry); ok {
+			e.Logger.Debugf("LDAP User[%s] Authenticated from cache.", normalized)
+			return entry, nil
+		}
+	}
+	entry, err := authenticate(ctx, normalized, password)
+	if err != nil {
+		e.Logger.Debugf("LDAP User[%s] Authenticate Error. [%s]", normalized, err)
+		return Entry{}, err
+	}
+	if setting.LDAP.CacheTTL > 0 {
+		expire := time.Now().Add(setting.LDAP.CacheTTL)
+		a.send(ctx, commandPut, []interface{}{normalized, verifier, entry, expire})
+	}
+	return entry, nil
+}
+
+func (a *Authenticator) verifier(userID string, password string) []byte {
+	mac := hmac.New(sha256.New, a.cacheKey)
+	mac.Write([]byte(userID))
+	mac.Write([]byte{0})
+	mac.Write([]byte(password))
+	return mac.Sum(nil)
+}
+
+// send はコマンドをmainLoopに渡して応答を待つ
+func (a *Authenticator) send(ctx context.Context, cmdType commandType, req []interface{}) response {
+	if a.doneCh == nil {
+		return response{nil, ErrorStopped}
+	}
+	if err := ctx.Err(); err != nil {
+		return response{nil, err}
+	}
+	respCh := make(chan response, 1)
+	select {
+	case <-a.doneCh:
+		return response{nil, ErrorStopped}
+	case <-ctx.Done():
+		return response{nil, ctx.Err()}
+	case a.commandCh <- command{cmdType, req, respCh}:
+	}
+	select {
+	case resp := <-respCh:
+		return resp
+	case <-a.doneCh:
+		select {
+		case resp := <-respCh:
+			return resp
+		default:
+			return response{nil, ErrorStopped}
+		}
+	}
+}
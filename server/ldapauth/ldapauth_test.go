@@ -0,0 +1,263 @@
+package ldapauth
+
+import (
+	"context"
+	"io/ioutil"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/knanao/goauth/server/ldapauth/ldaptest"
+	"github.com/knanao/goauth/server/model"
+	"github.com/knanao/goauth/server/setting"
+	"github.com/labstack/echo"
+)
+
+const (
+	serviceDN = "cn=service,dc=example,dc=com"
+	aliceDN   = "uid=alice,ou=people,dc=example,dc=com"
+	adminsDN  = "cn=Admins,ou=groups,dc=example,dc=com"
+	staffDN   = "cn=staff,ou=groups,dc=example,dc=com"
+)
+
+// setupDirectory はテスト用のディレクトリとそれを使用する設定を用意する
+func setupDirectory(t *testing.T) *ldaptest.Server {
+	t.Helper()
+	server, err := ldaptest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(server.Close)
+	server.AddEntry(ldaptest.Entry{DN: serviceDN, Password: "service-secret"})
+	server.AddEntry(ldaptest.Entry{
+		DN:       aliceDN,
+		Password: "alice-secret",
+		Attributes: map[string][]string{
+			"uid":      {"alice"},
+			"cn":       {"Alice Liddell"},
+			"mail":     {"alice@example.com"},
+			"memberOf": {adminsDN, staffDN},
+		},
+	})
+	server.AddEntry(ldaptest.Entry{
+		DN:         "uid=bob,ou=people,dc=example,dc=com",
+		Password:   "bob-secret",
+		Attributes: map[string][]string{"uid": {"bob"}, "cn": {"Bob"}},
+	})
+	for _, dn := range []string{"uid=twin,ou=people,dc=example,dc=com", "uid=twin,ou=partners,dc=example,dc=com"} {
+		server.AddEntry(ldaptest.Entry{DN: dn, Password: "twin-secret", Attributes: map[string][]string{"uid": {"twin"}}})
+	}
+
+	saved := setting.LDAP
+	t.Cleanup(func() { setting.LDAP = saved })
+	setting.LDAP.URL = server.URL
+	setting.LDAP.StartTLS = false
+	setting.LDAP.BindDN = serviceDN
+	setting.LDAP.BindPassword = "service-secret"
+	setting.LDAP.BaseDN = "dc=example,dc=com"
+	setting.LDAP.UserFilter = "(uid=%s)"
+	setting.LDAP.NameAttribute = "cn"
+	setting.LDAP.EmailAttribute = "mail"
+	setting.LDAP.GroupAttribute = "memberOf"
+	setting.LDAP.GroupRoles = map[string][]string{
+		adminsDN: {"admin", "user"},
+		"staff":  {"user"},
+	}
+	setting.LDAP.DefaultRoles = []string{"guest"}
+	setting.LDAP.Timeout = 5 * time.Second
+	setting.LDAP.CacheTTL = 0
+	return server
+}
+
+func startAuthenticator(t *testing.T) *Authenticator {
+	t.Helper()
+	server := echo.New()
+	server.Logger.SetOutput(ioutil.Discard)
+	a := &Authenticator{}
+	if err := a.Start(server); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(a.Stop)
+	return a
+}
+
+func TestAuthenticateSearchThenBind(t *testing.T) {
+	server := setupDirectory(t)
+	a := startAuthenticator(t)
+
+	entry, err := a.Authenticate("Alice", "alice-secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Entry{
+		DN:       aliceDN,
+		UserID:   "alice",
+		FullName: "Alice Liddell",
+		Email:    "alice@example.com",
+		Groups:   []string{adminsDN, staffDN},
+		Roles:    []model.Role{"admin", "user"},
+	}
+	if !reflect.DeepEqual(entry, want) {
+		t.Errorf("entry = %+v, want %+v", entry, want)
+	}
+	// サービスアカウントで検索した後、見つかったDNでバインドし直す
+	if got, want := server.Binds(), []string{serviceDN, aliceDN}; !reflect.DeepEqual(got, want) {
+		t.Errorf("binds = %v, want %v", got, want)
+	}
+}
+
+func TestAuthenticateErrors(t *testing.T) {
+	server := setupDirectory(t)
+	a := startAuthenticator(t)
+
+	tests := []struct {
+		name     string
+		userID   string
+		password string
+		want     error
+	}{
+		{"wrong password", "alice", "wrong", ErrorInvalidPassword},
+		{"empty password", "alice", "", ErrorInvalidPassword},
+		{"unknown user", "carol", "carol-secret", ErrorNotFound},
+		{"filter injection", "*", "alice-secret", ErrorNotFound},
+		{"multiple entries", "twin", "twin-secret", ErrorMultipleEntries},
+	}
+	for _, x := range tests {
+		if _, err := a.Authenticate(x.userID, x.password); err != x.want {
+			t.Errorf("%s: err = %v, want %v", x.name, err, x.want)
+		}
+	}
+
+	setting.LDAP.BindPassword = "wrong"
+	if _, err := a.Authenticate("alice", "alice-secret"); err != ErrorUnavailable {
+		t.Errorf("service bind failure: err = %v, want %v", err, ErrorUnavailable)
+	}
+	setting.LDAP.BindPassword = "service-secret"
+
+	server.Close()
+	if _, err := a.Authenticate("alice", "alice-secret"); err != ErrorUnavailable {
+		t.Errorf("directory down: err = %v, want %v", err, ErrorUnavailable)
+	}
+}
+
+func TestAuthenticateDefaultRoles(t *testing.T) {
+	setupDirectory(t)
+	a := startAuthenticator(t)
+
+	entry, err := a.Authenticate("bob", "bob-secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []model.Role{"guest"}; !reflect.DeepEqual(entry.Roles, want) {
+		t.Errorf("roles = %v, want %v", entry.Roles, want)
+	}
+	setting.LDAP.DefaultRoles = nil
+	if _, err := a.Authenticate("bob", "bob-secret"); err != ErrorNoRoles {
+		t.Errorf("err = %v, want %v", err, ErrorNoRoles)
+	}
+}
+
+func TestMapRoles(t *testing.T) {
+	saved := setting.LDAP
+	defer func() { setting.LDAP = saved }()
+	setting.LDAP.GroupRoles = map[string][]string{
+		"CN=Admins,OU=Groups,DC=example,DC=com": {"admin", "user"},
+		"Staff":                                 {"user"},
+		"auditors":                              {"auditor"},
+	}
+	setting.LDAP.DefaultRoles = []string{"guest"}
+
+	tests := []struct {
+		name   string
+		groups []string
+		want   []model.Role
+	}{
+		{"dn match ignores case and spacing", []string{"cn=admins, ou=groups, dc=example, dc=com"}, []model.Role{"admin", "user"}},
+		{"cn match", []string{"cn=staff,ou=groups,dc=example,dc=com"}, []model.Role{"user"}},
+		{"cn match in another tree", []string{"cn=Auditors,ou=legacy,dc=example,dc=org"}, []model.Role{"auditor"}},
+		{"roles are not duplicated", []string{adminsDN, staffDN}, []model.Role{"admin", "user"}},
+		{"order follows groups", []string{"cn=auditors,dc=example,dc=com", staffDN}, []model.Role{"auditor", "user"}},
+		{"no match uses default", []string{"cn=others,dc=example,dc=com"}, []model.Role{"guest"}},
+		{"no groups uses default", nil, []model.Role{"guest"}},
+	}
+	for _, x := range tests {
+		if got := mapRoles(x.groups); !reflect.DeepEqual(got, x.want) {
+			t.Errorf("%s: mapRoles(%v) = %v, want %v", x.name, x.groups, got, x.want)
+		}
+	}
+
+	setting.LDAP.DefaultRoles = nil
+	if got := mapRoles([]string{"cn=others,dc=example,dc=com"}); len(got) != 0 {
+		t.Errorf("mapRoles without default = %v, want empty", got)
+	}
+}
+
+func TestAuthenticateCache(t *testing.T) {
+	server := setupDirectory(t)
+	setting.LDAP.CacheTTL = time.Minute
+	a := startAuthenticator(t)
+
+	if _, err := a.Authenticate("alice", "alice-secret"); err != nil {
+		t.Fatal(err)
+	}
+	binds := len(server.Binds())
+
+	// 同じパスワードはディレクトリに問い合わせない
+	entry, err := a.Authenticate("ALICE", "alice-secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry.DN != aliceDN {
+		t.Errorf("cached entry DN = %q, want %q", entry.DN, aliceDN)
+	}
+	if got := len(server.Binds()); got != binds {
+		t.Errorf("cache hit bound %d times", got-binds)
+	}
+
+	// 異なるパスワードはキャッシュを使わずにディレクトリで確認する
+	if _, err := a.Authenticate("alice", "wrong"); err != ErrorInvalidPassword {
+		t.Errorf("cache miss with wrong password: err = %v, want %v", err, ErrorInvalidPassword)
+	}
+	if got := len(server.Binds()); got == binds {
+		t.Error("wrong password was answered from the cache")
+	}
+}
+
+func TestAuthenticateCacheRejectsTamperedVerifier(t *testing.T) {
+	server := setupDirectory(t)
+	setting.LDAP.CacheTTL = time.Minute
+	a := startAuthenticator(t)
+
+	if _, err := a.Authenticate("alice", "alice-secret"); err != nil {
+		t.Fatal(err)
+	}
+	// 鍵が変わると保存したHMACと一致しなくなる
+	a.cacheKey[0] ^= 0xff
+	server.Close()
+	if _, err := a.Authenticate("alice", "alice-secret"); err != ErrorUnavailable {
+		t.Errorf("tampered verifier: err = %v, want %v", err, ErrorUnavailable)
+	}
+
+	// 書き換えた検証値をそのまま受け入れない
+	forged := a.verifier("alice", "forged")
+	forged[0] ^= 0xff
+	a.send(context.Background(), commandPut, []interface{}{"alice", forged, Entry{DN: aliceDN}, time.Now().Add(time.Minute)})
+	if _, err := a.Authenticate("alice", "forged"); err != ErrorUnavailable {
+		t.Errorf("forged verifier: err = %v, want %v", err, ErrorUnavailable)
+	}
+}
+
+func TestAuthenticateCacheExpires(t *testing.T) {
+	server := setupDirectory(t)
+	setting.LDAP.CacheTTL = 10 * time.Millisecond
+	a := startAuthenticator(t)
+
+	if _, err := a.Authenticate("alice", "alice-secret"); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	server.Close()
+	if _, err := a.Authenticate("alice", "alice-secret"); err != ErrorUnavailable {
+		t.Errorf("expired cache: err = %v, want %v", err, ErrorUnavailable)
+	}
+}
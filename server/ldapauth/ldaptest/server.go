@@ -0,0 +1,238 @@
+// Package ldaptest はテストのためにプロセス内で動かすLDAPサーバーを提供する
+package ldaptest
+
+import (
+	"net"
+	"strings"
+	"sync"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+)
+
+// Entry はディレクトリのエントリ
+type Entry struct {
+	DN         string
+	Password   string // 空の場合はバインドできない
+	Attributes map[string][]string
+}
+
+// Server は単純なバインドと等価のフィルターによる検索のみに対応するLDAPサーバー
+//
+// 検索は認証したかどうかにかかわらず許可する
+type Server struct {
+	URL string
+
+	listener net.Listener
+	wg       sync.WaitGroup
+
+	mu      sync.Mutex
+	entries []Entry
+	conns   map[net.Conn]struct{}
+	binds   []string // バインドを要求されたDN
+	closed  bool
+}
+
+// NewServer はローカルのポートで待ち受けるServerを起動する
+func NewServer() (*Server, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{
+		URL:      "ldap://" + listener.Addr().String(),
+		listener: listener,
+		conns:    make(map[net.Conn]struct{}),
+	}
+	s.wg.Add(1)
+	go s.serve()
+	return s, nil
+}
+
+// AddEntry はエントリを追加する
+func (s *Server) AddEntry(entry Entry) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.entries = append(s.entries, entry)
+}
+
+// Binds はこれまでにバインドを要求されたDNを順に返す
+func (s *Server) Binds() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.binds...)
+}
+
+// Close は待ち受けを止め、接続中のクライアントを切断する
+func (s *Server) Close() {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return
+	}
+	s.closed = true
+	s.listener.Close()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+}
+
+func (s *Server) serve() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			conn.Close()
+			return
+		}
+		s.conns[conn] = struct{}{}
+		s.mu.Unlock()
+		s.wg.Add(1)
+		go s.handle(conn)
+	}
+}
+
+func (s *Server) handle(conn net.Conn) {
+	defer s.wg.Done()
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		conn.Close()
+	}()
+	for {
+		packet, err := ber.ReadPacket(conn)
+		if err != nil || len(packet.Children) < 2 {
+			return
+		}
+		messageID, ok := packet.Children[0].Value.(int64)
+		if !ok {
+			return
+		}
+		op := packet.Children[1]
+		switch op.Tag {
+		case ldap.ApplicationBindRequest:
+			code := s.bind(op)
+			if _, err := conn.Write(result(messageID, ldap.ApplicationBindResponse, code).Bytes()); err != nil {
+				return
+			}
+		case ldap.ApplicationSearchRequest:
+			if err := s.search(conn, messageID, op); err != nil {
+				return
+			}
+		default:
+			// UnbindRequestなどは接続を閉じる
+			return
+		}
+	}
+}
+
+func (s *Server) bind(op *ber.Packet) uint16 {
+	if len(op.Children) < 3 {
+		return ldap.LDAPResultProtocolError
+	}
+	dn := op.Children[1].Data.String()
+	password := op.Children[2].Data.String()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.binds = append(s.binds, dn)
+	if dn == "" && password == "" {
+		return ldap.LDAPResultSuccess
+	}
+	for _, x := range s.entries {
+		if strings.EqualFold(x.DN, dn) && x.Password != "" && x.Password == password {
+			return ldap.LDAPResultSuccess
+		}
+	}
+	return ldap.LDAPResultInvalidCredentials
+}
+
+func (s *Server) search(conn net.Conn, messageID int64, op *ber.Packet) error {
+	if len(op.Children) < 7 {
+		_, err := conn.Write(result(messageID, ldap.ApplicationSearchResultDone, ldap.LDAPResultProtocolError).Bytes())
+		return err
+	}
+	baseDN := strings.ToLower(op.Children[0].Data.String())
+	sizeLimit, _ := op.Children[3].Value.(int64)
+	filter := op.Children[6]
+	var found []Entry
+	s.mu.Lock()
+	for _, x := range s.entries {
+		if strings.HasSuffix(strings.ToLower(x.DN), baseDN) && matchFilter(filter, x) {
+			found = append(found, x)
+		}
+	}
+	s.mu.Unlock()
+	code := uint16(ldap.LDAPResultSuccess)
+	if sizeLimit > 0 && int64(len(found)) > sizeLimit {
+		found = found[:sizeLimit]
+		code = ldap.LDAPResultSizeLimitExceeded
+	}
+	for _, x := range found {
+		if _, err := conn.Write(searchEntry(messageID, x).Bytes()); err != nil {
+			return err
+		}
+	}
+	_, err := conn.Write(result(messageID, ldap.ApplicationSearchResultDone, code).Bytes())
+	return err
+}
+
+// matchFilter は等価のフィルターに一致するかを返す。それ以外のフィルターには一致しない
+func matchFilter(filter *ber.Packet, entry Entry) bool {
+	if filter.ClassType != ber.ClassContext || filter.Tag != ldap.FilterEqualityMatch || len(filter.Children) != 2 {
+		return false
+	}
+	name := filter.Children[0].Data.String()
+	value := filter.Children[1].Data.String()
+	for k, values := range entry.Attributes {
+		if !strings.EqualFold(k, name) {
+			continue
+		}
+		for _, v := range values {
+			if strings.EqualFold(v, value) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func envelope(messageID int64, op *ber.Packet) *ber.Packet {
+	packet := ber.NewSequence("LDAP Response")
+	packet.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, messageID, "Message ID"))
+	packet.AppendChild(op)
+	return packet
+}
+
+func result(messageID int64, tag ber.Tag, code uint16) *ber.Packet {
+	op := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "Result")
+	op.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, int64(code), "Result Code"))
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "Matched DN"))
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "Diagnostic Message"))
+	return envelope(messageID, op)
+}
+
+func searchEntry(messageID int64, entry Entry) *ber.Packet {
+	op := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationSearchResultEntry, nil, "Search Result Entry")
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, entry.DN, "Object Name"))
+	attributes := ber.NewSequence("Attributes")
+	for k, values := range entry.Attributes {
+		attribute := ber.NewSequence("Attribute")
+		attribute.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, k, "Type"))
+		set := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "Values")
+		for _, v := range values {
+			set.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, v, "Value"))
+		}
+		attribute.AppendChild(set)
+		attributes.AppendChild(attribute)
+	}
+	op.AppendChild(attributes)
+	return envelope(messageID, op)
+}
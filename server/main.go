@@ -8,6 +8,8 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/knanao/goauth/server/audit"
+	"github.com/knanao/goauth/server/ldapauth"
 	"github.com/knanao/goauth/server/model"
 	"github.com/knanao/goauth/server/session"
 	"github.com/knanao/goauth/server/setting"
@@ -20,6 +22,9 @@ var (
 	templates      map[string]*template.Template
 	sessionManager *session.Manager
 	userDA         *model.UserDataAccessor
+	rbac           *model.RBAC
+	auditLog       *audit.Logger
+	ldapAuth       *ldapauth.Authenticator // LDAPを使用しない場合はnil
 )
 
 func main() {
@@ -32,14 +37,44 @@ func main() {
 	e.Use(middleware.Logger())
 	e.Use(middleware.Recover())
 
+	if err := setting.LoadRealms(); err != nil {
+		e.Logger.Fatal(err)
+	}
+	if err := setting.LoadLDAP(); err != nil {
+		e.Logger.Fatal(err)
+	}
+
 	setStaticRoute(e)
 	setRoute(e)
 
+	auditLog = &audit.Logger{}
+	if err := auditLog.Start(e); err != nil {
+		e.Logger.Fatal(err)
+	}
+
 	sessionManager = &session.Manager{}
-	sessionManager.Start(e)
+	if err := sessionManager.Start(e); err != nil {
+		e.Logger.Fatal(err)
+	}
 
-	userDA = &model.UserDataAccessor{}
-	userDA.Start(e)
+	var err error
+	rbac, err = model.LoadRBAC(setting.RBAC.Path)
+	if err != nil {
+		e.Logger.Fatal(err)
+	}
+
+	userDA = &model.UserDataAccessor{RBAC: rbac}
+	if err := userDA.Start(e); err != nil {
+		e.Logger.Fatal(err)
+	}
+	go watchUsers(e)
+
+	if setting.LDAP.Enabled {
+		ldapAuth = &ldapauth.Authenticator{}
+		if err := ldapAuth.Start(e); err != nil {
+			e.Logger.Fatal(err)
+		}
+	}
 
 	go func() {
 		if err := e.Start(setting.Server.Port); err != nil {
@@ -57,10 +92,16 @@ func main() {
 		e.Close()
 	}
 
+	if ldapAuth != nil {
+		ldapAuth.Stop()
+	}
+
 	userDA.Stop()
 
 	sessionManager.Stop()
 
+	auditLog.Stop()
+
 	time.Sleep(1 * time.Second)
 }
 
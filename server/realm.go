@@ -0,0 +1,47 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/knanao/goauth/server/session"
+	"github.com/knanao/goauth/server/setting"
+	"github.com/labstack/echo"
+)
+
+// realmBaseKey はレルムのルートのパス(/realms/:realm以下の場合)を保持するキー
+const realmBaseKey = "realm_base"
+
+// MiddlewareRealm はリクエストのレルムを決定する
+//
+// /realms/:realm以下のルートはパスのレルムを、それ以外はHostヘッダーに対応するレルムを使用する
+func MiddlewareRealm(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		realm := setting.RealmByHost(c.Request().Host)
+		if name := c.Param("realm"); name != "" {
+			config, ok := setting.LookupRealm(name)
+			if !ok {
+				return c.Render(http.StatusNotFound, "error", "Unknown realm.")
+			}
+			realm = config
+			c.Set(realmBaseKey, "/realms/"+realm.Name)
+		}
+		c.Set(session.RealmContextKey, realm)
+		return next(c)
+	}
+}
+
+// currentRealm はリクエストのレルムを返す
+func currentRealm(c echo.Context) *setting.RealmConfig {
+	if realm, ok := c.Get(session.RealmContextKey).(*setting.RealmConfig); ok {
+		return realm
+	}
+	return setting.RealmFor("")
+}
+
+// realmPath はリクエストのレルムのルートを基準にしたパスを返す
+func realmPath(c echo.Context, path string) string {
+	if base, ok := c.Get(realmBaseKey).(string); ok {
+		return base + path
+	}
+	return path
+}
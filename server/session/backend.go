@@ -0,0 +1,72 @@
+package session
+
+import (
+	"errors"
+	"time"
+
+	"github.com/knanao/goauth/server/setting"
+)
+
+var ErrorUnknownBackend = errors.New("Unknown Backend")
+
+// Record はバックエンドに保存するセッションの内容
+type Record struct {
+	Store    Store
+	Expire   time.Time
+	Lifetime time.Duration // 読み書きのたびに延長する期間
+}
+
+// Backend はセッションの保存先
+//
+// Managerはコマンドを直列に実行するが、複数のサーバーで共有するバックエンドでは
+// SaveのConsistencyTokenの比較と置き換えをバックエンド側で不可分に行う
+type Backend interface {
+	// Create は新しいセッションを保存する
+	Create(id ID, rec Record) error
+	// Load はセッションを返す。存在しない場合や期限切れの場合はErrorNotFoundを返す
+	Load(id ID, now time.Time) (Record, error)
+	// Touch はセッションの有効期限を変更する
+	Touch(id ID, expire time.Time) error
+	// Save は保存されているConsistencyTokenがtokenと一致する場合のみrecで置き換える
+	//
+	// 一致しない場合はErrorInvalidToken、存在しない場合や期限切れの場合はErrorNotFoundを返す
+	Save(id ID, token string, rec Record, now time.Time) error
+	// Delete はセッションを削除する。存在しない場合や期限切れの場合はErrorNotFoundを返す
+	Delete(id ID, now time.Time) error
+	// DeleteByData はデータがmatchのすべての値と一致するセッションを削除し、件数を返す
+	DeleteByData(match map[string]string) (int, error)
+	// DeleteExpired は期限切れのセッションを削除し、件数を返す
+	DeleteExpired(now time.Time) (int, error)
+	Close() error
+}
+
+const (
+	BackendMemory = "memory"
+	BackendFile   = "file"
+	BackendSQL    = "sql"
+	BackendRedis  = "redis"
+)
+
+// NewBackend は設定に応じたBackendを作成する
+func NewBackend() (Backend, error) {
+	switch setting.Session.Backend {
+	case BackendMemory, "":
+		return NewMemoryBackend(), nil
+	case BackendFile:
+		return NewFileBackend(setting.Session.Dir)
+	case BackendSQL:
+		return NewSQLBackend(setting.Session.SQLDriver, setting.Session.SQLDSN)
+	case BackendRedis:
+		return NewRedisBackend(setting.Session.RedisURL, setting.Session.RedisPrefix)
+	}
+	return nil, ErrorUnknownBackend
+}
+
+// copyStore はデータのマップを複製したStoreを返す
+func copyStore(s Store) Store {
+	data := make(map[string]string, len(s.Data))
+	for k, v := range s.Data {
+		data[k] = v
+	}
+	return Store{Data: data, ConsistencyToken: s.ConsistencyToken}
+}
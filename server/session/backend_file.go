@@ -0,0 +1,250 @@
+package session
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/knanao/goauth/server/internal/fileutil"
+)
+
+// FileBackend はセッションを1件ずつJSONファイルとしてディレクトリに保存する
+//
+// 同じディレクトリを共有する複数のプロセスから使用できるように、
+// 読み書きの間はセッションごとのロックファイルを作成する
+type FileBackend struct {
+	dir string
+}
+
+const (
+	fileSuffix     = ".json"
+	lockSuffix     = ".lock"
+	lockRetry      = 10 * time.Millisecond
+	lockTimeout    = 5 * time.Second
+	lockStaleAfter = 10 * time.Second // これより古いロックは異常終了したプロセスのものとして削除する
+)
+
+type fileRecord struct {
+	Data             map[string]string `json:"data"`
+	ConsistencyToken string            `json:"consistency_token"`
+	Expire           time.Time         `json:"expire"`
+	Lifetime         time.Duration     `json:"lifetime"`
+}
+
+func NewFileBackend(dir string) (*FileBackend, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &FileBackend{dir: dir}, nil
+}
+
+// path はセッションのファイル名を返す。ディレクトリの外を指すIDはErrorBadParameterとする
+func (b *FileBackend) path(id ID) (string, error) {
+	if id == "" {
+		return "", ErrorBadParameter
+	}
+	for _, c := range id {
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '-') {
+			return "", ErrorBadParameter
+		}
+	}
+	return filepath.Join(b.dir, string(id)+fileSuffix), nil
+}
+
+// lock はセッションのロックファイルを作成し、解放する関数を返す
+func (b *FileBackend) lock(path string) (func(), error) {
+	name := path + lockSuffix
+	deadline := time.Now().Add(lockTimeout)
+	for {
+		f, err := os.OpenFile(name, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if err == nil {
+			f.Close()
+			return func() { os.Remove(name) }, nil
+		}
+		if !os.IsExist(err) {
+			return nil, err
+		}
+		if fi, err := os.Stat(name); err == nil && time.Since(fi.ModTime()) > lockStaleAfter {
+			os.Remove(name)
+			continue
+		}
+		if time.Now().After(deadline) {
+			return nil, ErrorOther
+		}
+		time.Sleep(lockRetry)
+	}
+}
+
+func (b *FileBackend) read(path string) (Record, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return Record{}, ErrorNotFound
+	}
+	if err != nil {
+		return Record{}, err
+	}
+	var x fileRecord
+	if err := json.Unmarshal(data, &x); err != nil {
+		return Record{}, err
+	}
+	if x.Data == nil {
+		x.Data = make(map[string]string)
+	}
+	return Record{
+		Store:    Store{Data: x.Data, ConsistencyToken: x.ConsistencyToken},
+		Expire:   x.Expire,
+		Lifetime: x.Lifetime,
+	}, nil
+}
+
+func (b *FileBackend) write(path string, rec Record) error {
+	data, err := json.Marshal(fileRecord{
+		Data:             rec.Store.Data,
+		ConsistencyToken: rec.Store.ConsistencyToken,
+		Expire:           rec.Expire,
+		Lifetime:         rec.Lifetime,
+	})
+	if err != nil {
+		return err
+	}
+	return fileutil.WriteAtomic(path, data, 0600)
+}
+
+func (b *FileBackend) Create(id ID, rec Record) error {
+	path, err := b.path(id)
+	if err != nil {
+		return err
+	}
+	unlock, err := b.lock(path)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return b.write(path, rec)
+}
+
+func (b *FileBackend) Load(id ID, now time.Time) (Record, error) {
+	path, err := b.path(id)
+	if err != nil {
+		return Record{}, ErrorNotFound
+	}
+	rec, err := b.read(path)
+	if err != nil {
+		return Record{}, err
+	}
+	if now.After(rec.Expire) {
+		return Record{}, ErrorNotFound
+	}
+	return rec, nil
+}
+
+func (b *FileBackend) Touch(id ID, expire time.Time) error {
+	path, err := b.path(id)
+	if err != nil {
+		return ErrorNotFound
+	}
+	unlock, err := b.lock(path)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	rec, err := b.read(path)
+	if err != nil {
+		return err
+	}
+	rec.Expire = expire
+	return b.write(path, rec)
+}
+
+func (b *FileBackend) Save(id ID, token string, rec Record, now time.Time) error {
+	path, err := b.path(id)
+	if err != nil {
+		return ErrorNotFound
+	}
+	unlock, err := b.lock(path)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	old, err := b.read(path)
+	if err != nil {
+		return err
+	}
+	if now.After(old.Expire) {
+		return ErrorNotFound
+	}
+	if old.Store.ConsistencyToken != token {
+		return ErrorInvalidToken
+	}
+	return b.write(path, rec)
+}
+
+func (b *FileBackend) Delete(id ID, now time.Time) error {
+	path, err := b.path(id)
+	if err != nil {
+		return ErrorNotFound
+	}
+	unlock, err := b.lock(path)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	rec, err := b.read(path)
+	if err != nil {
+		return err
+	}
+	if now.After(rec.Expire) {
+		return ErrorNotFound
+	}
+	return os.Remove(path)
+}
+
+// deleteIf は条件に一致するセッションをロックを取得して確認し直してから削除する
+func (b *FileBackend) deleteIf(cond func(rec Record) bool) (int, error) {
+	files, err := ioutil.ReadDir(b.dir)
+	if err != nil {
+		return 0, err
+	}
+	deleted := 0
+	for _, fi := range files {
+		name := fi.Name()
+		if fi.IsDir() || strings.HasPrefix(name, ".") || !strings.HasSuffix(name, fileSuffix) {
+			continue
+		}
+		path := filepath.Join(b.dir, name)
+		rec, err := b.read(path)
+		if err != nil || !cond(rec) {
+			continue
+		}
+		unlock, err := b.lock(path)
+		if err != nil {
+			return deleted, err
+		}
+		if rec, err := b.read(path); err == nil && cond(rec) {
+			if err := os.Remove(path); err == nil {
+				deleted++
+			}
+		}
+		unlock()
+	}
+	return deleted, nil
+}
+
+func (b *FileBackend) DeleteByData(match map[string]string) (int, error) {
+	return b.deleteIf(func(rec Record) bool {
+		return matchData(rec.Store.Data, match)
+	})
+}
+
+func (b *FileBackend) DeleteExpired(now time.Time) (int, error) {
+	return b.deleteIf(func(rec Record) bool {
+		return now.After(rec.Expire)
+	})
+}
+
+func (b *FileBackend) Close() error {
+	return nil
+}
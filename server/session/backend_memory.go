@@ -0,0 +1,114 @@
+package session
+
+import (
+	"time"
+)
+
+// MemoryBackend はセッションをメモリ上に保持する。再起動するとセッションは失われる
+//
+// Managerのループからのみ呼び出されるため排他制御は行わない
+type MemoryBackend struct {
+	sessions map[ID]Record
+}
+
+func NewMemoryBackend() *MemoryBackend {
+	return &MemoryBackend{sessions: make(map[ID]Record)}
+}
+
+func (b *MemoryBackend) Create(id ID, rec Record) error {
+	rec.Store = copyStore(rec.Store)
+	b.sessions[id] = rec
+	return nil
+}
+
+func (b *MemoryBackend) Load(id ID, now time.Time) (Record, error) {
+	rec, ok := b.sessions[id]
+	if !ok || now.After(rec.Expire) {
+		return Record{}, ErrorNotFound
+	}
+	rec.Store = copyStore(rec.Store)
+	return rec, nil
+}
+
+func (b *MemoryBackend) Touch(id ID, expire time.Time) error {
+	rec, ok := b.sessions[id]
+	if !ok {
+		return ErrorNotFound
+	}
+	rec.Expire = expire
+	b.sessions[id] = rec
+	return nil
+}
+
+func (b *MemoryBackend) Save(id ID, token string, rec Record, now time.Time) error {
+	old, ok := b.sessions[id]
+	if !ok || now.After(old.Expire) {
+		return ErrorNotFound
+	}
+	if old.Store.ConsistencyToken != token {
+		return ErrorInvalidToken
+	}
+	rec.Store = copyStore(rec.Store)
+	b.sessions[id] = rec
+	return nil
+}
+
+func (b *MemoryBackend) Delete(id ID, now time.Time) error {
+	rec, ok := b.sessions[id]
+	if !ok || now.After(rec.Expire) {
+		return ErrorNotFound
+	}
+	delete(b.sessions, id)
+	return nil
+}
+
+func (b *MemoryBackend) DeleteByData(match map[string]string) (int, error) {
+	deleted := 0
+	for k, v := range b.sessions {
+		if matchData(v.Store.Data, match) {
+			delete(b.sessions, k)
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
+func (b *MemoryBackend) DeleteExpired(now time.Time) (int, error) {
+	deleted := 0
+	for k, v := range b.sessions {
+		if now.After(v.Expire) {
+			delete(b.sessions, k)
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
+func (b *MemoryBackend) Close() error {
+	return nil
+}
+
+func (b *MemoryBackend) Snapshot(now time.Time) map[ID]Record {
+	records := make(map[ID]Record)
+	for k, v := range b.sessions {
+		if now.After(v.Expire) {
+			continue
+		}
+		v.Store = copyStore(v.Store)
+		records[k] = v
+	}
+	return records
+}
+
+func (b *MemoryBackend) Restore(records map[ID]Record) int {
+	restored := 0
+	for k, v := range records {
+		if _, ok := b.sessions[k]; ok {
+			continue
+		}
+		v.Store = copyStore(v.Store)
+		b.sessions[k] = v
+		restored++
+	}
+	return restored
+}
@@ -0,0 +1,229 @@
+package session
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// RedisBackend はセッションをRedisのハッシュとして保存する
+//
+// キーの有効期限をセッションの有効期限に合わせるため、期限切れのセッションはRedisが削除する。
+// トークンの比較と更新はLuaスクリプトで不可分に行う
+type RedisBackend struct {
+	client *redis.Client
+	prefix string
+}
+
+const redisTimeout = 5 * time.Second
+
+func NewRedisBackend(url string, prefix string) (*RedisBackend, error) {
+	opt, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, err
+	}
+	client := redis.NewClient(opt)
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	if err := client.Ping(ctx).Err(); err != nil {
+		client.Close()
+		return nil, err
+	}
+	return &RedisBackend{client: client, prefix: prefix}, nil
+}
+
+func (b *RedisBackend) key(id ID) string {
+	return b.prefix + string(id)
+}
+
+// 有効期限はPEXPIREATに合わせてUnix時間(ミリ秒)で保存する
+func unixMilli(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+func (b *RedisBackend) Create(id ID, rec Record) error {
+	data, err := json.Marshal(rec.Store.Data)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	key := b.key(id)
+	_, err = b.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, key,
+			"token", rec.Store.ConsistencyToken,
+			"data", string(data),
+			"lifetime", int64(rec.Lifetime),
+			"expire", unixMilli(rec.Expire))
+		pipe.PExpireAt(ctx, key, rec.Expire)
+		return nil
+	})
+	return err
+}
+
+func (b *RedisBackend) Load(id ID, now time.Time) (Record, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	values, err := b.client.HGetAll(ctx, b.key(id)).Result()
+	if err != nil {
+		return Record{}, err
+	}
+	if len(values) <= 0 {
+		return Record{}, ErrorNotFound
+	}
+	lifetime, err := strconv.ParseInt(values["lifetime"], 10, 64)
+	if err != nil {
+		return Record{}, err
+	}
+	expire, err := strconv.ParseInt(values["expire"], 10, 64)
+	if err != nil {
+		return Record{}, err
+	}
+	rec := Record{
+		Expire:   time.Unix(0, expire*int64(time.Millisecond)),
+		Lifetime: time.Duration(lifetime),
+	}
+	if now.After(rec.Expire) {
+		return Record{}, ErrorNotFound
+	}
+	sessionData := make(map[string]string)
+	if err := json.Unmarshal([]byte(values["data"]), &sessionData); err != nil {
+		return Record{}, err
+	}
+	rec.Store = Store{Data: sessionData, ConsistencyToken: values["token"]}
+	return rec, nil
+}
+
+var redisTouchScript = redis.NewScript(`
+if redis.call('EXISTS', KEYS[1]) == 0 then
+	return 0
+end
+redis.call('HSET', KEYS[1], 'expire', ARGV[1])
+redis.call('PEXPIREAT', KEYS[1], ARGV[1])
+return 1
+`)
+
+func (b *RedisBackend) Touch(id ID, expire time.Time) error {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	n, err := redisTouchScript.Run(ctx, b.client, []string{b.key(id)}, unixMilli(expire)).Int()
+	if err != nil {
+		return err
+	}
+	if n <= 0 {
+		return ErrorNotFound
+	}
+	return nil
+}
+
+// redisSaveScript は存在しない場合や期限切れの場合は0、トークンが一致しない場合は-1を返す
+var redisSaveScript = redis.NewScript(`
+local values = redis.call('HMGET', KEYS[1], 'token', 'expire')
+if not values[1] or tonumber(values[2]) < tonumber(ARGV[6]) then
+	return 0
+end
+if values[1] ~= ARGV[1] then
+	return -1
+end
+redis.call('HSET', KEYS[1], 'token', ARGV[2], 'data', ARGV[3], 'lifetime', ARGV[4], 'expire', ARGV[5])
+redis.call('PEXPIREAT', KEYS[1], ARGV[5])
+return 1
+`)
+
+func (b *RedisBackend) Save(id ID, token string, rec Record, now time.Time) error {
+	data, err := json.Marshal(rec.Store.Data)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	n, err := redisSaveScript.Run(ctx, b.client, []string{b.key(id)},
+		token, rec.Store.ConsistencyToken, string(data), int64(rec.Lifetime),
+		unixMilli(rec.Expire), unixMilli(now)).Int()
+	if err != nil {
+		return err
+	}
+	switch {
+	case n == 0:
+		return ErrorNotFound
+	case n < 0:
+		return ErrorInvalidToken
+	}
+	return nil
+}
+
+var redisDeleteScript = redis.NewScript(`
+local expire = redis.call('HGET', KEYS[1], 'expire')
+if not expire or tonumber(expire) < tonumber(ARGV[1]) then
+	return 0
+end
+return redis.call('DEL', KEYS[1])
+`)
+
+func (b *RedisBackend) Delete(id ID, now time.Time) error {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	n, err := redisDeleteScript.Run(ctx, b.client, []string{b.key(id)}, unixMilli(now)).Int()
+	if err != nil {
+		return err
+	}
+	if n <= 0 {
+		return ErrorNotFound
+	}
+	return nil
+}
+
+// redisDeleteByDataScript はデータがARGV[1]のJSONのすべての値と一致する場合に削除する
+//
+// 一致の確認と削除を不可分に行うため、トークンが変わっただけのセッションも削除される
+var redisDeleteByDataScript = redis.NewScript(`
+local data = redis.call('HGET', KEYS[1], 'data')
+if not data then
+	return 0
+end
+local ok, session = pcall(cjson.decode, data)
+if not ok or type(session) ~= 'table' then
+	return 0
+end
+for k, v in pairs(cjson.decode(ARGV[1])) do
+	if session[k] ~= v then
+		return 0
+	end
+end
+return redis.call('DEL', KEYS[1])
+`)
+
+// redisScanTimeout はDeleteByDataでキーを走査して削除するまでの時間の上限
+const redisScanTimeout = 1 * time.Minute
+
+// DeleteByData は接頭辞に一致するキーをSCANで走査する
+func (b *RedisBackend) DeleteByData(match map[string]string) (int, error) {
+	arg, err := json.Marshal(match)
+	if err != nil {
+		return 0, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), redisScanTimeout)
+	defer cancel()
+	deleted := 0
+	iter := b.client.Scan(ctx, 0, b.prefix+"*", 100).Iterator()
+	for iter.Next(ctx) {
+		n, err := redisDeleteByDataScript.Run(ctx, b.client, []string{iter.Val()}, string(arg)).Int()
+		if err != nil {
+			return deleted, err
+		}
+		deleted += n
+	}
+	return deleted, iter.Err()
+}
+
+// DeleteExpired は何もしない。期限切れのキーはRedisが削除する
+func (b *RedisBackend) DeleteExpired(now time.Time) (int, error) {
+	return 0, nil
+}
+
+func (b *RedisBackend) Close() error {
+	return b.client.Close()
+}
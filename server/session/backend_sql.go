@@ -0,0 +1,226 @@
+package session
+
+import (
+	"database/sql"
+	"encoding/json"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+// SQLBackend はセッションをdatabase/sqlのデータベースに保存する
+//
+// 組み込みのSQLiteのドライバーでのみ動作を確認している。スキーマの作成に
+// SQLiteの構文(CREATE INDEX IF NOT EXISTSと複数の文の一括実行)を使用するため、
+// 他のデータベースには対応していない。有効期限はUnix時間(ナノ秒)で保存する
+type SQLBackend struct {
+	db *sql.DB
+}
+
+const sqlSessionSchema = `
+CREATE TABLE IF NOT EXISTS sessions (
+	id       VARCHAR(64) PRIMARY KEY,
+	token    VARCHAR(64) NOT NULL,
+	data     TEXT NOT NULL,
+	lifetime BIGINT NOT NULL,
+	expire   BIGINT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS sessions_expire ON sessions (expire);
+`
+
+func NewSQLBackend(driver string, dsn string) (*SQLBackend, error) {
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+	if driver == "sqlite" {
+		// SQLiteは書き込みが直列化されるため接続は1本で十分
+		db.SetMaxOpenConns(1)
+	}
+	if _, err := db.Exec(sqlSessionSchema); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &SQLBackend{db}, nil
+}
+
+func (b *SQLBackend) Create(id ID, rec Record) error {
+	data, err := json.Marshal(rec.Store.Data)
+	if err != nil {
+		return err
+	}
+	_, err = b.db.Exec("INSERT INTO sessions (id, token, data, lifetime, expire) VALUES (?, ?, ?, ?, ?)",
+		string(id), rec.Store.ConsistencyToken, string(data), int64(rec.Lifetime), rec.Expire.UnixNano())
+	return err
+}
+
+func (b *SQLBackend) Load(id ID, now time.Time) (Record, error) {
+	var token, data string
+	var lifetime, expire int64
+	err := b.db.QueryRow("SELECT token, data, lifetime, expire FROM sessions WHERE id = ? AND expire >= ?",
+		string(id), now.UnixNano()).Scan(&token, &data, &lifetime, &expire)
+	if err == sql.ErrNoRows {
+		return Record{}, ErrorNotFound
+	}
+	if err != nil {
+		return Record{}, err
+	}
+	sessionData := make(map[string]string)
+	if err := json.Unmarshal([]byte(data), &sessionData); err != nil {
+		return Record{}, err
+	}
+	return Record{
+		Store:    Store{Data: sessionData, ConsistencyToken: token},
+		Expire:   time.Unix(0, expire),
+		Lifetime: time.Duration(lifetime),
+	}, nil
+}
+
+func (b *SQLBackend) Touch(id ID, expire time.Time) error {
+	res, err := b.db.Exec("UPDATE sessions SET expire = ? WHERE id = ?", expire.UnixNano(), string(id))
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n <= 0 {
+		return ErrorNotFound
+	}
+	return nil
+}
+
+// Save はトークンの比較と更新を1つのUPDATEで行う
+func (b *SQLBackend) Save(id ID, token string, rec Record, now time.Time) error {
+	data, err := json.Marshal(rec.Store.Data)
+	if err != nil {
+		return err
+	}
+	res, err := b.db.Exec("UPDATE sessions SET token = ?, data = ?, lifetime = ?, expire = ? "+
+		"WHERE id = ? AND token = ? AND expire >= ?",
+		rec.Store.ConsistencyToken, string(data), int64(rec.Lifetime), rec.Expire.UnixNano(),
+		string(id), token, now.UnixNano())
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		return nil
+	}
+	// 更新されなかった理由がトークンの不一致かどうかを確認する
+	if _, err := b.Load(id, now); err != nil {
+		return err
+	}
+	return ErrorInvalidToken
+}
+
+func (b *SQLBackend) Delete(id ID, now time.Time) error {
+	res, err := b.db.Exec("DELETE FROM sessions WHERE id = ? AND expire >= ?", string(id), now.UnixNano())
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n <= 0 {
+		return ErrorNotFound
+	}
+	return nil
+}
+
+// sqlTarget はDeleteByDataで削除するセッションと読み出した時点のデータ
+type sqlTarget struct {
+	id   string
+	data string
+}
+
+func (b *SQLBackend) DeleteByData(match map[string]string) (int, error) {
+	targets, err := b.findByData(match)
+	if err != nil {
+		return 0, err
+	}
+	deleted := 0
+	for _, x := range targets {
+		ok, err := b.deleteIfMatch(x, match)
+		if err != nil {
+			return deleted, err
+		}
+		if ok {
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
+// findByData はデータがmatchのすべての値と一致するセッションを返す
+func (b *SQLBackend) findByData(match map[string]string) ([]sqlTarget, error) {
+	rows, err := b.db.Query("SELECT id, data FROM sessions")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	targets := []sqlTarget{}
+	for rows.Next() {
+		var x sqlTarget
+		if err := rows.Scan(&x.id, &x.data); err != nil {
+			return nil, err
+		}
+		if matchJSON(x.data, match) {
+			targets = append(targets, x)
+		}
+	}
+	return targets, rows.Err()
+}
+
+// deleteIfMatch はデータがmatchと一致している場合にセッションを削除する
+//
+// 一致を確認したデータと同じ場合だけ削除する。読み出した後に更新されていた場合は
+// 読み直して確認し直すため、トークンが変わっただけのセッションも削除される
+func (b *SQLBackend) deleteIfMatch(x sqlTarget, match map[string]string) (bool, error) {
+	for {
+		res, err := b.db.Exec("DELETE FROM sessions WHERE id = ? AND data = ?", x.id, x.data)
+		if err != nil {
+			return false, err
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return false, err
+		}
+		if n > 0 {
+			return true, nil
+		}
+		err = b.db.QueryRow("SELECT data FROM sessions WHERE id = ?", x.id).Scan(&x.data)
+		if err == sql.ErrNoRows {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		if !matchJSON(x.data, match) {
+			return false, nil
+		}
+	}
+}
+
+// matchJSON はJSONで保存されたデータがmatchのすべての値と一致するかを返す
+func matchJSON(data string, match map[string]string) bool {
+	sessionData := make(map[string]string)
+	if err := json.Unmarshal([]byte(data), &sessionData); err != nil {
+		return false
+	}
+	return matchData(sessionData, match)
+}
+
+func (b *SQLBackend) DeleteExpired(now time.Time) (int, error) {
+	res, err := b.db.Exec("DELETE FROM sessions WHERE expire < ?", now.UnixNano())
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
+
+func (b *SQLBackend) Close() error {
+	return b.db.Close()
+}
@@ -0,0 +1,491 @@
+package session
+
+import (
+	"context"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+const testPrefix = "test:session:"
+
+// testBackend はすべてのバックエンドで同じ振る舞いを確認するためのバックエンドの作成方法
+type testBackend struct {
+	name string
+	open func(t *testing.T) Backend
+	// selfExpiring は期限切れのセッションをバックエンド自身が削除する場合にtrue
+	selfExpiring bool
+}
+
+var testBackends = []testBackend{
+	{name: BackendMemory, open: func(t *testing.T) Backend {
+		return NewMemoryBackend()
+	}},
+	{name: BackendFile, open: func(t *testing.T) Backend {
+		b, err := NewFileBackend(filepath.Join(t.TempDir(), "sessions"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}},
+	{name: BackendSQL, open: func(t *testing.T) Backend {
+		return openSQLBackend(t)
+	}},
+	{name: BackendRedis, selfExpiring: true, open: func(t *testing.T) Backend {
+		b, _ := openRedisBackend(t)
+		return b
+	}},
+}
+
+func openSQLBackend(t *testing.T) *SQLBackend {
+	t.Helper()
+	b, err := NewSQLBackend("sqlite", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { b.Close() })
+	return b
+}
+
+func openRedisBackend(t *testing.T) (*RedisBackend, *miniredis.Miniredis) {
+	t.Helper()
+	server := miniredis.RunT(t)
+	b, err := NewRedisBackend("redis://"+server.Addr()+"/0", testPrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { b.Close() })
+	return b, server
+}
+
+// forEachBackend はすべてのバックエンドでfを実行する
+func forEachBackend(t *testing.T, f func(t *testing.T, x testBackend, b Backend)) {
+	for _, x := range testBackends {
+		x := x
+		t.Run(x.name, func(t *testing.T) {
+			f(t, x, x.open(t))
+		})
+	}
+}
+
+// testNow はRedisがミリ秒で保存するため、比較できるようにミリ秒に丸めた現在時刻を返す
+func testNow() time.Time {
+	return time.Now().Truncate(time.Millisecond)
+}
+
+func testRecord(token string, data map[string]string, now time.Time) Record {
+	return Record{
+		Store:    Store{Data: data, ConsistencyToken: token},
+		Expire:   now.Add(time.Minute),
+		Lifetime: time.Minute,
+	}
+}
+
+func checkRecord(t *testing.T, got Record, want Record) {
+	t.Helper()
+	if !reflect.DeepEqual(got.Store, want.Store) {
+		t.Errorf("store = %+v, want %+v", got.Store, want.Store)
+	}
+	if !got.Expire.Equal(want.Expire) {
+		t.Errorf("expire = %s, want %s", got.Expire, want.Expire)
+	}
+	if got.Lifetime != want.Lifetime {
+		t.Errorf("lifetime = %s, want %s", got.Lifetime, want.Lifetime)
+	}
+}
+
+func TestBackendCreateLoad(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, x testBackend, b Backend) {
+		now := testNow()
+		rec := testRecord("token-1", map[string]string{"user_id": "alice"}, now)
+		if err := b.Create("s1", rec); err != nil {
+			t.Fatal(err)
+		}
+		got, err := b.Load("s1", now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkRecord(t, got, rec)
+
+		// 返された内容を書き換えても保存されている内容は変わらない
+		got.Store.Data["user_id"] = "mallory"
+		rec.Store.Data["user_id"] = "mallory"
+		if again, err := b.Load("s1", now); err != nil || again.Store.Data["user_id"] != "alice" {
+			t.Errorf("stored data changed: %v, %v", again.Store.Data, err)
+		}
+
+		if _, err := b.Load("missing", now); err != ErrorNotFound {
+			t.Errorf("missing: err = %v, want %v", err, ErrorNotFound)
+		}
+		if _, err := b.Load("s1", now.Add(2*time.Minute)); err != ErrorNotFound {
+			t.Errorf("expired: err = %v, want %v", err, ErrorNotFound)
+		}
+	})
+}
+
+func TestBackendCreateEmptyData(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, x testBackend, b Backend) {
+		now := testNow()
+		if err := b.Create("s1", testRecord("token-1", map[string]string{}, now)); err != nil {
+			t.Fatal(err)
+		}
+		got, err := b.Load("s1", now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Store.Data == nil || len(got.Store.Data) != 0 {
+			t.Errorf("data = %#v, want empty map", got.Store.Data)
+		}
+	})
+}
+
+func TestBackendTouch(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, x testBackend, b Backend) {
+		now := testNow()
+		rec := testRecord("token-1", map[string]string{"user_id": "alice"}, now)
+		if err := b.Create("s1", rec); err != nil {
+			t.Fatal(err)
+		}
+		expire := now.Add(10 * time.Minute)
+		if err := b.Touch("s1", expire); err != nil {
+			t.Fatal(err)
+		}
+		got, err := b.Load("s1", now.Add(5*time.Minute))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rec.Expire = expire
+		checkRecord(t, got, rec)
+
+		if err := b.Touch("missing", expire); err != ErrorNotFound {
+			t.Errorf("missing: err = %v, want %v", err, ErrorNotFound)
+		}
+		if _, err := b.Load("missing", now); err != ErrorNotFound {
+			t.Errorf("touch created a session: err = %v", err)
+		}
+	})
+}
+
+func TestBackendSave(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, x testBackend, b Backend) {
+		now := testNow()
+		if err := b.Create("s1", testRecord("token-1", map[string]string{"user_id": "alice"}, now)); err != nil {
+			t.Fatal(err)
+		}
+		next := testRecord("token-2", map[string]string{"user_id": "alice", "realm": "default"}, now.Add(time.Second))
+		if err := b.Save("s1", "token-1", next, now); err != nil {
+			t.Fatal(err)
+		}
+		got, err := b.Load("s1", now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkRecord(t, got, next)
+
+		// 古いトークンでの保存は後からの書き込みを上書きしない
+		stale := testRecord("token-3", map[string]string{"user_id": "mallory"}, now)
+		if err := b.Save("s1", "token-1", stale, now); err != ErrorInvalidToken {
+			t.Errorf("stale token: err = %v, want %v", err, ErrorInvalidToken)
+		}
+		if got, err := b.Load("s1", now); err != nil || got.Store.ConsistencyToken != "token-2" {
+			t.Errorf("stale save changed the session: %+v, %v", got.Store, err)
+		}
+
+		if err := b.Save("missing", "token-1", stale, now); err != ErrorNotFound {
+			t.Errorf("missing: err = %v, want %v", err, ErrorNotFound)
+		}
+		if err := b.Save("s1", "token-2", stale, now.Add(2*time.Minute)); err != ErrorNotFound {
+			t.Errorf("expired: err = %v, want %v", err, ErrorNotFound)
+		}
+	})
+}
+
+func TestBackendDelete(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, x testBackend, b Backend) {
+		now := testNow()
+		for _, id := range []ID{"s1", "s2"} {
+			if err := b.Create(id, testRecord("token-1", map[string]string{}, now)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := b.Delete("s1", now); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := b.Load("s1", now); err != ErrorNotFound {
+			t.Errorf("deleted session: err = %v, want %v", err, ErrorNotFound)
+		}
+		if err := b.Delete("s1", now); err != ErrorNotFound {
+			t.Errorf("deleted twice: err = %v, want %v", err, ErrorNotFound)
+		}
+		if err := b.Delete("s2", now.Add(2*time.Minute)); err != ErrorNotFound {
+			t.Errorf("expired: err = %v, want %v", err, ErrorNotFound)
+		}
+	})
+}
+
+func TestBackendDeleteByData(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, x testBackend, b Backend) {
+		now := testNow()
+		sessions := map[ID]map[string]string{
+			"s1": {"realm": "default", "user_id": "alice"},
+			"s2": {"realm": "default", "user_id": "alice", "csrf": "x"},
+			"s3": {"realm": "partner", "user_id": "alice"},
+			"s4": {"realm": "default", "user_id": "bob"},
+			"s5": {},
+		}
+		for id, data := range sessions {
+			if err := b.Create(id, testRecord("token-"+string(id), data, now)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		n, err := b.DeleteByData(map[string]string{"realm": "default", "user_id": "alice"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != 2 {
+			t.Errorf("deleted = %d, want 2", n)
+		}
+		for id := range sessions {
+			_, err := b.Load(id, now)
+			if deleted := id == "s1" || id == "s2"; deleted != (err == ErrorNotFound) {
+				t.Errorf("session %s: deleted = %v, err = %v", id, deleted, err)
+			}
+		}
+	})
+}
+
+func TestBackendDeleteExpired(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, x testBackend, b Backend) {
+		now := testNow()
+		expired := testRecord("token-1", map[string]string{}, now)
+		expired.Expire = now.Add(-time.Second)
+		if err := b.Create("old", expired); err != nil {
+			t.Fatal(err)
+		}
+		if err := b.Create("live", testRecord("token-2", map[string]string{}, now)); err != nil {
+			t.Fatal(err)
+		}
+		n, err := b.DeleteExpired(now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := 1; !x.selfExpiring && n != want {
+			t.Errorf("deleted = %d, want %d", n, want)
+		}
+		// 期限より前の時刻を指定しても読み出せない
+		if _, err := b.Load("old", expired.Expire.Add(-time.Second)); err != ErrorNotFound {
+			t.Errorf("expired session: err = %v, want %v", err, ErrorNotFound)
+		}
+		if _, err := b.Load("live", now); err != nil {
+			t.Errorf("live session: err = %v", err)
+		}
+	})
+}
+
+func TestFileBackendRejectsPathTraversal(t *testing.T) {
+	b, err := NewFileBackend(filepath.Join(t.TempDir(), "sessions"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := testNow()
+	for _, id := range []ID{"", "../escape", "a/b", "a.json"} {
+		if err := b.Create(id, testRecord("token-1", map[string]string{}, now)); err != ErrorBadParameter {
+			t.Errorf("Create(%q): err = %v, want %v", id, err, ErrorBadParameter)
+		}
+		if _, err := b.Load(id, now); err != ErrorNotFound {
+			t.Errorf("Load(%q): err = %v, want %v", id, err, ErrorNotFound)
+		}
+	}
+}
+
+func TestSQLBackendDeleteByDataRechecksChangedSession(t *testing.T) {
+	b := openSQLBackend(t)
+	now := testNow()
+	match := map[string]string{"user_id": "alice"}
+	for _, id := range []ID{"rotated", "extended", "changed"} {
+		if err := b.Create(id, testRecord("token-1", match, now)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	targets, err := b.findByData(match)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(targets) != 3 {
+		t.Fatalf("targets = %v, want 3 sessions", targets)
+	}
+	// 読み出した後に各セッションが更新された
+	updates := map[ID]map[string]string{
+		"rotated":  match,
+		"extended": {"user_id": "alice", "csrf": "x"},
+		"changed":  {"user_id": "bob"},
+	}
+	for id, data := range updates {
+		if err := b.Save(id, "token-1", testRecord("token-2", data, now), now); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, x := range targets {
+		ok, err := b.deleteIfMatch(x, match)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := x.id != "changed"; ok != want {
+			t.Errorf("deleteIfMatch(%s) = %v, want %v", x.id, ok, want)
+		}
+	}
+	for id := range updates {
+		_, err := b.Load(id, now)
+		if deleted := id != "changed"; deleted != (err == ErrorNotFound) {
+			t.Errorf("session %s: deleted = %v, err = %v", id, deleted, err)
+		}
+	}
+}
+
+func TestRedisSaveScript(t *testing.T) {
+	b, server := openRedisBackend(t)
+	ctx := context.Background()
+	now := testNow()
+	if err := b.Create("s1", testRecord("token-1", map[string]string{"user_id": "alice"}, now)); err != nil {
+		t.Fatal(err)
+	}
+	key := b.key("s1")
+	expire := now.Add(5 * time.Minute)
+	run := func(id ID, token string, now time.Time) int {
+		t.Helper()
+		n, err := redisSaveScript.Run(ctx, b.client, []string{b.key(id)},
+			token, "token-2", `{"user_id":"alice"}`, int64(time.Minute), unixMilli(expire), unixMilli(now)).Int()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+
+	if n := run("s1", "stale", now); n != -1 {
+		t.Errorf("token mismatch = %d, want -1", n)
+	}
+	if got := server.HGet(key, "token"); got != "token-1" {
+		t.Errorf("token after mismatch = %q, want token-1", got)
+	}
+	if n := run("missing", "token-1", now); n != 0 {
+		t.Errorf("missing = %d, want 0", n)
+	}
+	if server.Exists(b.key("missing")) {
+		t.Error("save created a missing session")
+	}
+	if n := run("s1", "token-1", now.Add(2*time.Minute)); n != 0 {
+		t.Errorf("expired = %d, want 0", n)
+	}
+	if n := run("s1", "token-1", now); n != 1 {
+		t.Fatalf("match = %d, want 1", n)
+	}
+	if got := server.HGet(key, "token"); got != "token-2" {
+		t.Errorf("token after save = %q, want token-2", got)
+	}
+	// キーの有効期限もセッションの有効期限に合わせる
+	if ttl := server.TTL(key); ttl <= time.Minute || ttl > 5*time.Minute {
+		t.Errorf("ttl = %s, want about 5m", ttl)
+	}
+}
+
+func TestRedisDeleteScript(t *testing.T) {
+	b, server := openRedisBackend(t)
+	ctx := context.Background()
+	now := testNow()
+	if err := b.Create("s1", testRecord("token-1", map[string]string{}, now)); err != nil {
+		t.Fatal(err)
+	}
+	key := b.key("s1")
+	run := func(now time.Time) int {
+		t.Helper()
+		n, err := redisDeleteScript.Run(ctx, b.client, []string{key}, unixMilli(now)).Int()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+
+	if n := run(now.Add(2 * time.Minute)); n != 0 {
+		t.Errorf("expired = %d, want 0", n)
+	}
+	if !server.Exists(key) {
+		t.Fatal("expired check deleted the key")
+	}
+	if n := run(now); n != 1 {
+		t.Errorf("live = %d, want 1", n)
+	}
+	if n := run(now); n != 0 {
+		t.Errorf("missing = %d, want 0", n)
+	}
+}
+
+func TestRedisDeleteByDataScript(t *testing.T) {
+	b, server := openRedisBackend(t)
+	ctx := context.Background()
+	now := testNow()
+	match := map[string]string{"realm": "default", "user_id": "alice"}
+	if err := b.Create("s1", testRecord("token-1", match, now)); err != nil {
+		t.Fatal(err)
+	}
+	key := b.key("s1")
+	run := func(match string) int {
+		t.Helper()
+		n, err := redisDeleteByDataScript.Run(ctx, b.client, []string{key}, match).Int()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+
+	if n := run(`{"user_id":"bob"}`); n != 0 {
+		t.Errorf("other user = %d, want 0", n)
+	}
+	if n := run(`{"user_id":"alice","realm":"partner"}`); n != 0 {
+		t.Errorf("other realm = %d, want 0", n)
+	}
+	if !server.Exists(key) {
+		t.Fatal("session deleted without a match")
+	}
+	// 一致を確認した後にトークンが変わっても、データが一致していれば削除する
+	if err := b.Save("s1", "token-1", testRecord("token-2", match, now), now); err != nil {
+		t.Fatal(err)
+	}
+	if n := run(`{"user_id":"alice"}`); n != 1 {
+		t.Errorf("rotated token = %d, want 1", n)
+	}
+	if server.Exists(key) {
+		t.Error("session not deleted")
+	}
+	if n := run(`{"user_id":"alice"}`); n != 0 {
+		t.Errorf("missing = %d, want 0", n)
+	}
+
+	// 壊れたデータのキーは削除しない
+	server.HSet(b.key("broken"), "token", "x", "data", "not json")
+	if n, err := redisDeleteByDataScript.Run(ctx, b.client, []string{b.key("broken")}, `{"user_id":"alice"}`).Int(); err != nil || n != 0 {
+		t.Errorf("broken data = %d, %v, want 0", n, err)
+	}
+}
+
+func TestRedisTouchScript(t *testing.T) {
+	b, server := openRedisBackend(t)
+	now := testNow()
+	if err := b.Touch("missing", now.Add(time.Minute)); err != ErrorNotFound {
+		t.Errorf("missing: err = %v, want %v", err, ErrorNotFound)
+	}
+	if server.Exists(b.key("missing")) {
+		t.Error("touch created a missing session")
+	}
+	if err := b.Create("s1", testRecord("token-1", map[string]string{}, now)); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Touch("s1", now.Add(10*time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if ttl := server.TTL(b.key("s1")); ttl <= 5*time.Minute {
+		t.Errorf("ttl = %s, want about 10m", ttl)
+	}
+}
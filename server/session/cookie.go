@@ -8,18 +8,31 @@ import (
 	"github.com/labstack/echo"
 )
 
+// RealmContextKey はリクエストのレルムの設定(*setting.RealmConfig)を保持するキー
+//
+// 設定されていない場合は既定のレルムのクッキーを使用する
+const RealmContextKey = "realm"
+
+func requestRealm(c echo.Context) *setting.RealmConfig {
+	if realm, ok := c.Get(RealmContextKey).(*setting.RealmConfig); ok {
+		return realm
+	}
+	return setting.RealmFor("")
+}
+
 func WriteCookie(c echo.Context, sessionID ID) error {
+	realm := requestRealm(c)
 	cookie := new(http.Cookie)
-	cookie.Name = setting.Session.CookieName
+	cookie.Name = realm.CookieName
 	cookie.Value = string(sessionID)
-	cookie.Expires = time.Now().Add(setting.Session.CookieExpire)
+	cookie.Expires = time.Now().Add(realm.CookieExpire)
 	c.SetCookie(cookie)
 	return nil
 }
 
 func ReadCookie(c echo.Context) (ID, error) {
 	var sessionID ID
-	cookie, err := c.Cookie(setting.Session.CookieName)
+	cookie, err := c.Cookie(requestRealm(c).CookieName)
 	if err != nil {
 		return sessionID, err
 	}
@@ -1,6 +1,7 @@
 package session
 
 import (
+	"context"
 	"errors"
 	"time"
 
@@ -13,6 +14,7 @@ var (
 	ErrorInvalidToken   = errors.New("Invalid Token")
 	ErrorInvalidCommand = errors.New("Invalid Command")
 	ErrorNotImplemented = errors.New("Not Implemented")
+	ErrorStopped        = errors.New("Stopped")
 	ErrorOther          = errors.New("Other")
 )
 
@@ -24,30 +26,110 @@ type Store struct {
 }
 
 type Manager struct {
+	Backend   Backend // nilの場合は設定に応じて作成する
+	snapshot  *snapshot
 	stopCh    chan struct{}
+	doneCh    chan struct{} // mainLoopの終了時に閉じる
 	commandCh chan command
 	stopGCCh  chan struct{}
+	gcDoneCh  chan struct{}
 }
 
-func (m *Manager) Start(echo *echo.Echo) {
+func (m *Manager) Start(echo *echo.Echo) error {
 	e = echo
+	if m.Backend == nil {
+		backend, err := NewBackend()
+		if err != nil {
+			return err
+		}
+		m.Backend = backend
+	}
+	if sn, ok := m.Backend.(Snapshotter); ok {
+		snapshot, err := newSnapshot()
+		if err != nil {
+			return err
+		}
+		m.snapshot = snapshot
+		m.restoreSnapshot(sn)
+	}
+	// ループの起動前にコマンドを受け付けられるようにチャネルを作成しておく
+	m.stopCh = make(chan struct{}, 1)
+	m.doneCh = make(chan struct{})
+	m.commandCh = make(chan command, 1)
+	m.stopGCCh = make(chan struct{}, 1)
+	m.gcDoneCh = make(chan struct{})
 	go m.mainLoop()
-	time.Sleep(100 * time.Millisecond)
 	go m.gcLoop()
+	return nil
 }
 
+// Stop はループの終了を待って戻る。以降の呼び出しはErrorStoppedを返す
 func (m *Manager) Stop() {
+	if m.doneCh == nil {
+		return
+	}
+	select {
+	case <-m.doneCh:
+		return
+	default:
+	}
 	m.stopGCCh <- struct{}{}
-	time.Sleep(100 * time.Millisecond)
+	<-m.gcDoneCh
 	m.stopCh <- struct{}{}
+	<-m.doneCh
 }
 
-func (m *Manager) Create() (ID, error) {
+// send はコマンドをmainLoopに渡して応答を待つ
+//
+// ctxが終了した場合やStopの後は待たずにエラーを返す。
+// すでに受け付けられたコマンドはctxが終了しても実行される
+func (m *Manager) send(ctx context.Context, cmdType commandType, req []interface{}) response {
+	if m.doneCh == nil {
+		return response{nil, ErrorStopped}
+	}
+	if err := ctx.Err(); err != nil {
+		return response{nil, err}
+	}
 	respCh := make(chan response, 1)
-	defer close(respCh)
-	cmd := command{commandCreate, nil, respCh}
-	m.commandCh <- cmd
-	resp := <-respCh
+	select {
+	case <-m.doneCh:
+		return response{nil, ErrorStopped}
+	case <-ctx.Done():
+		return response{nil, ctx.Err()}
+	case m.commandCh <- command{cmdType, req, respCh}:
+	}
+	select {
+	case resp := <-respCh:
+		return resp
+	case <-m.doneCh:
+		// 終了の直前に処理された場合は応答が残っている
+		select {
+		case resp := <-respCh:
+			return resp
+		default:
+			return response{nil, ErrorStopped}
+		}
+	case <-ctx.Done():
+		return response{nil, ctx.Err()}
+	}
+}
+
+func (m *Manager) Create() (ID, error) {
+	return m.CreateContext(context.Background())
+}
+
+func (m *Manager) CreateContext(ctx context.Context) (ID, error) {
+	return m.CreateWithExpireContext(ctx, 0)
+}
+
+// CreateWithExpire は有効期間を指定してセッションを作成する。0の場合は既定の有効期間を使用する
+func (m *Manager) CreateWithExpire(expire time.Duration) (ID, error) {
+	return m.CreateWithExpireContext(context.Background(), expire)
+}
+
+func (m *Manager) CreateWithExpireContext(ctx context.Context, expire time.Duration) (ID, error) {
+	req := []interface{}{expire}
+	resp := m.send(ctx, commandCreate, req)
 	var res ID
 	if resp.err != nil {
 		e.Logger.Debugf("Session Create Error. [%s]", resp.err)
@@ -61,12 +143,12 @@ func (m *Manager) Create() (ID, error) {
 }
 
 func (m *Manager) LoadStore(sessionID ID) (Store, error) {
-	respCh := make(chan response, 1)
-	defer close(respCh)
+	return m.LoadStoreContext(context.Background(), sessionID)
+}
+
+func (m *Manager) LoadStoreContext(ctx context.Context, sessionID ID) (Store, error) {
 	req := []interface{}{sessionID}
-	cmd := command{commandLoadStore, req, respCh}
-	m.commandCh <- cmd
-	resp := <-respCh
+	resp := m.send(ctx, commandLoadStore, req)
 	var res Store
 	if resp.err != nil {
 		e.Logger.Debugf("Session[%s] Load store Error. [%s]", sessionID, resp.err)
@@ -80,12 +162,12 @@ func (m *Manager) LoadStore(sessionID ID) (Store, error) {
 }
 
 func (m *Manager) SaveStore(sessionID ID, sessionStore Store) error {
-	respCh := make(chan response, 1)
-	defer close(respCh)
+	return m.SaveStoreContext(context.Background(), sessionID, sessionStore)
+}
+
+func (m *Manager) SaveStoreContext(ctx context.Context, sessionID ID, sessionStore Store) error {
 	req := []interface{}{sessionID, sessionStore}
-	cmd := command{commandSaveStore, req, respCh}
-	m.commandCh <- cmd
-	resp := <-respCh
+	resp := m.send(ctx, commandSaveStore, req)
 	if resp.err != nil {
 		e.Logger.Debugf("Session[%s] Save store Error. [%s]", sessionID, resp.err)
 		return resp.err
@@ -94,12 +176,12 @@ func (m *Manager) SaveStore(sessionID ID, sessionStore Store) error {
 }
 
 func (m *Manager) Delete(sessionID ID) error {
-	respCh := make(chan response, 1)
-	defer close(respCh)
+	return m.DeleteContext(context.Background(), sessionID)
+}
+
+func (m *Manager) DeleteContext(ctx context.Context, sessionID ID) error {
 	req := []interface{}{sessionID}
-	cmd := command{commandDelete, req, respCh}
-	m.commandCh <- cmd
-	resp := <-respCh
+	resp := m.send(ctx, commandDelete, req)
 	if resp.err != nil {
 		e.Logger.Debugf("Session[%s] Delete Error. [%s]", sessionID, resp.err)
 		return resp.err
@@ -107,12 +189,31 @@ func (m *Manager) Delete(sessionID ID) error {
 	return nil
 }
 
+// DeleteByData はデータがmatchのすべての値と一致するセッションを削除し、削除した件数を返す
+func (m *Manager) DeleteByData(match map[string]string) (int, error) {
+	return m.DeleteByDataContext(context.Background(), match)
+}
+
+func (m *Manager) DeleteByDataContext(ctx context.Context, match map[string]string) (int, error) {
+	req := []interface{}{match}
+	resp := m.send(ctx, commandDeleteByData, req)
+	if resp.err != nil {
+		e.Logger.Debugf("Session Delete by data Error. match[%s] [%s]", match, resp.err)
+		return 0, resp.err
+	}
+	if res, ok := resp.result[0].(int); ok {
+		return res, nil
+	}
+	e.Logger.Debugf("Session Delete by data Error. match[%s] [%s]", match, ErrorOther)
+	return 0, ErrorOther
+}
+
 func (m *Manager) DeleteExpired() error {
-	respCh := make(chan response, 1)
-	defer close(respCh)
-	cmd := command{commandDelete, nil, respCh}
-	m.commandCh <- cmd
-	resp := <-respCh
+	return m.DeleteExpiredContext(context.Background())
+}
+
+func (m *Manager) DeleteExpiredContext(ctx context.Context) error {
+	resp := m.send(ctx, commandDeleteExpired, nil)
 	if resp.err != nil {
 		e.Logger.Debugf("Session DeleteExpired Error. [%s]", resp.err)
 		return resp.err
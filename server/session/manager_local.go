@@ -1,19 +1,16 @@
 package session
 
 import (
+	"context"
 	"time"
 
+	"github.com/knanao/goauth/server/setting"
 	"github.com/labstack/echo"
 	uuid "github.com/satori/go.uuid"
 )
 
 var e *echo.Echo
 
-type session struct {
-	store  Store
-	expire time.Time
-}
-
 const sessionExpire time.Duration = (3 * time.Minute)
 
 type commandType int
@@ -24,6 +21,8 @@ const (
 	commandSaveStore                        // データストアの保存
 	commandDelete                           // セッションの削除
 	commandDeleteExpired                    // 期限切れのセッションを削除
+	commandDeleteByData                     // データの値が一致するセッションを削除
+	commandSnapshot                         // セッションをファイルに保存
 )
 
 type command struct {
@@ -38,11 +37,8 @@ type response struct {
 }
 
 func (m *Manager) mainLoop() {
-	sessions := make(map[ID]session)
-	m.stopCh = make(chan struct{}, 1)
-	m.commandCh = make(chan command, 1)
-	defer close(m.commandCh)
-	defer close(m.stopCh)
+	backend := m.Backend
+	defer close(m.doneCh)
 	e.Logger.Info("session.Manager:start")
 loop:
 	for {
@@ -50,17 +46,28 @@ loop:
 		case cmd := <-m.commandCh:
 			switch cmd.cmdType {
 			case commandCreate:
+				reqExpire, ok := cmd.req[0].(time.Duration)
+				if !ok {
+					cmd.responseCh <- response{nil, ErrorBadParameter}
+					break
+				}
+				if reqExpire <= 0 {
+					reqExpire = sessionExpire
+				}
 				sessionID := ID(createSessionID())
-				session := session{}
+				session := Record{Lifetime: reqExpire}
 				sessionStore := Store{}
 				sessionData := make(map[string]string)
 				sessionStore.Data = sessionData
 				sessionStore.ConsistencyToken = createToken()
-				session.store = sessionStore
-				session.expire = time.Now().Add(sessionExpire)
-				sessions[sessionID] = session
+				session.Store = sessionStore
+				session.Expire = time.Now().Add(session.Lifetime)
+				if err := backend.Create(sessionID, session); err != nil {
+					cmd.responseCh <- response{nil, err}
+					break
+				}
 				res := []interface{}{sessionID}
-				e.Logger.Debugf("Session[%s] Create. expire[%s]", sessionID, session.expire)
+				e.Logger.Debugf("Session[%s] Create. expire[%s]", sessionID, session.Expire)
 				cmd.responseCh <- response{res, nil}
 			case commandLoadStore:
 				reqSessionID, ok := cmd.req[0].(ID)
@@ -68,26 +75,19 @@ loop:
 					cmd.responseCh <- response{nil, ErrorBadParameter}
 					break
 				}
-				session, ok := sessions[reqSessionID]
-				if !ok {
-					cmd.responseCh <- response{nil, ErrorNotFound}
+				now := time.Now()
+				session, err := backend.Load(reqSessionID, now)
+				if err != nil {
+					cmd.responseCh <- response{nil, err}
 					break
 				}
-				if time.Now().After(session.expire) {
-					cmd.responseCh <- response{nil, ErrorNotFound}
+				session.Expire = now.Add(session.Lifetime)
+				if err := backend.Touch(reqSessionID, session.Expire); err != nil {
+					cmd.responseCh <- response{nil, err}
 					break
 				}
-				sessionStore := Store{}
-				sessionData := make(map[string]string)
-				for k, v := range session.store.Data {
-					sessionData[k] = v
-				}
-				sessionStore.Data = sessionData
-				sessionStore.ConsistencyToken = session.store.ConsistencyToken
-				session.expire = time.Now().Add(sessionExpire)
-				sessions[reqSessionID] = session
-				e.Logger.Debugf("Session[%s] Load store. store[%s] expire[%s]", reqSessionID, session.store, session.expire)
-				res := []interface{}{sessionStore}
+				e.Logger.Debugf("Session[%s] Load store. store[%s] expire[%s]", reqSessionID, session.Store, session.Expire)
+				res := []interface{}{session.Store}
 				cmd.responseCh <- response{res, nil}
 			case commandSaveStore:
 				reqSessionID, ok := cmd.req[0].(ID)
@@ -100,30 +100,22 @@ loop:
 					cmd.responseCh <- response{nil, ErrorBadParameter}
 					break
 				}
-				session, ok := sessions[reqSessionID]
-				if !ok {
-					cmd.responseCh <- response{nil, ErrorNotFound}
-					break
-				}
-				if time.Now().After(session.expire) {
-					cmd.responseCh <- response{nil, ErrorNotFound}
+				now := time.Now()
+				// 延長する期間はセッションごとに異なるため保存されている値を使用する
+				session, err := backend.Load(reqSessionID, now)
+				if err != nil {
+					cmd.responseCh <- response{nil, err}
 					break
 				}
-				if session.store.ConsistencyToken != reqSessionStore.ConsistencyToken {
-					cmd.responseCh <- response{nil, ErrorInvalidToken}
+				sessionStore := copyStore(reqSessionStore)
+				sessionStore.ConsistencyToken = createToken()
+				session.Store = sessionStore
+				session.Expire = now.Add(session.Lifetime)
+				if err := backend.Save(reqSessionID, reqSessionStore.ConsistencyToken, session, now); err != nil {
+					cmd.responseCh <- response{nil, err}
 					break
 				}
-				sessionStore := Store{}
-				sessionData := make(map[string]string)
-				for k, v := range reqSessionStore.Data {
-					sessionData[k] = v
-				}
-				sessionStore.Data = sessionData
-				sessionStore.ConsistencyToken = createToken()
-				session.store = sessionStore
-				session.expire = time.Now().Add(sessionExpire)
-				sessions[reqSessionID] = session
-				e.Logger.Debugf("Session[%s] Save store. store[%s] expire[%s]", reqSessionID, session.store, session.expire)
+				e.Logger.Debugf("Session[%s] Save store. store[%s] expire[%s]", reqSessionID, session.Store, session.Expire)
 				cmd.responseCh <- response{nil, nil}
 			case commandDelete:
 				reqSessionID, ok := cmd.req[0].(ID)
@@ -131,27 +123,38 @@ loop:
 					cmd.responseCh <- response{nil, ErrorBadParameter}
 					break
 				}
-				session, ok := sessions[reqSessionID]
-				if !ok {
-					cmd.responseCh <- response{nil, ErrorNotFound}
+				if err := backend.Delete(reqSessionID, time.Now()); err != nil {
+					cmd.responseCh <- response{nil, err}
 					break
 				}
-				if time.Now().After(session.expire) {
-					cmd.responseCh <- response{nil, ErrorNotFound}
-					break
-				}
-				delete(sessions, reqSessionID)
 				e.Logger.Debugf("Session[%s] Delete.", reqSessionID)
 				cmd.responseCh <- response{nil, nil}
+			case commandDeleteByData:
+				reqMatch, ok := cmd.req[0].(map[string]string)
+				if !ok || len(reqMatch) <= 0 {
+					cmd.responseCh <- response{nil, ErrorBadParameter}
+					break
+				}
+				deleted, err := backend.DeleteByData(reqMatch)
+				if err != nil {
+					cmd.responseCh <- response{nil, err}
+					break
+				}
+				e.Logger.Debugf("Session Delete by data. match[%s] deleted[%d]", reqMatch, deleted)
+				res := []interface{}{deleted}
+				cmd.responseCh <- response{res, nil}
 			case commandDeleteExpired:
-				e.Logger.Debugf("Run Session GC. Now[%s]", time.Now())
-				for k, v := range sessions {
-					if time.Now().After(v.expire) {
-						e.Logger.Debugf("Session[%s] expire delete. expire[%s]", k, v.expire)
-						delete(sessions, k)
-					}
+				now := time.Now()
+				e.Logger.Debugf("Run Session GC. Now[%s]", now)
+				deleted, err := backend.DeleteExpired(now)
+				if err != nil {
+					cmd.responseCh <- response{nil, err}
+					break
 				}
+				e.Logger.Debugf("Session expire delete. deleted[%d]", deleted)
 				cmd.responseCh <- response{nil, nil}
+			case commandSnapshot:
+				cmd.responseCh <- response{nil, m.saveSnapshot(backend)}
 			default:
 				cmd.responseCh <- response{nil, ErrorInvalidCommand}
 			}
@@ -159,23 +162,32 @@ loop:
 			break loop
 		}
 	}
+	// 停止時は受け付け済みのコマンドをすべて処理した後の状態を保存する
+	m.saveSnapshot(backend)
+	if err := backend.Close(); err != nil {
+		e.Logger.Warnf("Session Backend Close Error. [%s]", err)
+	}
 	e.Logger.Info("session.Manager:stop")
 }
 
+// gcLoop は期限切れのセッションの削除と、設定されている場合はセッションの定期的な保存を行う
 func (m *Manager) gcLoop() {
-	m.stopGCCh = make(chan struct{}, 1)
-	defer close(m.stopGCCh)
+	defer close(m.gcDoneCh)
 	e.Logger.Info("session.Manager GC:start")
 	t := time.NewTicker(1 * time.Minute)
+	var snapshotCh <-chan time.Time
+	if m.snapshot != nil && setting.Session.SnapshotInterval > 0 {
+		st := time.NewTicker(setting.Session.SnapshotInterval)
+		defer st.Stop()
+		snapshotCh = st.C
+	}
 loop:
 	for {
 		select {
 		case <-t.C:
-			respCh := make(chan response, 1)
-			defer close(respCh)
-			cmd := command{commandDeleteExpired, nil, respCh}
-			m.commandCh <- cmd
-			<-respCh
+			m.send(context.Background(), commandDeleteExpired, nil)
+		case <-snapshotCh:
+			m.send(context.Background(), commandSnapshot, nil)
 		case <-m.stopGCCh:
 			break loop
 		}
@@ -184,6 +196,47 @@ loop:
 	e.Logger.Info("session.Manager GC:stop")
 }
 
+// restoreSnapshot はファイルに保存されたセッションを復元する
+//
+// mainLoopの起動前に呼び出す。ファイルを読み込めない場合は空の状態で起動する
+func (m *Manager) restoreSnapshot(sn Snapshotter) {
+	if m.snapshot == nil {
+		return
+	}
+	records, skipped, err := m.snapshot.load(time.Now())
+	if err != nil {
+		e.Logger.Warnf("Session Snapshot Load Error. path[%s] [%s]", m.snapshot.path, err)
+		return
+	}
+	restored := sn.Restore(records)
+	e.Logger.Infof("Session Snapshot Restore. path[%s] restored[%d] skipped[%d]", m.snapshot.path, restored, skipped)
+}
+
+// saveSnapshot は期限切れでないセッションをファイルに保存する。mainLoopからのみ呼び出す
+func (m *Manager) saveSnapshot(backend Backend) error {
+	sn, ok := backend.(Snapshotter)
+	if !ok || m.snapshot == nil {
+		return nil
+	}
+	now := time.Now()
+	records := sn.Snapshot(now)
+	if err := m.snapshot.save(records, now); err != nil {
+		e.Logger.Warnf("Session Snapshot Save Error. path[%s] [%s]", m.snapshot.path, err)
+		return err
+	}
+	e.Logger.Debugf("Session Snapshot Save. path[%s] sessions[%d]", m.snapshot.path, len(records))
+	return nil
+}
+
+func matchData(data map[string]string, match map[string]string) bool {
+	for k, v := range match {
+		if value, ok := data[k]; !ok || value != v {
+			return false
+		}
+	}
+	return true
+}
+
 func createSessionID() string {
 	u, _ := uuid.NewV4()
 	return u.String()
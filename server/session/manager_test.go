@@ -0,0 +1,126 @@
+package session
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/knanao/goauth/server/setting"
+	"github.com/labstack/echo"
+)
+
+func startManager(t *testing.T, backend Backend) *Manager {
+	t.Helper()
+	server := echo.New()
+	server.Logger.SetOutput(ioutil.Discard)
+	m := &Manager{Backend: backend}
+	if err := m.Start(server); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(m.Stop)
+	return m
+}
+
+func TestManager(t *testing.T) {
+	saved := setting.Session
+	t.Cleanup(func() { setting.Session = saved })
+	setting.Session.SnapshotPath = ""
+
+	forEachBackend(t, func(t *testing.T, x testBackend, b Backend) {
+		m := startManager(t, b)
+		id, err := m.Create()
+		if err != nil {
+			t.Fatal(err)
+		}
+		store, err := m.LoadStore(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		store.Data["user_id"] = "alice"
+		if err := m.SaveStore(id, store); err != nil {
+			t.Fatal(err)
+		}
+		// 保存のたびにトークンが変わるため、同じStoreでの2回目の保存は失敗する
+		if err := m.SaveStore(id, store); err != ErrorInvalidToken {
+			t.Errorf("second save: err = %v, want %v", err, ErrorInvalidToken)
+		}
+		loaded, err := m.LoadStore(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if loaded.Data["user_id"] != "alice" || loaded.ConsistencyToken == store.ConsistencyToken {
+			t.Errorf("loaded = %+v", loaded)
+		}
+
+		if _, err := m.DeleteByData(map[string]string{}); err != ErrorBadParameter {
+			t.Errorf("empty match: err = %v, want %v", err, ErrorBadParameter)
+		}
+		n, err := m.DeleteByData(map[string]string{"user_id": "alice"})
+		if err != nil || n != 1 {
+			t.Errorf("DeleteByData = %d, %v, want 1", n, err)
+		}
+		if _, err := m.LoadStore(id); err != ErrorNotFound {
+			t.Errorf("deleted session: err = %v, want %v", err, ErrorNotFound)
+		}
+		if err := m.Delete(id); err != ErrorNotFound {
+			t.Errorf("delete twice: err = %v, want %v", err, ErrorNotFound)
+		}
+	})
+}
+
+func TestManagerStopped(t *testing.T) {
+	m := &Manager{Backend: NewMemoryBackend()}
+	if _, err := m.Create(); err != ErrorStopped {
+		t.Errorf("before start: err = %v, want %v", err, ErrorStopped)
+	}
+	saved := setting.Session
+	t.Cleanup(func() { setting.Session = saved })
+	setting.Session.SnapshotPath = ""
+	m = startManager(t, NewMemoryBackend())
+	m.Stop()
+	if _, err := m.Create(); err != ErrorStopped {
+		t.Errorf("after stop: err = %v, want %v", err, ErrorStopped)
+	}
+}
+
+func TestManagerSnapshot(t *testing.T) {
+	saved := setting.Session
+	t.Cleanup(func() { setting.Session = saved })
+	setting.Session.SnapshotPath = filepath.Join(t.TempDir(), "sessions.snapshot")
+	setting.Session.SnapshotInterval = 0
+	setting.Session.SnapshotKey = "k1:MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY="
+	setting.Session.SnapshotKeyFile = ""
+
+	m := startManager(t, NewMemoryBackend())
+	id, err := m.Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := m.LoadStore(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Data["user_id"] = "alice"
+	if err := m.SaveStore(id, store); err != nil {
+		t.Fatal(err)
+	}
+	m.Stop()
+
+	// 再起動した後も停止前のセッションを引き継ぐ
+	m = startManager(t, NewMemoryBackend())
+	restored, err := m.LoadStore(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restored.Data["user_id"] != "alice" {
+		t.Errorf("restored data = %v", restored.Data)
+	}
+	m.Stop()
+
+	// 鍵がなければ暗号化されたファイルは読み込まない
+	setting.Session.SnapshotKey = ""
+	m = startManager(t, NewMemoryBackend())
+	if _, err := m.LoadStore(id); err != ErrorNotFound {
+		t.Errorf("sealed snapshot without key: err = %v, want %v", err, ErrorNotFound)
+	}
+}
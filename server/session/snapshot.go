@@ -0,0 +1,127 @@
+package session
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/knanao/goauth/server/envelope"
+	"github.com/knanao/goauth/server/internal/fileutil"
+	"github.com/knanao/goauth/server/setting"
+)
+
+var ErrorSnapshotSealed = errors.New("Snapshot Sealed")
+
+// Snapshotter はプロセス内にのみセッションを保持するバックエンドで、
+// 再起動をまたいでセッションを引き継ぐために内容の取り出しと復元を行う
+type Snapshotter interface {
+	// Snapshot は期限切れでないセッションの複製を返す
+	Snapshot(now time.Time) map[ID]Record
+	// Restore はセッションを追加する。すでに存在するIDは上書きしない
+	Restore(records map[ID]Record) int
+}
+
+// snapshot はセッションを保存するファイル
+type snapshot struct {
+	path    string
+	keyring *envelope.Keyring // nilの場合は暗号化しない
+}
+
+const snapshotVersion = 1
+
+type snapshotFile struct {
+	Version  int               `json:"version"`
+	SavedAt  time.Time         `json:"saved_at"`
+	Sessions []json.RawMessage `json:"sessions"` // 壊れたセッションだけを読み飛ばせるように1件ずつ読み込む
+}
+
+type snapshotEntry struct {
+	ID ID `json:"id"`
+	fileRecord
+}
+
+// newSnapshot は設定に応じたsnapshotを作成する。保存しない設定の場合はnilを返す
+func newSnapshot() (*snapshot, error) {
+	if setting.Session.SnapshotPath == "" {
+		return nil, nil
+	}
+	keyring, err := envelope.LoadKeyring(setting.Session.SnapshotKey, setting.Session.SnapshotKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	return &snapshot{path: setting.Session.SnapshotPath, keyring: keyring}, nil
+}
+
+func (s *snapshot) save(records map[ID]Record, now time.Time) error {
+	file := snapshotFile{Version: snapshotVersion, SavedAt: now, Sessions: []json.RawMessage{}}
+	for id, rec := range records {
+		data, err := json.Marshal(snapshotEntry{id, fileRecord{
+			Data:             rec.Store.Data,
+			ConsistencyToken: rec.Store.ConsistencyToken,
+			Expire:           rec.Expire,
+			Lifetime:         rec.Lifetime,
+		}})
+		if err != nil {
+			return err
+		}
+		file.Sessions = append(file.Sessions, data)
+	}
+	data, err := json.Marshal(file)
+	if err != nil {
+		return err
+	}
+	if s.keyring != nil {
+		data, err = s.keyring.Seal(data)
+		if err != nil {
+			return err
+		}
+	}
+	return fileutil.WriteAtomic(s.path, data, 0600)
+}
+
+// load はファイルから期限切れでないセッションを読み込み、読み飛ばした件数とともに返す
+//
+// ファイルがない場合は空を返す。ファイル全体を読み込めない場合はエラーを返す
+func (s *snapshot) load(now time.Time) (map[ID]Record, int, error) {
+	records := make(map[ID]Record)
+	data, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return records, 0, nil
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	if envelope.IsSealed(data) {
+		if s.keyring == nil {
+			return nil, 0, ErrorSnapshotSealed
+		}
+		data, _, err = s.keyring.Open(data)
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+	var file snapshotFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, 0, err
+	}
+	skipped := 0
+	for _, raw := range file.Sessions {
+		var x snapshotEntry
+		if err := json.Unmarshal(raw, &x); err != nil || x.ID == "" || x.ConsistencyToken == "" ||
+			x.Lifetime <= 0 || now.After(x.Expire) {
+			skipped++
+			continue
+		}
+		if x.Data == nil {
+			x.Data = make(map[string]string)
+		}
+		records[x.ID] = Record{
+			Store:    Store{Data: x.Data, ConsistencyToken: x.ConsistencyToken},
+			Expire:   x.Expire,
+			Lifetime: x.Lifetime,
+		}
+	}
+	return records, skipped, nil
+}
@@ -0,0 +1,137 @@
+package setting
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+)
+
+var LDAP = ldap{}
+
+type ldap struct {
+	Path    string // 設定ファイル(存在しない場合はLDAPで認証しない)
+	Enabled bool   // 設定ファイルを読み込んだ場合にtrue
+
+	URL                string // ldap://またはldaps://
+	StartTLS           bool
+	InsecureSkipVerify bool
+	BindDN             string // ユーザーの検索に使用するアカウント(空の場合は匿名で検索する)
+	BindPassword       string // 環境変数GOAUTH_LDAP_BIND_PASSWORDが設定されている場合はそちらを使用する
+	BaseDN             string
+	UserFilter         string // %sをエスケープしたUserIDで置き換える
+	NameAttribute      string
+	EmailAttribute     string
+	GroupAttribute     string // ユーザーが属するグループのDNを持つ属性
+	// GroupRoles はグループのDNまたはCN(大文字小文字を区別しない)に与えるロール
+	GroupRoles   map[string][]string
+	DefaultRoles []string // どのグループにも一致しないユーザーのロール(空の場合はログインさせない)
+	Realm        string   // LDAPで認証するレルム
+	Timeout      time.Duration
+	CacheTTL     time.Duration // 認証に成功した結果を保持する期間(0の場合は保持しない)
+}
+
+// ldapFile はLDAPの設定ファイル
+type ldapFile struct {
+	URL                string              `json:"url"`
+	StartTLS           bool                `json:"start_tls"`
+	InsecureSkipVerify bool                `json:"insecure_skip_verify"`
+	BindDN             string              `json:"bind_dn"`
+	BindPassword       string              `json:"bind_password"`
+	BaseDN             string              `json:"base_dn"`
+	UserFilter         string              `json:"user_filter"`
+	NameAttribute      string              `json:"name_attribute"`
+	EmailAttribute     string              `json:"email_attribute"`
+	GroupAttribute     string              `json:"group_attribute"`
+	GroupRoles         map[string][]string `json:"group_roles"`
+	DefaultRoles       []string            `json:"default_roles"`
+	Realm              string              `json:"realm"`
+	Timeout            string              `json:"timeout"`
+	CacheTTL           string              `json:"cache_ttl"`
+}
+
+// LoadLDAP はLDAP.PathからLDAPの設定を読み込む
+//
+// LoadRealmsの後に呼び出す。省略された項目は既定値を使用する
+func LoadLDAP() error {
+	path := LDAP.Path
+	LDAP = ldap{Path: path}
+	if path == "" {
+		return nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	x := ldapFile{
+		UserFilter:     "(uid=%s)",
+		NameAttribute:  "cn",
+		EmailAttribute: "mail",
+		GroupAttribute: "memberOf",
+		Realm:          DefaultRealm,
+		Timeout:        "5s",
+	}
+	if err := json.Unmarshal(data, &x); err != nil {
+		return fmt.Errorf("ldap: %s", err)
+	}
+	if err := x.apply(&LDAP); err != nil {
+		return fmt.Errorf("ldap: %s", err)
+	}
+	if password := os.Getenv("GOAUTH_LDAP_BIND_PASSWORD"); password != "" {
+		LDAP.BindPassword = password
+	}
+	LDAP.Enabled = true
+	return nil
+}
+
+func (x *ldapFile) apply(config *ldap) error {
+	if x.URL == "" {
+		return errors.New("url is required")
+	}
+	if x.BaseDN == "" {
+		return errors.New("base_dn is required")
+	}
+	if strings.Count(x.UserFilter, "%s") != 1 {
+		return errors.New("user_filter must contain exactly one %s")
+	}
+	if _, ok := LookupRealm(x.Realm); !ok {
+		return fmt.Errorf("unknown realm: %s", x.Realm)
+	}
+	config.URL = x.URL
+	config.StartTLS = x.StartTLS
+	config.InsecureSkipVerify = x.InsecureSkipVerify
+	config.BindDN = x.BindDN
+	config.BindPassword = x.BindPassword
+	config.BaseDN = x.BaseDN
+	config.UserFilter = x.UserFilter
+	config.NameAttribute = x.NameAttribute
+	config.EmailAttribute = x.EmailAttribute
+	config.GroupAttribute = x.GroupAttribute
+	config.GroupRoles = x.GroupRoles
+	config.DefaultRoles = x.DefaultRoles
+	config.Realm = x.Realm
+	durations := []struct {
+		value string
+		dest  *time.Duration
+	}{
+		{x.Timeout, &config.Timeout},
+		{x.CacheTTL, &config.CacheTTL},
+	}
+	for _, d := range durations {
+		if d.value == "" {
+			continue
+		}
+		v, err := time.ParseDuration(d.value)
+		if err != nil {
+			return err
+		}
+		*d.dest = v
+	}
+	return nil
+}
@@ -0,0 +1,180 @@
+package setting
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// DefaultRealm はレルムを指定しないユーザーとリクエストが属するレルム
+const DefaultRealm = "default"
+
+// RealmConfig はレルムごとの設定
+type RealmConfig struct {
+	Name          string
+	Hosts         []string // このレルムを選択するHostヘッダー
+	CookieName    string
+	CookieExpire  time.Duration
+	SessionExpire time.Duration // 0の場合はセッションの既定の有効期間
+	// PasswordPolicy は定義ファイルで指定された項目以外は全体の設定を引き継ぐ
+	PasswordPolicy passwordPolicy
+}
+
+var (
+	realms      = map[string]*RealmConfig{}
+	realmHosts  = map[string]*RealmConfig{}
+	realmNameRe = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+)
+
+// realmFile はレルムの定義ファイルの1件
+type realmFile struct {
+	Name           string          `json:"name"`
+	Hosts          []string        `json:"hosts"`
+	CookieName     string          `json:"cookie_name"`
+	CookieExpire   string          `json:"cookie_expire"`
+	SessionExpire  string          `json:"session_expire"`
+	PasswordPolicy json.RawMessage `json:"password_policy"`
+	PasswordMaxAge string          `json:"password_max_age"`
+}
+
+// LoadRealms は既定のレルムを作成し、Realm.Pathからレルムの定義を読み込む
+//
+// Loadの後に呼び出す。既定のレルムの設定は定義ファイルで上書きできる
+func LoadRealms() error {
+	realms = map[string]*RealmConfig{}
+	realmHosts = map[string]*RealmConfig{}
+	realms[DefaultRealm] = &RealmConfig{
+		Name:           DefaultRealm,
+		CookieName:     Session.CookieName,
+		CookieExpire:   Session.CookieExpire,
+		PasswordPolicy: PasswordPolicy,
+	}
+	if Realm.Path == "" {
+		return nil
+	}
+	data, err := ioutil.ReadFile(Realm.Path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var files []realmFile
+	if err := json.Unmarshal(data, &files); err != nil {
+		return err
+	}
+	for _, x := range files {
+		config, err := x.config()
+		if err != nil {
+			return fmt.Errorf("realm %s: %s", x.Name, err)
+		}
+		if x.Name != DefaultRealm {
+			if _, ok := realms[x.Name]; ok {
+				return fmt.Errorf("realm %s: duplicate name", x.Name)
+			}
+		}
+		realms[x.Name] = config
+		for _, host := range config.Hosts {
+			host = strings.ToLower(host)
+			if _, ok := realmHosts[host]; ok {
+				return fmt.Errorf("realm %s: duplicate host %s", x.Name, host)
+			}
+			realmHosts[host] = config
+		}
+	}
+	return nil
+}
+
+func (x *realmFile) config() (*RealmConfig, error) {
+	if !realmNameRe.MatchString(x.Name) {
+		return nil, errors.New("invalid name")
+	}
+	config := &RealmConfig{
+		Name:           x.Name,
+		Hosts:          x.Hosts,
+		CookieName:     x.CookieName,
+		CookieExpire:   Session.CookieExpire,
+		PasswordPolicy: PasswordPolicy,
+	}
+	if config.CookieName == "" {
+		config.CookieName = Session.CookieName
+		if x.Name != DefaultRealm {
+			config.CookieName += "_" + x.Name
+		}
+	}
+	durations := []struct {
+		value string
+		dest  *time.Duration
+	}{
+		{x.CookieExpire, &config.CookieExpire},
+		{x.SessionExpire, &config.SessionExpire},
+		{x.PasswordMaxAge, &config.PasswordPolicy.MaxAge},
+	}
+	for _, d := range durations {
+		if d.value == "" {
+			continue
+		}
+		v, err := time.ParseDuration(d.value)
+		if err != nil {
+			return nil, err
+		}
+		*d.dest = v
+	}
+	if len(x.PasswordPolicy) > 0 {
+		// 全体の設定の上に指定された項目だけを上書きする
+		if err := json.Unmarshal(x.PasswordPolicy, &config.PasswordPolicy); err != nil {
+			return nil, err
+		}
+	}
+	return config, nil
+}
+
+// LookupRealm は名前でレルムを探す。空の名前は既定のレルムとして扱う
+func LookupRealm(name string) (*RealmConfig, bool) {
+	if name == "" {
+		name = DefaultRealm
+	}
+	if name == DefaultRealm {
+		return defaultRealm(), true
+	}
+	config, ok := realms[name]
+	return config, ok
+}
+
+// RealmFor はレルムの設定を返す。見つからない場合は既定のレルムを返す
+func RealmFor(name string) *RealmConfig {
+	if config, ok := LookupRealm(name); ok {
+		return config
+	}
+	return defaultRealm()
+}
+
+// RealmByHost はHostヘッダーに対応するレルムを返す。対応がない場合は既定のレルムを返す
+func RealmByHost(host string) *RealmConfig {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if config, ok := realmHosts[strings.ToLower(host)]; ok {
+		return config
+	}
+	return defaultRealm()
+}
+
+func defaultRealm() *RealmConfig {
+	if config, ok := realms[DefaultRealm]; ok {
+		return config
+	}
+	// LoadRealmsの前は全体の設定をそのまま使用する
+	return &RealmConfig{
+		Name:           DefaultRealm,
+		CookieName:     Session.CookieName,
+		CookieExpire:   Session.CookieExpire,
+		PasswordPolicy: PasswordPolicy,
+	}
+}
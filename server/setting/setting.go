@@ -1,6 +1,7 @@
 package setting
 
 import (
+	"os"
 	"time"
 )
 
@@ -15,10 +16,154 @@ var Session = session{}
 type session struct {
 	CookieName   string
 	CookieExpire time.Duration
+	Backend      string // memory, file, sql, redis
+	Dir          string // fileの場合の保存先のディレクトリ
+	SQLDriver    string // sqlの場合のdatabase/sqlのドライバー名(sqliteのみ対応)
+	SQLDSN       string
+	RedisURL     string // redisの場合の接続先(redis://[:password@]host:port/db)
+	RedisPrefix  string // redisのキーの接頭辞
+	// memoryの場合に停止時のセッションを保存し、起動時に復元するファイル(空の場合は保存しない)
+	SnapshotPath     string
+	SnapshotInterval time.Duration // 停止時以外に保存する間隔(0の場合は停止時のみ)
+	SnapshotKey      string        // "ID:鍵(base64)"。KeyとKeyFileのいずれかが設定されている場合は暗号化する
+	SnapshotKeyFile  string
+}
+
+var UserStore = userStore{}
+
+type userStore struct {
+	Type           string // json, sqlite, bolt, htpasswd
+	JSONPath       string
+	SQLitePath     string
+	BoltPath       string
+	HtpasswdPath   string
+	HtgroupPath    string        // htpasswdのユーザーのロール(存在しない場合はすべてuser)
+	ReloadInterval time.Duration // ファイルの変更を確認する間隔(0の場合は確認しない)
+	Strict         bool          // trueの場合は検証でエラーのあるデータを読み込まない
+	// Key とKeyFile のいずれかが設定されている場合はJSONファイルを暗号化して保存する
+	Key     string // "ID:鍵(base64)"。KeyFileの鍵より優先して暗号化に使用する
+	KeyFile string // 1行に1つ"ID:鍵(base64)"。先頭の鍵で暗号化し、残りは復号にのみ使用する
+}
+
+var RBAC = rbac{}
+
+type rbac struct {
+	Path string // ロールとグループの定義ファイル(存在しない場合は既定の定義を使用する)
+}
+
+var Password = password{}
+
+type password struct {
+	Algorithm        string // bcrypt, scrypt, argon2id, pbkdf2-sha256
+	Pepper           string // サーバー側で付与するペッパー(空の場合は使用しない)
+	BcryptCost       int
+	ScryptN          int
+	ScryptR          int
+	ScryptP          int
+	Argon2Time       uint32
+	Argon2Memory     uint32 // KiB
+	Argon2Threads    uint8
+	PBKDF2Iterations int
+}
+
+var PasswordPolicy = passwordPolicy{}
+
+type passwordPolicy struct {
+	MinLength        int           `json:"min_length"`
+	MaxLength        int           `json:"max_length"` // 0の場合は制限しない
+	RequireUpper     bool          `json:"require_upper"`
+	RequireLower     bool          `json:"require_lower"`
+	RequireDigit     bool          `json:"require_digit"`
+	RequireSymbol    bool          `json:"require_symbol"`
+	DisallowUserInfo bool          `json:"disallow_user_info"` // UserIDや氏名を含むパスワードを禁止する
+	MaxRepeated      int           `json:"max_repeated"`       // 同じ文字の連続を許可する回数(0の場合は制限しない)
+	HistoryDepth     int           `json:"history_depth"`      // 再利用を禁止する過去のパスワードの件数(0の場合は確認しない)
+	MaxAge           time.Duration `json:"-"`                  // パスワードの有効期間(0の場合は期限なし)
+}
+
+var Lockout = lockout{}
+
+type lockout struct {
+	MaxFailures int           // ロックするまでの連続失敗回数(0の場合はロックしない)
+	Cooldown    time.Duration // 最初のロックの期間。以降のロックごとに倍になる
+	MaxCooldown time.Duration
+}
+
+var Realm = realm{}
+
+type realm struct {
+	Path string // レルムの定義ファイル(存在しない場合は既定のレルムのみ)
+}
+
+var Audit = audit{}
+
+type audit struct {
+	Path string
+	Key  string // 設定されている場合はイベントのハッシュにHMACを使用する
 }
 
 func Load() {
 	Server.Port = ":3000"
 	Session.CookieName = "gowebserver_session_id"
 	Session.CookieExpire = (1 * time.Hour)
+	Session.Backend = "memory"
+	if backend := os.Getenv("GOAUTH_SESSION_BACKEND"); backend != "" {
+		Session.Backend = backend
+	}
+	Session.Dir = "../data/sessions"
+	Session.SQLDriver = "sqlite"
+	Session.SQLDSN = "../data/sessions.sqlite"
+	Session.RedisURL = "redis://localhost:6379/0"
+	if url := os.Getenv("GOAUTH_REDIS_URL"); url != "" {
+		Session.RedisURL = url
+	}
+	Session.RedisPrefix = "goauth:session:"
+	Session.SnapshotPath = "../data/sessions.snapshot"
+	if path, ok := os.LookupEnv("GOAUTH_SESSION_SNAPSHOT"); ok {
+		Session.SnapshotPath = path
+	}
+	Session.SnapshotInterval = (1 * time.Minute)
+	Session.SnapshotKey = os.Getenv("GOAUTH_SESSION_KEY")
+	Session.SnapshotKeyFile = os.Getenv("GOAUTH_SESSION_KEY_FILE")
+	UserStore.Type = "json"
+	UserStore.JSONPath = "../data/users.json"
+	if path := os.Getenv("GOAUTH_USERS_FILE"); path != "" {
+		UserStore.JSONPath = path
+	}
+	UserStore.ReloadInterval = (5 * time.Second)
+	UserStore.Strict = os.Getenv("GOAUTH_USERS_STRICT") == "1"
+	UserStore.Key = os.Getenv("GOAUTH_USERS_KEY")
+	UserStore.KeyFile = os.Getenv("GOAUTH_USERS_KEY_FILE")
+	UserStore.SQLitePath = "../data/users.sqlite"
+	UserStore.BoltPath = "../data/users.bolt"
+	UserStore.HtpasswdPath = "../data/users.htpasswd"
+	UserStore.HtgroupPath = "../data/users.htgroup"
+	RBAC.Path = "../data/roles.json"
+	Password.Algorithm = "bcrypt"
+	Password.Pepper = os.Getenv("GOAUTH_PASSWORD_PEPPER")
+	Password.BcryptCost = 12
+	Password.ScryptN = 32768
+	Password.ScryptR = 8
+	Password.ScryptP = 1
+	Password.Argon2Time = 3
+	Password.Argon2Memory = 64 * 1024
+	Password.Argon2Threads = 2
+	Password.PBKDF2Iterations = 310000
+	PasswordPolicy.MinLength = 10
+	PasswordPolicy.MaxLength = 128
+	PasswordPolicy.RequireUpper = true
+	PasswordPolicy.RequireLower = true
+	PasswordPolicy.RequireDigit = true
+	PasswordPolicy.RequireSymbol = false
+	PasswordPolicy.DisallowUserInfo = true
+	PasswordPolicy.MaxRepeated = 3
+	PasswordPolicy.HistoryDepth = 5
+	PasswordPolicy.MaxAge = (90 * 24 * time.Hour)
+	Realm.Path = "../data/realms.json"
+	LDAP.Path = "../data/ldap.json"
+	Audit.Path = "../data/audit.log"
+	Audit.Key = os.Getenv("GOAUTH_AUDIT_KEY")
+	Lockout.MaxFailures = 5
+	Lockout.Cooldown = (1 * time.Minute)
+	Lockout.MaxCooldown = (1 * time.Hour)
 }
@@ -38,4 +38,16 @@ func loadTemplates() {
 	templates["admin_users"] = template.Must(
 		template.ParseFiles(baseTemplate, "../client/templates/admin_users.html"),
 	)
+	templates["admin_user_edit"] = template.Must(
+		template.ParseFiles(baseTemplate, "../client/templates/admin_user_edit.html"),
+	)
+	templates["admin_users_import"] = template.Must(
+		template.ParseFiles(baseTemplate, "../client/templates/admin_users_import.html"),
+	)
+	templates["admin_users_validation"] = template.Must(
+		template.ParseFiles(baseTemplate, "../client/templates/admin_users_validation.html"),
+	)
+	templates["change_password"] = template.Must(
+		template.ParseFiles(baseTemplate, "../client/templates/change_password.html"),
+	)
 }
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"github.com/knanao/goauth/server/model"
+	"github.com/labstack/echo"
+)
+
+// watchUsers はユーザーの変更を監視し、削除または無効化されたユーザーのセッションを破棄する
+//
+// 購読が遅れて解除された場合は登録し直し、解除されていた間に取りこぼした変更を
+// 現在のユーザーとの比較で補う。UserDataAccessorの停止で終了する
+func watchUsers(e *echo.Echo) {
+	// known は通知で把握しているユーザー。取りこぼした削除を検出するために使用する
+	known := make(map[sessionUser]bool)
+	for {
+		ch, _, err := userDA.Watch(64)
+		if err != nil {
+			if err != model.ErrorStopped {
+				e.Logger.Errorf("User Watch Error. [%s]", err)
+			}
+			return
+		}
+		// 登録した後に比較するため、比較以降の変更はすべて通知で受け取れる
+		current, err := resyncUsers(e, known)
+		if err != nil {
+			e.Logger.Errorf("User Watch Resync Error. [%s]", err)
+		} else {
+			known = current
+		}
+		for event := range ch {
+			for _, x := range invalidatedUsers(&event) {
+				invalidateSessions(e, x, string(event.Type))
+			}
+			switch event.Type {
+			case model.ChangeDeleted:
+				delete(known, sessionUser{event.User.RealmName(), event.User.UserID})
+			case model.ChangeUpdated:
+				if event.Previous != nil {
+					delete(known, sessionUser{event.Previous.RealmName(), event.Previous.UserID})
+				}
+				fallthrough
+			case model.ChangeCreated:
+				known[sessionUser{event.User.RealmName(), event.User.UserID}] = true
+			}
+		}
+	}
+}
+
+// sessionUser はセッションに保存されるレルムとUserIDの組
+type sessionUser struct {
+	realm  string
+	userID string
+}
+
+// resyncUsers は把握しているユーザーのうち存在しなくなったユーザーと、
+// 無効化されているユーザーのセッションを破棄し、現在のユーザーの一覧を返す
+func resyncUsers(e *echo.Echo, known map[sessionUser]bool) (map[sessionUser]bool, error) {
+	records, err := userDA.FindAll()
+	if err != nil {
+		return nil, err
+	}
+	current := make(map[sessionUser]bool)
+	for _, x := range records {
+		key := sessionUser{x.RealmName(), x.UserID}
+		current[key] = true
+		if x.Disabled {
+			invalidateSessions(e, key, "resync:disabled")
+		}
+	}
+	for key := range known {
+		if !current[key] {
+			invalidateSessions(e, key, "resync:deleted")
+		}
+	}
+	return current, nil
+}
+
+func invalidateSessions(e *echo.Echo, x sessionUser, reason string) {
+	match := map[string]string{"realm": x.realm, "user_id": x.userID}
+	n, err := sessionManager.DeleteByData(match)
+	if err != nil {
+		e.Logger.Errorf("User[%s] Session invalidation Error. [%s]", x.userID, err)
+		return
+	}
+	if n > 0 {
+		e.Logger.Infof("User[%s] Sessions invalidated. reason[%s] sessions[%d]", x.userID, reason, n)
+	}
+}
+
+// invalidatedUsers はセッションを破棄する必要があるユーザーを返す
+func invalidatedUsers(event *model.ChangeEvent) []sessionUser {
+	switch event.Type {
+	case model.ChangeDeleted:
+		return []sessionUser{{event.User.RealmName(), event.User.UserID}}
+	case model.ChangeUpdated:
+		results := []sessionUser{}
+		if event.User.Disabled {
+			results = append(results, sessionUser{event.User.RealmName(), event.User.UserID})
+		}
+		// UserIDやレルムが変わった場合は以前のセッションが残らないようにする
+		if event.Previous != nil && (event.Previous.UserID != event.User.UserID ||
+			event.Previous.RealmName() != event.User.RealmName()) {
+			results = append(results, sessionUser{event.Previous.RealmName(), event.Previous.UserID})
+		}
+		return results
+	}
+	return nil
+}